@@ -0,0 +1,199 @@
+package prominence
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Importer for ESRI ASCII grids (.asc), as exported by most GIS tools.
+// http://resources.esri.com/help/9.3/arcgisengine/java/GP_ToolRef/spatial_analyst_tools/esri_ascii_raster_format.htm
+//
+// The file is a header of keyword/value pairs:
+//   ncols, nrows: size of the raster
+//   xllcorner, yllcorner (or xllcenter, yllcenter): lower left
+//     corner (or center of the lower left cell), in degrees
+//   cellsize (or dx and dy): cell size, in degrees
+//   NODATA_value: value of missing cells (optional)
+// followed by nrows rows of ncols values, north to south, separated
+// by white space.  Values are heights in meters, and may have
+// fractional parts, so we store them internally in decimeters.
+//
+// Grid coordinates are as for all rasters (see raster).
+
+// An ASCIIGrid is a DataSet for the ESRI ASCII grid file of the given name.
+type ASCIIGrid struct {
+	name string
+	raster
+}
+
+// NewASCIIGrid returns an ASCIIGrid which reads the named file.
+func NewASCIIGrid(name string) *ASCIIGrid {
+	return &ASCIIGrid{name: name}
+}
+
+func (g *ASCIIGrid) Init() error {
+	f, err := os.Open(g.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := g.readHeader(bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("%s: %v", g.name, err)
+	}
+	return nil
+}
+
+// readHeader reads the header from r and returns the
+// first value of the raster.
+func (g *ASCIIGrid) readHeader(r *bufio.Reader) (string, error) {
+	h := map[string]float64{}
+	for {
+		key, err := readWord(r)
+		if err != nil {
+			return "", fmt.Errorf("reading header: %v", err)
+		}
+		if _, err := strconv.ParseFloat(key, 64); err == nil {
+			// Start of the raster.
+			if err := g.setHeader(h); err != nil {
+				return "", err
+			}
+			return key, nil
+		}
+		val, err := readWord(r)
+		if err != nil {
+			return "", fmt.Errorf("reading header: %v", err)
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad %s value %q", key, val)
+		}
+		h[strings.ToLower(key)] = v
+	}
+}
+
+// setHeader sets the raster description from header values h.
+func (g *ASCIIGrid) setHeader(h map[string]float64) error {
+	for _, k := range []string{"ncols", "nrows"} {
+		if _, ok := h[k]; !ok {
+			return fmt.Errorf("missing %s", k)
+		}
+	}
+	g.width = int(h["ncols"])
+	g.length = int(h["nrows"])
+	if g.width <= 0 || g.length <= 0 {
+		return fmt.Errorf("bad raster size %dx%d", g.width, g.length)
+	}
+	if c, ok := h["cellsize"]; ok {
+		g.scalex, g.scaley = c, c
+	} else {
+		g.scalex, g.scaley = h["dx"], h["dy"]
+	}
+	if g.scalex <= 0 || g.scaley <= 0 {
+		return fmt.Errorf("missing or bad cellsize")
+	}
+	x, okx := h["xllcenter"]
+	y, oky := h["yllcenter"]
+	if !okx || !oky {
+		x, okx = h["xllcorner"]
+		y, oky = h["yllcorner"]
+		if !okx || !oky {
+			return fmt.Errorf("missing xllcorner/yllcorner")
+		}
+		x += g.scalex / 2
+		y += g.scaley / 2
+	}
+	g.long0 = x
+	g.lat0 = y + float64(g.length-1)*g.scaley
+	g.nodata, g.hasNodata = h["nodata_value"]
+	g.scalez = 0.1
+	return nil
+}
+
+// readWord returns the next white-space-separated word from r.
+func readWord(r *bufio.Reader) (string, error) {
+	var w []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if len(w) > 0 {
+				return string(w), nil
+			}
+			return "", err
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			if len(w) > 0 {
+				return string(w), nil
+			}
+		default:
+			w = append(w, c)
+		}
+	}
+}
+
+func (g *ASCIIGrid) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	return g.readRows(done, 0, Coord(g.length))
+}
+
+func (g *ASCIIGrid) readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c)
+		err := g.read(c, done, miny, maxy)
+		if err != nil && err != errCanceled {
+			err = fmt.Errorf("%s: %v", g.name, err)
+		}
+		errc <- err
+	}()
+	return c, errc
+}
+
+// read sends the samples of g in rows [miny, maxy) to c.
+// The rows before miny still have to be scanned, but not parsed.
+func (g *ASCIIGrid) read(c chan<- []Cell, done <-chan struct{}, miny, maxy Coord) error {
+	f, err := os.Open(g.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Print("reading " + g.name)
+	r := bufio.NewReaderSize(f, 1<<16)
+	w, err := g.readHeader(r)
+	if err != nil {
+		return err
+	}
+	chunker := cellChunker{c: c, done: done}
+	for y := 0; y < g.length && Coord(y) < maxy; y++ {
+		for x := 0; x < g.width; x++ {
+			if x != 0 || y != 0 {
+				w, err = readWord(r)
+				if err != nil {
+					return fmt.Errorf("reading row %d column %d: %v", y, x, err)
+				}
+			}
+			if Coord(y) < miny {
+				continue
+			}
+			v, err := strconv.ParseFloat(w, 64)
+			if err != nil {
+				return fmt.Errorf("row %d column %d: bad value %q", y, x, w)
+			}
+			z, ok := g.height(v)
+			if !ok {
+				continue
+			}
+			if !chunker.send(Cell{Point{Coord(x), Coord(y)}, z}) {
+				return errCanceled
+			}
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package prominence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Importer for BIL (band interleaved by line) rasters, which are
+// raw samples described by a .hdr file of the same name.
+// http://webhelp.esri.com/arcgisdesktop/9.3/index.cfm?TopicName=BIL,_BIP,_and_BSQ_raster_files
+//
+// The header is lines of keyword and value.  We use:
+//   NROWS, NCOLS: size of the raster
+//   NBANDS: must be 1
+//   NBITS: 16 or 32
+//   PIXELTYPE: SIGNEDINT (the default), UNSIGNEDINT or FLOAT
+//   BYTEORDER: I (little-endian, the default) or M (big-endian)
+//   SKIPBYTES: bytes to skip at the start of the file
+//   BANDROWBYTES, TOTALROWBYTES: bytes in each row, if padded
+//   ULXMAP, ULYMAP: center of the upper left cell, in degrees
+//   XDIM, YDIM: cell size, in degrees
+//   NODATA: value of missing cells (optional)
+// Samples are heights in meters.  Float samples are stored
+// internally in decimeters.
+//
+// Grid coordinates are as for all rasters (see raster).
+
+// A BIL is a DataSet for the BIL file of the given name.
+type BIL struct {
+	name string
+	raster
+
+	order      binary.ByteOrder
+	bits       int
+	float      bool
+	signed     bool
+	skip       int64
+	rowBytes   int
+	totalBytes int
+}
+
+// NewBIL returns a BIL which reads the named file.  The header
+// is the file of the same name with the extension .hdr.
+func NewBIL(name string) *BIL {
+	return &BIL{name: name}
+}
+
+func (b *BIL) Init() error {
+	if err := b.readHeader(); err != nil {
+		return fmt.Errorf("%s: %v", b.name, err)
+	}
+	return nil
+}
+
+// hdrName returns the name of the header file for b.
+func (b *BIL) hdrName() string {
+	base := strings.TrimSuffix(b.name, filepath.Ext(b.name))
+	if _, err := os.Stat(base + ".HDR"); err == nil {
+		return base + ".HDR"
+	}
+	return base + ".hdr"
+}
+
+// readHeader reads and checks the .hdr file.
+func (b *BIL) readHeader() error {
+	f, err := os.Open(b.hdrName())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		h[strings.ToUpper(fields[0])] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	num := func(k string, def float64) (float64, error) {
+		v, ok := h[k]
+		if !ok {
+			return def, nil
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s value %q", k, v)
+		}
+		return x, nil
+	}
+	var vals [10]float64
+	for i, k := range []string{"NROWS", "NCOLS", "NBANDS", "NBITS", "SKIPBYTES", "BANDROWBYTES", "ULXMAP", "ULYMAP", "XDIM", "YDIM"} {
+		def := math.NaN()
+		switch k {
+		case "NBANDS":
+			def = 1
+		case "NBITS":
+			def = 8
+		case "SKIPBYTES", "BANDROWBYTES":
+			def = 0
+		}
+		v, err := num(k, def)
+		if err != nil {
+			return err
+		}
+		if math.IsNaN(v) {
+			return fmt.Errorf("missing %s", k)
+		}
+		vals[i] = v
+	}
+	b.length, b.width = int(vals[0]), int(vals[1])
+	if b.width <= 0 || b.length <= 0 {
+		return fmt.Errorf("bad raster size %dx%d", b.width, b.length)
+	}
+	if vals[2] != 1 {
+		return fmt.Errorf("%g bands, only 1 is supported", vals[2])
+	}
+	b.bits = int(vals[3])
+	b.skip = int64(vals[4])
+	b.long0, b.lat0 = vals[6], vals[7]
+	b.scalex, b.scaley = vals[8], vals[9]
+	if b.scalex <= 0 || b.scaley <= 0 {
+		return fmt.Errorf("bad cell size %gx%g", b.scalex, b.scaley)
+	}
+
+	switch l := strings.ToUpper(h["LAYOUT"]); l {
+	case "", "BIL", "BIP", "BSQ":
+		// With one band, all layouts are the same.
+	default:
+		return fmt.Errorf("unknown layout %s", l)
+	}
+	switch strings.ToUpper(h["BYTEORDER"]) {
+	case "", "I":
+		b.order = binary.LittleEndian
+	case "M":
+		b.order = binary.BigEndian
+	default:
+		return fmt.Errorf("unknown byte order %s", h["BYTEORDER"])
+	}
+	switch strings.ToUpper(h["PIXELTYPE"]) {
+	case "", "SIGNEDINT":
+		b.signed = true
+	case "UNSIGNEDINT":
+	case "FLOAT":
+		b.float = true
+	default:
+		return fmt.Errorf("unknown pixel type %s", h["PIXELTYPE"])
+	}
+	switch {
+	case b.bits == 16 && !b.float, b.bits == 32:
+	default:
+		return fmt.Errorf("%d-bit %s samples not supported", b.bits, strings.ToLower(h["PIXELTYPE"]))
+	}
+
+	b.rowBytes = b.width * b.bits / 8
+	if r := int(vals[5]); r != 0 {
+		if r < b.rowBytes {
+			return fmt.Errorf("BANDROWBYTES %d too small", r)
+		}
+		b.rowBytes = r
+	}
+	t, err := num("TOTALROWBYTES", float64(b.rowBytes))
+	if err != nil {
+		return err
+	}
+	b.totalBytes = int(t)
+	if b.totalBytes < b.rowBytes {
+		return fmt.Errorf("TOTALROWBYTES %d too small", b.totalBytes)
+	}
+
+	if v, ok := h["NODATA"]; ok {
+		b.nodata, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("bad NODATA value %q", v)
+		}
+		b.hasNodata = true
+	}
+	b.scalez = 1
+	if b.float {
+		b.scalez = 0.1
+	}
+	return nil
+}
+
+func (b *BIL) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	return b.readRows(done, 0, Coord(b.length))
+}
+
+func (b *BIL) readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c)
+		err := b.read(c, done, miny, maxy)
+		if err != nil && err != errCanceled {
+			err = fmt.Errorf("%s: %v", b.name, err)
+		}
+		errc <- err
+	}()
+	return c, errc
+}
+
+// read sends the samples of b in rows [miny, maxy) to c.
+func (b *BIL) read(c chan<- []Cell, done <-chan struct{}, miny, maxy Coord) error {
+	if miny < 0 {
+		miny = 0
+	}
+	if maxy > Coord(b.length) {
+		maxy = Coord(b.length)
+	}
+	f, err := os.Open(b.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Print("reading " + b.name)
+	if _, err := f.Seek(b.skip+int64(miny)*int64(b.totalBytes), io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 1<<16)
+	row := make([]byte, b.totalBytes)
+	chunker := cellChunker{c: c, done: done}
+	for y := int(miny); y < int(maxy); y++ {
+		if y == b.length-1 {
+			row = row[:b.rowBytes] // padding after the last row is optional
+		}
+		if _, err := io.ReadFull(r, row); err != nil {
+			return fmt.Errorf("reading row %d: %v", y, err)
+		}
+		for x := 0; x < b.width; x++ {
+			z, ok := b.height(b.sample(row, x))
+			if !ok {
+				continue
+			}
+			if !chunker.send(Cell{Point{Coord(x), Coord(y)}, z}) {
+				return errCanceled
+			}
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
+
+// sample returns the i'th sample of row.
+func (b *BIL) sample(row []byte, i int) float64 {
+	switch {
+	case b.bits == 16 && b.signed:
+		return float64(int16(b.order.Uint16(row[2*i:])))
+	case b.bits == 16:
+		return float64(b.order.Uint16(row[2*i:]))
+	case b.float:
+		return float64(math.Float32frombits(b.order.Uint32(row[4*i:])))
+	case b.signed:
+		return float64(int32(b.order.Uint32(row[4*i:])))
+	default:
+		return float64(b.order.Uint32(row[4*i:]))
+	}
+}
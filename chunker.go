@@ -1,37 +1,65 @@
-package main
+package prominence
 
-import "sync"
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// workers is the number of goroutines the importers (and the tile
+// renderer) use to do their work in parallel.
+var workers = runtime.NumCPU()
 
 // A cellChunker gathers batches of cells to send over a []cell channel.
 type cellChunker struct {
-	buf []cell
-	c   chan<- []cell
+	buf []Cell
+	c   chan<- []Cell
+	// done, if not nil, is closed when the receiver no longer
+	// wants any cells.
+	done <-chan struct{}
 }
 
 // send will send c over the underlying channel, eventually.
-func (cc *cellChunker) send(c cell) {
+// It returns false if done has been closed, in which case
+// the sender should stop.
+func (cc *cellChunker) send(c Cell) bool {
 	buf := cc.buf
 	if len(buf) == cap(buf) {
 		if len(buf) > 0 {
-			cc.c <- buf
+			select {
+			case cc.c <- buf:
+			case <-cc.done:
+				return false
+			}
 		}
 		i := chunkPool.Get()
 		if i != nil {
-			buf = i.([]cell)[:0]
+			buf = i.([]Cell)[:0]
 		} else {
-			buf = make([]cell, 0, 1024)
+			buf = make([]Cell, 0, 1024)
 		}
 	}
 	cc.buf = append(buf, c)
+	return true
 }
 
 // flush sends all pending cells, now.
-func (cc *cellChunker) flush() {
+// It returns false if done has been closed.
+func (cc *cellChunker) flush() bool {
 	if len(cc.buf) > 0 {
-		cc.c <- cc.buf
+		select {
+		case cc.c <- cc.buf:
+		case <-cc.done:
+			return false
+		}
 		cc.buf = nil
 	}
+	return true
 }
 
 // A pool of unused buffers
 var chunkPool sync.Pool
+
+// errCanceled is reported by readers which stopped because
+// their done channel was closed.
+var errCanceled = errors.New("canceled")
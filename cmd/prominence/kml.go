@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/randall77/prominence"
+)
+
+// KML output, for Google Earth.
+//
+// Peaks are grouped into folders by prominence band, and their icons
+// are colored and scaled by band.  Each peak which is not an island
+// top also has a placemark at its key col, and a line from the peak
+// through the key col to the dominating peak, so cols can be checked
+// by eye against the imagery.  Basins (with -wet) go in one folder.
+
+// kmlBands are the prominence bands, most prominent first,
+// with the style of their peaks.
+var kmlBands = []struct {
+	min   float64 // meters
+	name  string
+	color string // aabbggrr
+	scale float64
+}{
+	{1500, "1500m and up", "ff0000ff", 1.4},
+	{600, "600m to 1500m", "ff0080ff", 1.2},
+	{300, "300m to 600m", "ff00ffff", 1.0},
+	{100, "100m to 300m", "ff00ff00", 0.8},
+	{math.Inf(-1), "under 100m", "ffffffff", 0.6},
+}
+
+const (
+	kmlPeakIcon = "http://maps.google.com/mapfiles/kml/shapes/triangle.png"
+	kmlColIcon  = "http://maps.google.com/mapfiles/kml/shapes/placemark_circle.png"
+)
+
+// A kmlWriter writes a KML document.  Folders must be written
+// whole, so it holds the placemarks of each one until Close.
+type kmlWriter struct {
+	*outFile
+	pos    prominence.Positioner
+	bands  []bytes.Buffer // placemarks in each of kmlBands
+	basins bytes.Buffer
+}
+
+func newKMLWriter(f *outFile, pos prominence.Positioner) *kmlWriter {
+	fmt.Fprintln(f, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
+	fmt.Fprintln(f, "<kml xmlns=\"http://www.opengis.net/kml/2.2\">")
+	fmt.Fprintln(f, "<Document>")
+	for k, b := range kmlBands {
+		fmt.Fprintf(f, "  <Style id=\"band%d\"><IconStyle><color>%s</color><scale>%.1f</scale><Icon><href>%s</href></Icon></IconStyle></Style>\n",
+			k, b.color, b.scale, kmlPeakIcon)
+	}
+	fmt.Fprintf(f, "  <Style id=\"col\"><IconStyle><color>ffff8000</color><scale>0.6</scale><Icon><href>%s</href></Icon></IconStyle></Style>\n", kmlColIcon)
+	fmt.Fprintln(f, "  <Style id=\"keycol\"><LineStyle><color>c0ff8000</color><width>2</width></LineStyle></Style>")
+	fmt.Fprintf(f, "  <Style id=\"basin\"><IconStyle><color>ffff0000</color><scale>0.8</scale><Icon><href>%s</href></Icon></IconStyle></Style>\n", kmlColIcon)
+	return &kmlWriter{outFile: f, pos: pos, bands: make([]bytes.Buffer, len(kmlBands))}
+}
+
+func (w *kmlWriter) Peak(r prominence.Peak, iso *prominence.Isolation) {
+	k := 0
+	for r.Prom < kmlBands[k].min {
+		k++
+	}
+	b := &w.bands[k]
+
+	pos := w.pos
+	x, y, z := pos.Pos(r.Peak)
+	desc := fmt.Sprintf("height=%.0f<br>prominence=%.0f", z, r.Prom)
+	if *verrPtr > 0 {
+		desc += fmt.Sprintf("<br>clean prominence=%.0f<br>optimistic prominence=%.0f", r.Clean, r.Optimistic)
+		if r.Uncertain {
+			desc += "<br>key col uncertain"
+		}
+	}
+	if r.PeakFilled {
+		desc += "<br>peak in filled void"
+	}
+	if r.ColFilled {
+		desc += "<br>key col in filled void"
+	}
+	if r.PeakRegion.Size > 1 {
+		desc += "<br>peak plateau=" + regionString(pos, r.PeakRegion)
+	}
+	if !r.Island {
+		desc += fmt.Sprintf("<br>line parent=%s<br>prominence parent=%s", locString(pos, r.LineParent), locString(pos, r.PromParent))
+		if r.ColRegion.Size > 1 {
+			desc += "<br>col plateau=" + regionString(pos, r.ColRegion)
+		}
+	}
+	if iso != nil && !math.IsInf(iso.Dist, 1) {
+		desc += fmt.Sprintf("<br>isolation=%.1fkm", iso.Dist)
+	}
+	writePlacemark(b, fmt.Sprintf("%.0fm", r.Prom), fmt.Sprintf("band%d", k), x, y, desc)
+	if r.Island {
+		return
+	}
+
+	cx, cy, cz := pos.Pos(r.Col)
+	desc = fmt.Sprintf("height=%.0f<br>key col of %s", cz, locString(pos, r.Peak))
+	if r.ColFilled {
+		desc += "<br>in filled void"
+	}
+	if r.ColRegion.Size > 1 {
+		desc += "<br>plateau=" + regionString(pos, r.ColRegion)
+	}
+	writePlacemark(b, "", "col", cx, cy, desc)
+
+	dx, dy, _ := pos.Pos(r.Dom)
+	fmt.Fprintln(b, "  <Placemark>")
+	fmt.Fprintln(b, "    <styleUrl>#keycol</styleUrl>")
+	fmt.Fprintln(b, "    <LineString>")
+	fmt.Fprintln(b, "      <tessellate>1</tessellate>")
+	fmt.Fprintf(b, "      <coordinates>%f,%f %f,%f %f,%f</coordinates>\n", x, y, cx, cy, dx, dy)
+	fmt.Fprintln(b, "    </LineString>")
+	fmt.Fprintln(b, "  </Placemark>")
+}
+
+func (w *kmlWriter) Basin(b basinReport) {
+	x, y, z := w.pos.Pos(b.sink)
+	desc := fmt.Sprintf("height=%.0f<br>depth=%.0f", z, b.depth)
+	name := fmt.Sprintf("%.0fm", b.depth)
+	if b.closed {
+		desc = fmt.Sprintf("height=%.0f<br>closed", z)
+		name = "closed"
+	}
+	writePlacemark(&w.basins, name, "basin", x, y, desc)
+}
+
+func (w *kmlWriter) Close() error {
+	for k := range kmlBands {
+		writeFolder(w, "Prominence "+kmlBands[k].name, &w.bands[k])
+	}
+	writeFolder(w, "Basins", &w.basins)
+	fmt.Fprintln(w, "</Document>")
+	fmt.Fprintln(w, "</kml>")
+	return w.outFile.Close()
+}
+
+// writeFolder writes a KML folder with the placemarks in b, if any.
+func writeFolder(w io.Writer, name string, b *bytes.Buffer) {
+	if b.Len() == 0 {
+		return
+	}
+	fmt.Fprintln(w, "<Folder>")
+	fmt.Fprintf(w, "  <name>%s</name>\n", xmlText(name))
+	b.WriteTo(w)
+	fmt.Fprintln(w, "</Folder>")
+}
+
+// writePlacemark writes a KML placemark at (x, y) with the given
+// name (if not empty), style and description.
+func writePlacemark(w io.Writer, name, style string, x, y float64, desc string) {
+	fmt.Fprintln(w, "  <Placemark>")
+	if name != "" {
+		fmt.Fprintf(w, "    <name>%s</name>\n", xmlText(name))
+	}
+	fmt.Fprintf(w, "    <styleUrl>#%s</styleUrl>\n", style)
+	fmt.Fprintln(w, "    <Point>")
+	fmt.Fprintf(w, "       <coordinates>%f,%f</coordinates>\n", x, y)
+	fmt.Fprintln(w, "    </Point>")
+	// CDATA can't hold "]]>", so split it between two sections.
+	desc = strings.Replace(desc, "]]>", "]]]]><![CDATA[>", -1)
+	fmt.Fprintf(w, "   <description><![CDATA[%s]]></description>\n", desc)
+	fmt.Fprintln(w, "  </Placemark>")
+}
+
+// xmlText escapes s for use as XML character data.
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
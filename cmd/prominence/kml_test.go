@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randall77/prominence"
+)
+
+// A kmlDoc is the part of a KML document we check.
+type kmlDoc struct {
+	Document struct {
+		Styles []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"Style"`
+		Folders []kmlFolder `xml:"Folder"`
+	}
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	StyleURL    string `xml:"styleUrl"`
+	Point       string `xml:"Point>coordinates"`
+	LineString  string `xml:"LineString>coordinates"`
+	Description string `xml:"description"`
+}
+
+func TestKML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o []outputSpec) { outputs = o }(outputs)
+	kml, kmz := filepath.Join(dir, "out.kml"), filepath.Join(dir, "out.kmz")
+	outputs = []outputSpec{{"kml", kml}, {"kmz", kmz}}
+
+	out, err := openWriters(prominence.SimpleDataSet(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range testPeaks {
+		for _, w := range out {
+			w.Peak(p, nil)
+		}
+	}
+	if err := closeWriters(out); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(kml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc kmlDoc
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("bad KML: %v\n%s", err, b)
+	}
+	styles := map[string]bool{}
+	for _, s := range doc.Document.Styles {
+		styles[s.ID] = true
+	}
+	for _, id := range []string{"band0", "band4", "col", "keycol", "basin"} {
+		if !styles[id] {
+			t.Errorf("no style %s", id)
+		}
+	}
+
+	// The island (900m) and the peak (200m) are in different bands.
+	// The peak has a col placemark and a line through its col.
+	want := []kmlFolder{
+		{"Prominence 600m to 1500m", []kmlPlacemark{
+			{Name: "900m", StyleURL: "#band1", Point: "6.000000,0.000000"},
+		}},
+		{"Prominence 100m to 300m", []kmlPlacemark{
+			{Name: "200m", StyleURL: "#band3", Point: "3.000000,-2.000000"},
+			{StyleURL: "#col", Point: "4.000000,-1.000000"},
+			{StyleURL: "#keycol", LineString: "3.000000,-2.000000 4.000000,-1.000000 6.000000,0.000000"},
+		}},
+	}
+	folders := doc.Document.Folders
+	if len(folders) != len(want) {
+		t.Fatalf("want %d folders, got %d:\n%s", len(want), len(folders), b)
+	}
+	for i, f := range folders {
+		if f.Name != want[i].Name || len(f.Placemarks) != len(want[i].Placemarks) {
+			t.Errorf("folder %d: want %s with %d placemarks, got %s with %d", i, want[i].Name, len(want[i].Placemarks), f.Name, len(f.Placemarks))
+			continue
+		}
+		for j, p := range f.Placemarks {
+			w := want[i].Placemarks[j]
+			if p.Name != w.Name || p.StyleURL != w.StyleURL || strings.TrimSpace(p.Point) != w.Point || strings.TrimSpace(p.LineString) != w.LineString {
+				t.Errorf("%s: placemark %d: want %+v, got %+v", f.Name, j, w, p)
+			}
+		}
+	}
+	if d := folders[1].Placemarks[1].Description; !strings.Contains(d, "key col of") {
+		t.Errorf("bad col description %q", d)
+	}
+
+	// The KMZ holds the same document.
+	z, err := zip.OpenReader(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	if len(z.File) != 1 || z.File[0].Name != "doc.kml" {
+		t.Fatalf("KMZ holds %d files, want just doc.kml", len(z.File))
+	}
+	r, err := z.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zb, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(zb, b) {
+		t.Errorf("KMZ document differs from KML:\n%s", zb)
+	}
+}
+
+func TestKMLEscape(t *testing.T) {
+	var p, f bytes.Buffer
+	writePlacemark(&p, "<Peak> & \"Co\"", "band0", 1, 2, "a ]]> b")
+	writeFolder(&f, "R&D <1>", &p)
+	var got kmlFolder
+	if err := xml.Unmarshal(f.Bytes(), &got); err != nil {
+		t.Fatalf("bad KML: %v\n%s", err, f.Bytes())
+	}
+	if got.Name != "R&D <1>" || len(got.Placemarks) != 1 {
+		t.Fatalf("bad folder %+v", got)
+	}
+	if pm := got.Placemarks[0]; pm.Name != "<Peak> & \"Co\"" || pm.Description != "a ]]> b" {
+		t.Errorf("bad placemark %+v", pm)
+	}
+}
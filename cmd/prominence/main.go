@@ -0,0 +1,573 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/randall77/prominence"
+)
+
+var formatPtr = flag.String("format", "test", "format of input file (test, noaa1, noaa16, hgt, geotiff, asc, bil, stream, synthetic, mosaic, tree)")
+var minPtr = flag.Float64("min", 100, "minimum prominence to display (meters; with -verr, the optimistic prominence)")
+var minSize = flag.Int64("minsize", 100, "minimum island size to display (# samples)")
+var wetPtr = flag.Bool("wet", false, "compute basin depths (wet prominence) instead of prominence")
+var treePtr = flag.String("tree", "", "write the full divide tree to this file")
+var isolationPtr = flag.Bool("isolation", false, "compute isolation of displayed peaks (rereads the data set)")
+var verrPtr = flag.Float64("verr", 0, "vertical error of the data set (meters)")
+var tilePtr = flag.String("tile", "", "GLOBE tiles (a-p): for noaa1, the tile (default from the file name); for noaa16, the tiles to read (default all)")
+var bboxPtr = flag.String("bbox", "", "only read hgt tiles in, or convert, this box: minlong,minlat,maxlong,maxlat (degrees)")
+var seedPtr = flag.Int64("seed", 1, "synthetic: random seed")
+var seaPtr = flag.Int("sealevel", 0, "synthetic: sea level (meters)")
+var plateauPtr = flag.Float64("plateaufreq", 0, "synthetic: fraction of the terrain in plateaus (0 to 1)")
+var fillPtr = flag.Bool("fillvoids", false, "hgt: fill data voids by interpolation, instead of treating them as ocean")
+var oceanPtr = flag.String("ocean", "", "which samples are ocean: none, at:HEIGHT, below:HEIGHT (meters), or mask:FORMAT:NAME for a land/sea mask (default: the format's sentinel)")
+var resPtr = flag.Int("res", 1200, "mosaic: samples per degree")
+var outPtr = flag.String("o", "", "convert: write the stream to this file instead of stdout")
+var tilesPtr = flag.String("tiles", "", "draw the data set and the displayed peaks as web map tiles in this directory (DIR/z/x/y.png, and DIR/index.html to browse them)")
+var zoomPtr = flag.Int("tilezoom", -1, "most detailed zoom level of the tiles (default: to match the data set)")
+var hillshadePtr = flag.Bool("hillshade", false, "shade the tiles by slope")
+var pngPtr = flag.String("png", "", "draw the data set as a PNG image in this file (default globe.png for preview)")
+var pngSizePtr = flag.String("pngsize", "2000x1000", "png: fit the image in WIDTHxHEIGHT pixels, keeping its shape (0 for either is unlimited)")
+var colorsPtr = flag.String("colors", "gray", "png: color map, gray or hypso (by height)")
+var aggPtr = flag.String("agg", "max", "png: height of a pixel made of several samples, max or mean")
+var outputPtr = flag.String("output", "kml", "write the results to these files: a comma-separated list of FORMAT[:FILE], FORMAT one of kml, kmz, geojson, csv, jsonl, shp (default FILE globe.FORMAT)")
+
+// opts are the settings of the computation, from the flags.
+var opts prominence.Options
+
+// streamOpts are the settings of convert, from the flags.
+var streamOpts prominence.StreamOptions
+
+func init() {
+	flag.StringVar(&opts.TmpDir, "tmpdir", "", "temporary directory for external sort")
+	flag.IntVar(&opts.P, "P", runtime.NumCPU(), "width of parallel processing of the external sort")
+	flag.IntVar(&opts.Connectivity, "connectivity", 4, "number of neighbors of each sample (4 or 8)")
+	flag.BoolVar(&opts.Plateaus, "plateaus", false, "merge connected samples of equal altitude into plateaus")
+	flag.BoolVar(&streamOpts.Gzip, "gzip", false, "convert: compress the stream")
+	flag.BoolVar(&streamOpts.Grid, "grid", false, "convert: write a dense grid of heights instead of x y z samples (holds the grid in memory)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: prominence [flags] [input]\n")
+		fmt.Fprintf(os.Stderr, "       prominence convert [flags] [input]  (write input in the stream format)\n")
+		fmt.Fprintf(os.Stderr, "       prominence preview [flags] [input]  (only draw input, see -png)\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	var cmd string
+	if len(os.Args) > 1 && (os.Args[1] == "convert" || os.Args[1] == "preview") {
+		cmd = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Parse()
+
+	var err error
+	ocean, err = parseOcean(*oceanPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outputs, err = parseOutput(*outputPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cmd == "preview" && *pngPtr == "" {
+		*pngPtr = "globe.png"
+	}
+	if *pngPtr != "" {
+		if err := parsePreview(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var data prominence.DataSet
+	switch *formatPtr {
+	case "tree":
+		// A previously computed divide tree, handled in run.
+	case "mosaic":
+		// The inputs are format:name, highest priority first.
+		box, err := parseBox(*bboxPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if box == nil {
+			log.Fatal("-format mosaic needs -bbox")
+		}
+		var sources []prominence.DataSet
+		for _, arg := range flag.Args() {
+			i := strings.Index(arg, ":")
+			if i < 0 {
+				log.Fatalf("bad mosaic source %q, want format:name", arg)
+			}
+			d, err := openDataSet(arg[:i], arg[i+1:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			sources = append(sources, withOcean(d))
+		}
+		data = prominence.NewMosaic(*box, *resPtr, sources...)
+	default:
+		d, err := openDataSet(*formatPtr, flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		data = withOcean(d)
+	}
+
+	if opts.Connectivity != 4 && opts.Connectivity != 8 {
+		log.Fatalf("bad -connectivity %d, want 4 or 8", opts.Connectivity)
+	}
+	if *isolationPtr && *wetPtr {
+		log.Fatal("isolation is not supported for basins")
+	}
+	if *isolationPtr && *formatPtr == "stream" {
+		log.Fatal("can't compute isolation on a stream, it can only be read once")
+	}
+
+	switch cmd {
+	case "convert":
+		if data == nil {
+			log.Fatal("can't convert a divide tree")
+		}
+		if err := convertData(data); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "preview":
+		if data == nil {
+			log.Fatal("can't preview a divide tree")
+		}
+		if err := previewData(data); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := run(data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ocean is the -ocean mask, or nil for the default.
+var ocean prominence.OceanMask
+
+// outputs are the -output files.
+var outputs []outputSpec
+
+// parseOcean parses an -ocean flag.  It returns nil for the empty string.
+func parseOcean(s string) (prominence.OceanMask, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s == "none" {
+		return prominence.NoOcean(), nil
+	}
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("bad -ocean %q", s)
+	}
+	kind, arg := s[:i], s[i+1:]
+	switch kind {
+	case "at", "below":
+		var h float64
+		if _, err := fmt.Sscanf(arg, "%g", &h); err != nil {
+			return nil, fmt.Errorf("bad -ocean %q: %v", s, err)
+		}
+		if kind == "at" {
+			return prominence.OceanAt(h), nil
+		}
+		return prominence.OceanBelow(h), nil
+	case "mask":
+		i := strings.Index(arg, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad -ocean %q, want mask:FORMAT:NAME", s)
+		}
+		d, err := openDataSet(arg[:i], arg[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		return prominence.NewRasterMask(d)
+	}
+	return nil, fmt.Errorf("bad -ocean %q", s)
+}
+
+// withOcean applies the -ocean mask, if any, to d.
+func withOcean(d prominence.DataSet) prominence.DataSet {
+	if ocean == nil {
+		return d
+	}
+	if h, ok := d.(*prominence.HGT); ok {
+		// Keep samples at 0m unless the mask says they are ocean.
+		h.Ocean = ocean
+		return h
+	}
+	return prominence.Masked(d, ocean)
+}
+
+// openDataSet returns the data set in the named file
+// (or directory, or other input) in the given format.
+func openDataSet(format, name string) (prominence.DataSet, error) {
+	switch format {
+	case "test":
+		return prominence.SimpleDataSet([]prominence.Cell{
+			{P: prominence.Point{X: 0, Y: 0}, Z: 5},
+			{P: prominence.Point{X: 0, Y: 1}, Z: 6},
+			{P: prominence.Point{X: 0, Y: 2}, Z: 7},
+			{P: prominence.Point{X: 0, Y: 3}, Z: 6},
+			{P: prominence.Point{X: 1, Y: 0}, Z: 5},
+			{P: prominence.Point{X: 1, Y: 1}, Z: 8},
+			{P: prominence.Point{X: 1, Y: 2}, Z: 3},
+			{P: prominence.Point{X: 1, Y: 3}, Z: 4},
+		}), nil
+	case "noaa1":
+		var tile byte
+		switch t := strings.ToLower(*tilePtr); len(t) {
+		case 0:
+		case 1:
+			tile = t[0]
+		default:
+			return nil, fmt.Errorf("-tile %s: noaa1 reads a single tile", *tilePtr)
+		}
+		return prominence.NewNOAA1(name, tile), nil
+	case "noaa16":
+		return prominence.NewNOAA16(name, strings.ToLower(*tilePtr)), nil
+	case "hgt", "srtm3":
+		box, err := parseBox(*bboxPtr)
+		if err != nil {
+			return nil, err
+		}
+		d := prominence.NewHGT(name, box)
+		d.FillVoids = *fillPtr
+		return d, nil
+	case "geotiff":
+		return prominence.NewGeoTIFF(name), nil
+	case "asc":
+		return prominence.NewASCIIGrid(name), nil
+	case "bil":
+		return prominence.NewBIL(name), nil
+	case "stream":
+		return prominence.NewStream(os.Stdin), nil
+	case "synthetic":
+		// The input is the size, like 4000x3000.
+		var w, h int
+		if _, err := fmt.Sscanf(name, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			return nil, fmt.Errorf("bad synthetic size %q, want WIDTHxLENGTH", name)
+		}
+		return prominence.NewSynthetic(*seedPtr, w, h, prominence.Height(*seaPtr), *plateauPtr), nil
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// convertData writes data in the stream format, cropped to -bbox.
+func convertData(data prominence.DataSet) error {
+	box, err := parseBox(*bboxPtr)
+	if err != nil {
+		return err
+	}
+	if err := data.Init(); err != nil {
+		return err
+	}
+	if *outPtr == "" {
+		return prominence.WriteStream(os.Stdout, data, box, &streamOpts)
+	}
+	f, err := os.Create(*outPtr)
+	if err != nil {
+		return err
+	}
+	if err := prominence.WriteStream(f, data, box, &streamOpts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The -png preview settings.
+var (
+	pngWidth, pngHeight int
+	pngColors           prominence.ColorMap
+	pngAgg              prominence.Aggregation
+)
+
+// parsePreview parses the -pngsize, -colors and -agg flags.
+func parsePreview() error {
+	if _, err := fmt.Sscanf(*pngSizePtr, "%dx%d", &pngWidth, &pngHeight); err != nil || pngWidth < 0 || pngHeight < 0 || pngWidth+pngHeight == 0 {
+		return fmt.Errorf("bad -pngsize %q, want WIDTHxHEIGHT", *pngSizePtr)
+	}
+	switch *colorsPtr {
+	case "gray":
+		pngColors = prominence.GrayColors
+	case "hypso":
+		pngColors = prominence.HypsometricColors
+	default:
+		return fmt.Errorf("bad -colors %q, want gray or hypso", *colorsPtr)
+	}
+	switch *aggPtr {
+	case "max":
+		pngAgg = prominence.AggregateMax
+	case "mean":
+		pngAgg = prominence.AggregateMean
+	default:
+		return fmt.Errorf("bad -agg %q, want max or mean", *aggPtr)
+	}
+	return nil
+}
+
+// newPreview returns a -png preview of data, which must be initialized.
+func newPreview(data prominence.DataSet) (*prominence.Preview, error) {
+	p, err := prominence.NewPreview(data, pngWidth, pngHeight, pngAgg)
+	if err != nil {
+		return nil, err
+	}
+	p.Colors = pngColors
+	return p, nil
+}
+
+// writePreview writes p to the -png file.
+func writePreview(p *prominence.Preview) error {
+	f, err := os.Create(*pngPtr)
+	if err != nil {
+		return err
+	}
+	if err := p.WritePNG(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// previewData draws data in the -png file, without computing anything.
+func previewData(data prominence.DataSet) error {
+	if err := data.Init(); err != nil {
+		return err
+	}
+	p, err := newPreview(data)
+	if err != nil {
+		return err
+	}
+	if err := p.ReadAll(); err != nil {
+		return err
+	}
+	return writePreview(p)
+}
+
+// run computes and reports the prominences (or basin depths) of data.
+// With -format tree, data is nil and the divide tree is read instead.
+func run(data prominence.DataSet) error {
+	proffile, err := os.Create("cpu.out")
+	if err != nil {
+		return err
+	}
+	defer proffile.Close()
+	if err := pprof.StartCPUProfile(proffile); err != nil {
+		return err
+	}
+	defer pprof.StopCPUProfile()
+
+	if data == nil {
+		// Prune a divide tree computed by an earlier run.
+		if *isolationPtr || *wetPtr || *treePtr != "" {
+			return fmt.Errorf("-isolation, -wet and -tree need a data set, not a divide tree")
+		}
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		t, err := prominence.ReadTree(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		// The bounds on prominence are for the vertical error
+		// the tree was computed with.
+		*verrPtr = prominence.Meters(t, prominence.Point{}, t.VErr)
+		filter := newPeakFilter(t, prominence.Point{})
+		min, _ := filter.Heights()
+		if min < t.MinProm {
+			return fmt.Errorf("%s was computed with -min %.0f, and can't report lower prominences", flag.Arg(0),
+				prominence.Meters(t, prominence.Point{}, t.MinProm+2*t.VErr))
+		}
+		var results []prominence.Peak
+		for _, n := range t.Nodes {
+			n.LineParent, err = t.LineParent(n, min)
+			if err != nil {
+				return err
+			}
+			results = filter.Add(results, n)
+		}
+		return report(t, results, nil)
+	}
+
+	if err := data.Init(); err != nil {
+		return err
+	}
+
+	// Get a reader for all the sample points.
+	// Closing done stops the reader if we return early.
+	done := make(chan struct{})
+	defer close(done)
+	r, rerr := data.Reader(done)
+
+	// Draw the data set as it goes by.
+	var tiles *prominence.TileRenderer
+	if *tilesPtr != "" {
+		tiles, err = prominence.NewTileRenderer(data, *zoomPtr)
+		if err != nil {
+			return err
+		}
+		tiles.Hillshade = *hillshadePtr
+		r = tiles.Sniff(r, done)
+	}
+	var preview *prominence.Preview
+	if *pngPtr != "" {
+		preview, err = newPreview(data)
+		if err != nil {
+			return err
+		}
+		r = preview.Sniff(r, done)
+	}
+
+	minx, maxx, miny, maxy, _, _ := data.Bounds()
+	if *wetPtr {
+		out, err := openWriters(data)
+		if err != nil {
+			return err
+		}
+		base := prominence.Point{X: minx, Y: miny}
+		err = prominence.ComputeBasins(r, rerr, minx, maxx, miny, maxy, &opts, func(sink, col, dom prominence.Cell, size int64, sea, closed bool) {
+			meters := prominence.Meters(data, base, col.Z-sink.Z)
+			if !closed && meters < *minPtr {
+				return
+			}
+			if size < *minSize {
+				return
+			}
+			switch {
+			case closed:
+				fmt.Printf("depth of %s [%9d] is unbounded (no outlet)\n",
+					locString(data, sink), size)
+			case sea:
+				fmt.Printf("depth of %s [%9d] is %4.0fm (spills at %s into the sea)\n",
+					locString(data, sink), size,
+					meters,
+					locString(data, col))
+			default:
+				fmt.Printf("depth of %s [%9d] is %4.0fm (spills at %s into %s)\n",
+					locString(data, sink), size,
+					meters,
+					locString(data, col),
+					locString(data, dom))
+			}
+			b := basinReport{sink: sink, col: col, dom: dom, size: size, depth: meters, sea: sea, closed: closed}
+			for _, w := range out {
+				w.Basin(b)
+			}
+		})
+		if cerr := closeWriters(out); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if preview != nil {
+			if err := writePreview(preview); err != nil {
+				return err
+			}
+		}
+		if tiles != nil {
+			return tiles.WriteTiles(*tilesPtr)
+		}
+		return nil
+	}
+
+	filter := newPeakFilter(data, prominence.Point{X: minx, Y: miny})
+	minProm, verr := filter.Heights()
+
+	var tree *prominence.TreeWriter
+	var treeFile *os.File
+	if *treePtr != "" {
+		treeFile, err = os.Create(*treePtr)
+		if err != nil {
+			return err
+		}
+		defer treeFile.Close()
+		tree, err = prominence.NewTreeWriter(treeFile, data, minProm, verr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Gather the peaks we want to display.
+	var results []prominence.Peak
+	err = prominence.ComputeProminence(r, rerr, minx, maxx, minProm, verr, &opts, func(res prominence.Result) {
+		prominence.MarkFilled(data, &res)
+		if tree != nil {
+			tree.Add(res)
+		}
+		results = filter.Add(results, res)
+	})
+	if err != nil {
+		return err
+	}
+	if preview != nil {
+		if err := writePreview(preview); err != nil {
+			return err
+		}
+	}
+	if tree != nil {
+		if err := tree.Flush(); err != nil {
+			return err
+		}
+		if err := treeFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	var iso []prominence.Isolation
+	if *isolationPtr {
+		peaks := make([]prominence.Cell, len(results))
+		for k, res := range results {
+			peaks[k] = res.Peak
+		}
+		iso, err = prominence.ComputeIsolation(data, peaks)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := report(data, results, iso); err != nil {
+		return err
+	}
+	if tiles != nil {
+		for _, res := range results {
+			x, y, _ := data.Pos(res.Peak)
+			tiles.AddPeak(x, y, res.Prom)
+		}
+		return tiles.WriteTiles(*tilesPtr)
+	}
+	return nil
+}
+
+// newPeakFilter returns a filter for the peaks to display, which
+// have at least -min optimistic prominence (given -verr) and -minsize
+// size.  base is any point in pos.
+func newPeakFilter(pos prominence.Positioner, base prominence.Point) *prominence.PeakFilter {
+	return &prominence.PeakFilter{Pos: pos, Base: base, MinProm: *minPtr, MinSize: *minSize, VErr: *verrPtr}
+}
+
+// parseBox parses a -bbox flag.  It returns nil for the empty string.
+func parseBox(s string) (*prominence.Box, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var b prominence.Box
+	if _, err := fmt.Sscanf(s, "%g,%g,%g,%g", &b.MinLong, &b.MinLat, &b.MaxLong, &b.MaxLat); err != nil {
+		return nil, fmt.Errorf("bad -bbox %q: %v", s, err)
+	}
+	if b.MinLong >= b.MaxLong || b.MinLat >= b.MaxLat {
+		return nil, fmt.Errorf("bad -bbox %q: empty box", s)
+	}
+	return &b, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTileFlag(t *testing.T) {
+	defer func(s string) { *tilePtr = s }(*tilePtr)
+	for _, test := range []struct {
+		name, tile string
+		err        string // from openDataSet, or else from Init
+	}{
+		{"globe.bin", "b", ""},
+		{"globe.bin", "B", ""},
+		{"c10g", "", ""},
+		{"globe.bin", "", "can't tell which GLOBE tile"},
+		{"globe.bin", "q", "can't tell which GLOBE tile"},
+		{"globe.bin", "ab", "noaa1 reads a single tile"},
+	} {
+		*tilePtr = test.tile
+		d, err := openDataSet("noaa1", test.name)
+		if err == nil {
+			err = d.Init()
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s -tile %q: want error %q, got %v", test.name, test.tile, test.err, err)
+		}
+	}
+}
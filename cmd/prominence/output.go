@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/randall77/prominence"
+)
+
+// Result writers.
+//
+// The displayed peaks (or basins, with -wet) are printed on stdout
+// and written to each of the -output files.  Positions are in
+// degrees, and heights, prominences and depths in meters.  The
+// key col and dominating peak of an island, and anything else which
+// doesn't apply or wasn't computed, are null (empty in CSV).
+
+// A resultWriter writes results to a file.
+type resultWriter interface {
+	// Peak writes a peak.  iso is its isolation, or nil if
+	// isolation wasn't computed.
+	Peak(r prominence.Peak, iso *prominence.Isolation)
+	// Basin writes a basin.
+	Basin(b basinReport)
+	// Close finishes the file and reports any error writing it.
+	Close() error
+}
+
+// A basinReport is a basin to display.
+type basinReport struct {
+	sink, col, dom prominence.Cell
+	size           int64
+	depth          float64 // in meters
+	sea, closed    bool
+}
+
+// An outputSpec is one element of the -output flag.
+type outputSpec struct {
+	format, name string
+}
+
+// outputExt is the extension of the default file name of each output format.
+var outputExt = map[string]string{
+	"kml":     "kml",
+	"kmz":     "kmz",
+	"geojson": "geojson",
+	"csv":     "csv",
+	"jsonl":   "jsonl",
+	"shp":     "shp",
+}
+
+// parseOutput parses an -output flag, a comma-separated list
+// of FORMAT[:FILE].  The default file is globe.EXT.
+func parseOutput(s string) ([]outputSpec, error) {
+	var specs []outputSpec
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		spec := outputSpec{format: f}
+		if i := strings.Index(f, ":"); i >= 0 {
+			spec.format, spec.name = f[:i], f[i+1:]
+		}
+		ext, ok := outputExt[spec.format]
+		if !ok {
+			return nil, fmt.Errorf("bad -output %q: unknown format %s", s, spec.format)
+		}
+		if spec.name == "" {
+			spec.name = "globe." + ext
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// openWriters creates the files for the -output writers.
+// pos converts the results to standard coordinates.
+func openWriters(pos prominence.Positioner) ([]resultWriter, error) {
+	var out []resultWriter
+	for _, spec := range outputs {
+		if spec.format == "shp" {
+			// Several files, named after spec.name.
+			w, err := newShapeWriter(strings.TrimSuffix(spec.name, ".shp"), pos)
+			if err != nil {
+				closeWriters(out)
+				return nil, err
+			}
+			out = append(out, w)
+			continue
+		}
+		f, err := os.Create(spec.name)
+		if err != nil {
+			closeWriters(out)
+			return nil, err
+		}
+		b := &outFile{Writer: bufio.NewWriter(f), f: f}
+		if spec.format == "kmz" {
+			// Google Earth reads the first .kml file in the archive.
+			b.zip = zip.NewWriter(f)
+			z, err := b.zip.Create("doc.kml")
+			if err != nil {
+				f.Close()
+				closeWriters(out)
+				return nil, err
+			}
+			b.Writer = bufio.NewWriter(z)
+		}
+		var w resultWriter
+		switch spec.format {
+		case "kml", "kmz":
+			w = newKMLWriter(b, pos)
+		case "geojson":
+			w = newGeoJSONWriter(b, pos)
+		case "csv":
+			w = newCSVWriter(b, pos)
+		case "jsonl":
+			w = &jsonlWriter{b, pos}
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// closeWriters closes all of out, and returns the first error.
+func closeWriters(out []resultWriter) error {
+	var err error
+	for _, w := range out {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// An outFile is a buffered output file.  If zip is not nil, the
+// output is the only file in a zip archive.
+type outFile struct {
+	*bufio.Writer
+	zip *zip.Writer
+	f   *os.File
+}
+
+func (f *outFile) Close() error {
+	err := f.Flush()
+	if f.zip != nil {
+		if cerr := f.zip.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// peakColumns names the values returned by peakValues.
+var peakColumns = []string{
+	"peak_long", "peak_lat", "peak_elev",
+	"col_long", "col_lat", "col_elev",
+	"dom_long", "dom_lat", "dom_elev",
+	"prominence", "size", "island",
+	"line_parent_long", "line_parent_lat", "line_parent_elev",
+	"prom_parent_long", "prom_parent_lat", "prom_parent_elev",
+	"clean_prominence", "optimistic_prominence", "uncertain",
+	"peak_filled", "col_filled",
+	"isolation_km",
+}
+
+// peakValues returns the values of r to write, in the order of peakColumns.
+// The clean and optimistic prominence are only known with -verr.  The
+// isolation is null if it wasn't computed or there is no higher sample.
+func peakValues(pos prominence.Positioner, r prominence.Peak, iso *prominence.Isolation) []interface{} {
+	v := locValues(pos, r.Peak, true)
+	v = append(v, locValues(pos, r.Col, !r.Island)...)
+	v = append(v, locValues(pos, r.Dom, !r.Island)...)
+	v = append(v, r.Prom, r.Size, r.Island)
+	v = append(v, locValues(pos, r.LineParent, !r.Island)...)
+	v = append(v, locValues(pos, r.PromParent, !r.Island)...)
+	var clean, optimistic interface{}
+	if *verrPtr > 0 {
+		clean, optimistic = r.Clean, r.Optimistic
+	}
+	v = append(v, clean, optimistic, r.Uncertain, r.PeakFilled, r.ColFilled)
+	var dist interface{}
+	if iso != nil && !math.IsInf(iso.Dist, 1) {
+		dist = iso.Dist
+	}
+	return append(v, dist)
+}
+
+// basinColumns names the values returned by basinValues.
+var basinColumns = []string{
+	"sink_long", "sink_lat", "sink_elev",
+	"outlet_long", "outlet_lat", "outlet_elev",
+	"into_long", "into_lat", "into_elev",
+	"depth", "size", "sea", "closed",
+}
+
+// basinValues returns the values of b to write, in the order of
+// basinColumns.  A closed basin has no outlet and no depth, and a
+// basin which spills into the sea doesn't spill into another basin.
+func basinValues(pos prominence.Positioner, b basinReport) []interface{} {
+	v := locValues(pos, b.sink, true)
+	v = append(v, locValues(pos, b.col, !b.closed)...)
+	v = append(v, locValues(pos, b.dom, !b.closed && !b.sea)...)
+	var depth interface{}
+	if !b.closed {
+		depth = b.depth
+	}
+	return append(v, depth, b.size, b.sea, b.closed)
+}
+
+// locValues returns the longitude, latitude and elevation of c,
+// or nils if ok is false.
+func locValues(pos prominence.Positioner, c prominence.Cell, ok bool) []interface{} {
+	if !ok {
+		return []interface{}{nil, nil, nil}
+	}
+	x, y, z := pos.Pos(c)
+	return []interface{}{roundDeg(x), roundDeg(y), z}
+}
+
+// roundDeg rounds x, in degrees, to about a centimeter, so that
+// grid positions print as short decimals.
+func roundDeg(x float64) float64 {
+	return math.Round(x*1e7) / 1e7
+}
+
+// writeObject writes the JSON object with the given keys and values.
+func writeObject(w *bufio.Writer, keys []string, values []interface{}) {
+	w.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		b, _ := json.Marshal(k)
+		w.Write(b)
+		w.WriteByte(':')
+		b, _ = json.Marshal(values[i])
+		w.Write(b)
+	}
+	w.WriteByte('}')
+}
+
+// A geoJSONWriter writes a FeatureCollection with a Point feature at
+// each peak (or sink), with the values of the result as properties.
+type geoJSONWriter struct {
+	*outFile
+	pos   prominence.Positioner
+	first bool
+}
+
+func newGeoJSONWriter(f *outFile, pos prominence.Positioner) *geoJSONWriter {
+	f.WriteString(`{"type":"FeatureCollection","features":[`)
+	return &geoJSONWriter{f, pos, true}
+}
+
+func (w *geoJSONWriter) Peak(r prominence.Peak, iso *prominence.Isolation) {
+	w.feature(r.Peak, peakColumns, peakValues(w.pos, r, iso))
+}
+
+func (w *geoJSONWriter) Basin(b basinReport) {
+	w.feature(b.sink, basinColumns, basinValues(w.pos, b))
+}
+
+func (w *geoJSONWriter) feature(c prominence.Cell, keys []string, values []interface{}) {
+	if !w.first {
+		w.WriteByte(',')
+	}
+	w.first = false
+	x, y, _ := w.pos.Pos(c)
+	fmt.Fprintf(w, "\n{\"type\":\"Feature\",\"geometry\":{\"type\":\"Point\",\"coordinates\":[%s,%s]},\"properties\":",
+		strconv.FormatFloat(roundDeg(x), 'f', -1, 64), strconv.FormatFloat(roundDeg(y), 'f', -1, 64))
+	writeObject(w.Writer, keys, values)
+	w.WriteByte('}')
+}
+
+func (w *geoJSONWriter) Close() error {
+	w.WriteString("\n]}\n")
+	return w.outFile.Close()
+}
+
+// A csvWriter writes a header row, then a row for each result.
+type csvWriter struct {
+	f   *outFile
+	c   *csv.Writer
+	pos prominence.Positioner
+}
+
+func newCSVWriter(f *outFile, pos prominence.Positioner) *csvWriter {
+	w := &csvWriter{f, csv.NewWriter(f), pos}
+	if *wetPtr {
+		w.c.Write(basinColumns)
+	} else {
+		w.c.Write(peakColumns)
+	}
+	return w
+}
+
+func (w *csvWriter) Peak(r prominence.Peak, iso *prominence.Isolation) {
+	w.write(peakValues(w.pos, r, iso))
+}
+
+func (w *csvWriter) Basin(b basinReport) {
+	w.write(basinValues(w.pos, b))
+}
+
+func (w *csvWriter) write(values []interface{}) {
+	row := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case float64:
+			row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			row[i] = fmt.Sprint(v)
+		}
+	}
+	w.c.Write(row)
+}
+
+func (w *csvWriter) Close() error {
+	w.c.Flush()
+	err := w.c.Error()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// A jsonlWriter writes a JSON object for each result, one per line.
+type jsonlWriter struct {
+	*outFile
+	pos prominence.Positioner
+}
+
+func (w *jsonlWriter) Peak(r prominence.Peak, iso *prominence.Isolation) {
+	writeObject(w.Writer, peakColumns, peakValues(w.pos, r, iso))
+	w.WriteByte('\n')
+}
+
+func (w *jsonlWriter) Basin(b basinReport) {
+	writeObject(w.Writer, basinColumns, basinValues(w.pos, b))
+	w.WriteByte('\n')
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/randall77/prominence"
+)
+
+func TestParseOutput(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want []outputSpec
+		err  string
+	}{
+		{"", nil, ""},
+		{"kml", []outputSpec{{"kml", "globe.kml"}}, ""},
+		{"csv:peaks.csv,geojson", []outputSpec{{"csv", "peaks.csv"}, {"geojson", "globe.geojson"}}, ""},
+		{",jsonl:,", []outputSpec{{"jsonl", "globe.jsonl"}}, ""},
+		{"shp:dir/out", []outputSpec{{"shp", "dir/out"}}, ""},
+		{"kml,gpx", nil, "unknown format gpx"},
+		{"KML", nil, "unknown format KML"},
+	} {
+		got, err := parseOutput(test.s)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: want error containing %q, got %v", test.s, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: want %v, got %v, %v", test.s, test.want, got, err)
+		}
+	}
+}
+
+// column returns the value of the named column in values.
+func column(t *testing.T, columns []string, values []interface{}, name string) interface{} {
+	for i, c := range columns {
+		if c == name {
+			return values[i]
+		}
+	}
+	t.Fatalf("no column %s", name)
+	return nil
+}
+
+func TestPeakValues(t *testing.T) {
+	defer func(v float64) { *verrPtr = v }(*verrPtr)
+	pos := prominence.SimpleDataSet(nil)
+	iso := &prominence.Isolation{Dist: 12.5}
+	none := &prominence.Isolation{Dist: math.Inf(1)}
+	for _, test := range []struct {
+		name string
+		peak prominence.Peak
+		iso  *prominence.Isolation
+		verr float64
+		want map[string]interface{}
+	}{
+		{"peak", testPeaks[0], iso, 0, map[string]interface{}{
+			"peak_long": 3.0, "peak_lat": -2.0, "peak_elev": 700.0,
+			"col_long": 4.0, "col_elev": 500.0, "dom_long": 6.0,
+			"prominence": 200.0, "size": int64(12), "island": false,
+			"line_parent_long": 6.0, "prom_parent_lat": 0.0,
+			"clean_prominence": nil, "optimistic_prominence": nil,
+			"isolation_km": 12.5,
+		}},
+		{"verr", testPeaks[0], nil, 5, map[string]interface{}{
+			"clean_prominence": 200.0, "optimistic_prominence": 200.0,
+			"isolation_km": nil,
+		}},
+		{"island", testPeaks[1], none, 0, map[string]interface{}{
+			"peak_long": 6.0, "prominence": 900.0, "island": true,
+			"col_long": nil, "col_lat": nil, "col_elev": nil,
+			"dom_long": nil, "dom_lat": nil, "dom_elev": nil,
+			"line_parent_long": nil, "prom_parent_elev": nil,
+			"isolation_km": nil,
+		}},
+	} {
+		*verrPtr = test.verr
+		v := peakValues(pos, test.peak, test.iso)
+		if len(v) != len(peakColumns) {
+			t.Fatalf("%s: %d values for %d columns", test.name, len(v), len(peakColumns))
+		}
+		for name, want := range test.want {
+			if got := column(t, peakColumns, v, name); got != want {
+				t.Errorf("%s: %s is %#v, want %#v", test.name, name, got, want)
+			}
+		}
+	}
+}
+
+// testBasins are a basin spilling into another, one spilling into
+// the sea, and one with no outlet.
+var testBasins = []basinReport{
+	{
+		sink: prominence.Cell{P: prominence.Point{X: 1, Y: 1}, Z: 10},
+		col:  prominence.Cell{P: prominence.Point{X: 2, Y: 1}, Z: 30},
+		dom:  prominence.Cell{P: prominence.Point{X: 5, Y: 1}, Z: 5},
+		size: 9, depth: 20,
+	},
+	{
+		sink: prominence.Cell{P: prominence.Point{X: 5, Y: 1}, Z: 5},
+		col:  prominence.Cell{P: prominence.Point{X: 7, Y: 1}, Z: 8},
+		size: 20, depth: 3, sea: true,
+	},
+	{
+		sink: prominence.Cell{P: prominence.Point{X: 9, Y: 9}, Z: -2},
+		size: 4, closed: true,
+	},
+}
+
+func TestBasinValues(t *testing.T) {
+	pos := prominence.SimpleDataSet(nil)
+	for i, want := range []map[string]interface{}{
+		{"sink_long": 1.0, "outlet_long": 2.0, "outlet_elev": 30.0, "into_long": 5.0, "into_elev": 5.0,
+			"depth": 20.0, "size": int64(9), "sea": false, "closed": false},
+		{"sink_long": 5.0, "outlet_long": 7.0, "into_long": nil, "into_lat": nil, "into_elev": nil,
+			"depth": 3.0, "sea": true},
+		{"sink_elev": -2.0, "outlet_long": nil, "outlet_elev": nil, "into_long": nil,
+			"depth": nil, "closed": true},
+	} {
+		v := basinValues(pos, testBasins[i])
+		if len(v) != len(basinColumns) {
+			t.Fatalf("basin %d: %d values for %d columns", i, len(v), len(basinColumns))
+		}
+		for name, w := range want {
+			if got := column(t, basinColumns, v, name); got != w {
+				t.Errorf("basin %d: %s is %#v, want %#v", i, name, got, w)
+			}
+		}
+	}
+}
+
+// writeResults writes the test peaks (or, with wet, basins) to a
+// new file in dir with a writer made by newWriter, and returns the
+// contents of the file.
+func writeResults(t *testing.T, dir, name string, wet bool, newWriter func(*outFile) resultWriter) []byte {
+	defer func(w bool) { *wetPtr = w }(*wetPtr)
+	*wetPtr = wet
+	name = filepath.Join(dir, name)
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWriter(&outFile{Writer: bufio.NewWriter(f), f: f})
+	if wet {
+		for _, b := range testBasins {
+			w.Basin(b)
+		}
+	} else {
+		for _, p := range testPeaks {
+			w.Peak(p, nil)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pos := prominence.SimpleDataSet(nil)
+
+	for _, wet := range []bool{false, true} {
+		columns, n := peakColumns, len(testPeaks)
+		if wet {
+			columns, n = basinColumns, len(testBasins)
+		}
+		// null is the column which is null (empty in CSV) in the
+		// last result, and only there.
+		null := "col_long"
+		if wet {
+			null = "outlet_long"
+		}
+
+		// GeoJSON: a FeatureCollection with a Point at each result.
+		b := writeResults(t, dir, "out.geojson", wet, func(f *outFile) resultWriter { return newGeoJSONWriter(f, pos) })
+		var fc struct {
+			Type     string
+			Features []struct {
+				Type     string
+				Geometry struct {
+					Type        string
+					Coordinates []float64
+				}
+				Properties map[string]interface{}
+			}
+		}
+		if err := json.Unmarshal(b, &fc); err != nil {
+			t.Fatalf("wet=%t: bad GeoJSON: %v\n%s", wet, err, b)
+		}
+		if fc.Type != "FeatureCollection" || len(fc.Features) != n {
+			t.Fatalf("wet=%t: want a FeatureCollection of %d features, got %s of %d", wet, n, fc.Type, len(fc.Features))
+		}
+		for i, f := range fc.Features {
+			if f.Type != "Feature" || f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) != 2 || len(f.Properties) != len(columns) {
+				t.Errorf("wet=%t: bad feature %d: %v", wet, i, f)
+				continue
+			}
+			first := columns[0] // the long of the peak or sink
+			if f.Properties[first] != f.Geometry.Coordinates[0] {
+				t.Errorf("wet=%t: feature %d: %s %v is not at %v", wet, i, first, f.Properties[first], f.Geometry.Coordinates)
+			}
+			if v, ok := f.Properties[null]; !ok || (v == nil) != (i == n-1) {
+				t.Errorf("wet=%t: feature %d: %s is %v", wet, i, null, v)
+			}
+		}
+
+		// CSV: a header row, then a row for each result.
+		b = writeResults(t, dir, "out.csv", wet, func(f *outFile) resultWriter { return newCSVWriter(f, pos) })
+		rows, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			t.Fatalf("wet=%t: bad CSV: %v\n%s", wet, err, b)
+		}
+		if len(rows) != n+1 || !reflect.DeepEqual(rows[0], columns) {
+			t.Fatalf("wet=%t: want header %v and %d rows, got\n%s", wet, columns, n, b)
+		}
+		k := 0
+		for k < len(columns) && columns[k] != null {
+			k++
+		}
+		for i, row := range rows[1:] {
+			if (row[k] == "") != (i == n-1) {
+				t.Errorf("wet=%t: row %d: %s is %q", wet, i, null, row[k])
+			}
+		}
+		if wet {
+			if got := rows[1][len(rows[1])-2:]; !reflect.DeepEqual(got, []string{"false", "false"}) {
+				t.Errorf("wet=%t: sea and closed are %q", wet, got)
+			}
+		} else if rows[1][0] != "3" || rows[2][1] != "0" {
+			t.Errorf("wet=%t: bad positions in\n%s", wet, b)
+		}
+
+		// JSONL: an object for each result, one per line.
+		b = writeResults(t, dir, "out.jsonl", wet, func(f *outFile) resultWriter { return &jsonlWriter{f, pos} })
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		if len(lines) != n {
+			t.Fatalf("wet=%t: want %d lines, got\n%s", wet, n, b)
+		}
+		for i, l := range lines {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(l), &m); err != nil {
+				t.Errorf("wet=%t: line %d: %v", wet, i, err)
+				continue
+			}
+			if len(m) != len(columns) {
+				t.Errorf("wet=%t: line %d has %d keys, want %d", wet, i, len(m), len(columns))
+			}
+			if v, ok := m[null]; !ok || (v == nil) != (i == n-1) {
+				t.Errorf("wet=%t: line %d: %s is %v", wet, i, null, v)
+			}
+		}
+	}
+}
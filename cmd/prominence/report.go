@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/randall77/prominence"
+)
+
+// Results on stdout.
+//
+// Each displayed peak (or basin, see run) is printed on a line,
+// with positions in degrees and heights in meters.
+
+// report displays results on stdout and writes them to the -output files.
+// iso, if not nil, is the isolation of each result.
+func report(pos prominence.Positioner, results []prominence.Peak, iso []prominence.Isolation) error {
+	out, err := openWriters(pos)
+	if err != nil {
+		return err
+	}
+	for k, res := range results {
+		peak, col, dom, size, meters := res.Peak, res.Col, res.Dom, res.Size, res.Prom
+		var isoString string
+		if iso != nil {
+			if math.IsInf(iso[k].Dist, 1) {
+				isoString = " isolation: none higher"
+			} else {
+				isoString = fmt.Sprintf(" isolation %6.1fkm to %s", iso[k].Dist, locString(pos, iso[k].Higher))
+			}
+		}
+
+		var boundsString string
+		if *verrPtr > 0 {
+			boundsString = fmt.Sprintf(" (%.0f-%.0fm)", res.Clean, res.Optimistic)
+			if res.Uncertain {
+				boundsString += " key col uncertain"
+			}
+		}
+		if res.PeakFilled {
+			boundsString += " peak in filled void"
+		}
+		if res.ColFilled {
+			boundsString += " key col in filled void"
+		}
+
+		if res.Island {
+			fmt.Printf("prominence of %s%s [%9d] is %4.0fm%s (to sea level)%s\n",
+				locString(pos, peak), regionString(pos, res.PeakRegion), size,
+				meters, boundsString, isoString)
+		} else {
+			fmt.Printf("prominence of %s%s [%9d] is %4.0fm%s (key col %s%s to %s, line parent %s, prominence parent %s)%s\n",
+				locString(pos, peak), regionString(pos, res.PeakRegion), size,
+				meters, boundsString,
+				locString(pos, col), regionString(pos, res.ColRegion),
+				locString(pos, dom),
+				locString(pos, res.LineParent),
+				locString(pos, res.PromParent), isoString)
+		}
+		var r *prominence.Isolation
+		if iso != nil {
+			r = &iso[k]
+		}
+		for _, w := range out {
+			w.Peak(res, r)
+		}
+	}
+	return closeWriters(out)
+}
+
+const minsec = false
+
+// locString returns a human-readable location string for c, like:
+//
+//	12°03'55"N   3°23'52"W  678m
+func locString(d prominence.Positioner, c prominence.Cell) string {
+	x, y, z := d.Pos(c)
+	s := ""
+	if minsec {
+		if y >= 0 {
+			s += deg(y) + "N"
+		} else {
+			s += deg(-y) + "S"
+		}
+		s += " "
+		if x >= 0 {
+			s += deg(x) + "E"
+		} else {
+			s += deg(-x) + "W"
+		}
+	} else {
+		s += fmt.Sprintf("%8.4f %8.4f", x, y)
+	}
+	s += " "
+	s += fmt.Sprintf("%4.0fm", z)
+	return s
+}
+
+// regionString returns a human-readable description of a plateau,
+// or the empty string if r is a single sample.
+func regionString(d prominence.Positioner, r prominence.Region) string {
+	if r.Size <= 1 {
+		return ""
+	}
+	x0, y0, _ := d.Pos(prominence.Cell{P: r.Min, Z: 0})
+	x1, y1, _ := d.Pos(prominence.Cell{P: r.Max, Z: 0})
+	return fmt.Sprintf(" (plateau of %d samples, %.4f %.4f to %.4f %.4f)", r.Size, x0, y0, x1, y1)
+}
+
+func deg(x float64) string {
+	d := int(x)
+	x -= float64(d)
+	x *= 60
+	m := int(x)
+	x -= float64(m)
+	x *= 60
+	s := int(x + .5)
+	return fmt.Sprintf("%3d°%02d'%02d\"", d, m, s)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randall77/prominence"
+)
+
+// ESRI shapefile output.
+//
+// The results are written as two point shapefiles, base_peaks and
+// base_cols (base_sinks and base_outlets with -wet).  Each result is
+// a point in the first, and (unless it is an island, or a basin with
+// no outlet) a point at its key col in the second, with the same
+// attributes as the other -output formats in both.  A shapefile is
+// four files: .shp holds the points, .shx an index of them, .dbf the
+// attributes (in dBase III format) and .prj the coordinate system.
+// Data set positions are longitude and latitude in degrees, which
+// we take to be WGS84.
+//
+// The headers of .shp and .dbf hold the number of records and the
+// bounding box, so each layer is held in memory until Close.
+
+// shpPrj is the .prj of WGS84 longitude and latitude.
+const shpPrj = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// dbfName shortens attribute names to dBase's 10 characters.
+var dbfName = strings.NewReplacer(
+	"line_parent", "lpar",
+	"prom_parent", "ppar",
+	"prominence", "prom",
+	"optimistic", "opt",
+	"isolation", "iso",
+	"outlet", "out",
+	"filled", "fill",
+	"_long", "_lon",
+)
+
+// A shapeWriter writes results as a pair of point shapefiles.
+type shapeWriter struct {
+	pos    prominence.Positioner
+	layers [2]*shapeLayer
+}
+
+func newShapeWriter(base string, pos prominence.Positioner) (*shapeWriter, error) {
+	names, columns := [2]string{"peaks", "cols"}, peakColumns
+	if *wetPtr {
+		names, columns = [2]string{"sinks", "outlets"}, basinColumns
+	}
+	w := &shapeWriter{pos: pos}
+	for i, name := range names {
+		l, err := newShapeLayer(base+"_"+name, columns)
+		if err != nil {
+			if i > 0 {
+				w.layers[0].remove()
+			}
+			return nil, err
+		}
+		w.layers[i] = l
+	}
+	return w, nil
+}
+
+func (w *shapeWriter) Peak(r prominence.Peak, iso *prominence.Isolation) {
+	v := peakValues(w.pos, r, iso)
+	x, y, _ := w.pos.Pos(r.Peak)
+	w.layers[0].add(x, y, v)
+	if !r.Island {
+		x, y, _ = w.pos.Pos(r.Col)
+		w.layers[1].add(x, y, v)
+	}
+}
+
+func (w *shapeWriter) Basin(b basinReport) {
+	v := basinValues(w.pos, b)
+	x, y, _ := w.pos.Pos(b.sink)
+	w.layers[0].add(x, y, v)
+	if !b.closed {
+		x, y, _ = w.pos.Pos(b.col)
+		w.layers[1].add(x, y, v)
+	}
+}
+
+func (w *shapeWriter) Close() error {
+	var err error
+	for _, l := range w.layers {
+		if lerr := l.write(); err == nil {
+			err = lerr
+		}
+		if cerr := l.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// A shapeLayer is a point shapefile.
+type shapeLayer struct {
+	shp, shx, dbf *os.File
+	created       []string // names of the files made so far
+	fields        []dbfField
+	points        [][2]float64
+	rows          bytes.Buffer // dBase records
+}
+
+// A dbfField is an attribute column.
+type dbfField struct {
+	name      string
+	typ       byte // 'N' for numbers, 'L' for booleans
+	size, dec int
+}
+
+// newShapeLayer creates the shapefile base, with the given attributes.
+// If it fails, it leaves none of the files behind.
+func newShapeLayer(base string, columns []string) (*shapeLayer, error) {
+	l := &shapeLayer{}
+	for _, c := range columns {
+		f := dbfField{name: strings.ToUpper(dbfName.Replace(c)), typ: 'N'}
+		switch {
+		case c == "island" || c == "uncertain" || c == "sea" || c == "closed" || strings.HasSuffix(c, "_filled"):
+			f.typ, f.size = 'L', 1
+		case c == "size":
+			f.size = 15
+		case strings.HasSuffix(c, "_long") || strings.HasSuffix(c, "_lat"):
+			f.size, f.dec = 13, 7
+		default:
+			f.size, f.dec = 12, 1
+		}
+		l.fields = append(l.fields, f)
+	}
+	for _, f := range []struct {
+		p   **os.File
+		ext string
+	}{{&l.shp, ".shp"}, {&l.shx, ".shx"}, {&l.dbf, ".dbf"}} {
+		var err error
+		*f.p, err = os.Create(base + f.ext)
+		if err != nil {
+			l.remove()
+			return nil, err
+		}
+		l.created = append(l.created, base+f.ext)
+	}
+	prj, err := os.Create(base + ".prj")
+	if err != nil {
+		l.remove()
+		return nil, err
+	}
+	l.created = append(l.created, base+".prj")
+	_, err = prj.WriteString(shpPrj)
+	if cerr := prj.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		l.remove()
+		return nil, err
+	}
+	return l, nil
+}
+
+// add adds a point at x, y with the given attribute values.
+func (l *shapeLayer) add(x, y float64, values []interface{}) {
+	l.points = append(l.points, [2]float64{x, y})
+	l.rows.WriteByte(' ') // not deleted
+	for i, f := range l.fields {
+		var s string
+		switch v := values[i].(type) {
+		case nil:
+			if f.typ == 'L' {
+				s = "?"
+			}
+		case bool:
+			s = "F"
+			if v {
+				s = "T"
+			}
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', f.dec, 64)
+		}
+		if len(s) > f.size {
+			s = strings.Repeat("*", f.size) // overflow, as dBase does
+		}
+		l.rows.WriteString(strings.Repeat(" ", f.size-len(s)))
+		l.rows.WriteString(s)
+	}
+}
+
+// write writes the .shp, .shx and .dbf files of l.
+func (l *shapeLayer) write() error {
+	const (
+		headerSize = 100
+		recordSize = 28 // 8 byte header, then type, x, y
+		pointType  = 1
+	)
+	be, le := binary.BigEndian, binary.LittleEndian
+
+	// The .shp and .shx headers differ only in the file length.
+	header := make([]byte, headerSize)
+	be.PutUint32(header[0:], 9994)
+	le.PutUint32(header[28:], 1000)
+	le.PutUint32(header[32:], pointType)
+	if len(l.points) > 0 {
+		box := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+		for _, p := range l.points {
+			box[0] = math.Min(box[0], p[0])
+			box[1] = math.Min(box[1], p[1])
+			box[2] = math.Max(box[2], p[0])
+			box[3] = math.Max(box[3], p[1])
+		}
+		for i, v := range box {
+			le.PutUint64(header[36+8*i:], math.Float64bits(v))
+		}
+	}
+	// Lengths and offsets are in 16-bit words.
+	shp := make([]byte, headerSize+recordSize*len(l.points))
+	shx := make([]byte, headerSize+8*len(l.points))
+	copy(shp, header)
+	copy(shx, header)
+	be.PutUint32(shp[24:], uint32(len(shp)/2))
+	be.PutUint32(shx[24:], uint32(len(shx)/2))
+	for i, p := range l.points {
+		off := headerSize + recordSize*i
+		r := shp[off:]
+		be.PutUint32(r[0:], uint32(i+1))
+		be.PutUint32(r[4:], (recordSize-8)/2)
+		le.PutUint32(r[8:], pointType)
+		le.PutUint64(r[12:], math.Float64bits(p[0]))
+		le.PutUint64(r[20:], math.Float64bits(p[1]))
+		be.PutUint32(shx[headerSize+8*i:], uint32(off/2))
+		be.PutUint32(shx[headerSize+8*i+4:], (recordSize-8)/2)
+	}
+
+	// The dBase III header, with a descriptor for each field.
+	rowSize := 1
+	for _, f := range l.fields {
+		rowSize += f.size
+	}
+	dbf := make([]byte, 32+32*len(l.fields)+1)
+	now := time.Now()
+	dbf[0] = 3
+	dbf[1], dbf[2], dbf[3] = byte(now.Year()-1900), byte(now.Month()), byte(now.Day())
+	le.PutUint32(dbf[4:], uint32(len(l.points)))
+	le.PutUint16(dbf[8:], uint16(len(dbf)))
+	le.PutUint16(dbf[10:], uint16(rowSize))
+	for i, f := range l.fields {
+		d := dbf[32+32*i:]
+		copy(d[:10], f.name)
+		d[11] = f.typ
+		d[16] = byte(f.size)
+		d[17] = byte(f.dec)
+	}
+	dbf[len(dbf)-1] = 0x0d
+	dbf = append(dbf, l.rows.Bytes()...)
+	dbf = append(dbf, 0x1a)
+
+	if _, err := l.shp.Write(shp); err != nil {
+		return err
+	}
+	if _, err := l.shx.Write(shx); err != nil {
+		return err
+	}
+	_, err := l.dbf.Write(dbf)
+	return err
+}
+
+// remove closes and removes the files of l, after an error.
+func (l *shapeLayer) remove() {
+	l.close()
+	for _, name := range l.created {
+		os.Remove(name)
+	}
+}
+
+// close closes the files of l.
+func (l *shapeLayer) close() error {
+	var err error
+	for _, f := range []*os.File{l.shp, l.shx, l.dbf} {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
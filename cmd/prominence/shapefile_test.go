@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randall77/prominence"
+)
+
+// testPeaks are a peak and an island top.  Positions are as for
+// SimpleDataSet: x, y and z are long, lat and height.
+var testPeaks = []prominence.Peak{
+	{
+		Result: prominence.Result{
+			Peak:       prominence.Cell{P: prominence.Point{X: 3, Y: -2}, Z: 700},
+			Col:        prominence.Cell{P: prominence.Point{X: 4, Y: -1}, Z: 500},
+			Dom:        prominence.Cell{P: prominence.Point{X: 6, Y: 0}, Z: 900},
+			LineParent: prominence.Cell{P: prominence.Point{X: 6, Y: 0}, Z: 900},
+			PromParent: prominence.Cell{P: prominence.Point{X: 6, Y: 0}, Z: 900},
+			Size:       12,
+		},
+		Prom: 200, Clean: 200, Optimistic: 200,
+	},
+	{
+		Result: prominence.Result{
+			Peak:   prominence.Cell{P: prominence.Point{X: 6, Y: 0}, Z: 900},
+			Size:   40,
+			Island: true,
+		},
+		Prom: 900, Clean: 900, Optimistic: 900,
+	},
+}
+
+func TestShapefile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "out")
+	w, err := newShapeWriter(base, prominence.SimpleDataSet(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range testPeaks {
+		w.Peak(p, nil)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	be, le := binary.BigEndian, binary.LittleEndian
+	for _, test := range []struct {
+		layer  string
+		points [][2]float64
+	}{
+		{"peaks", [][2]float64{{3, -2}, {6, 0}}},
+		{"cols", [][2]float64{{4, -1}}}, // no col for the island
+	} {
+		read := func(ext string) []byte {
+			b, err := ioutil.ReadFile(base + "_" + test.layer + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		shp, shx, dbf := read(".shp"), read(".shx"), read(".dbf")
+		if prj := read(".prj"); !bytes.HasPrefix(prj, []byte(`GEOGCS["GCS_WGS_1984"`)) {
+			t.Errorf("%s: bad .prj %q", test.layer, prj)
+		}
+		n := len(test.points)
+
+		// Both headers hold the file length, in 16-bit words,
+		// and the bounding box.
+		for _, f := range []struct {
+			ext string
+			b   []byte
+			len int
+		}{{".shp", shp, 100 + 28*n}, {".shx", shx, 100 + 8*n}} {
+			if len(f.b) != f.len || int(be.Uint32(f.b[24:]))*2 != f.len {
+				t.Errorf("%s%s: %d bytes, header says %d words, want %d bytes", test.layer, f.ext, len(f.b), be.Uint32(f.b[24:]), f.len)
+				continue
+			}
+			if be.Uint32(f.b) != 9994 || le.Uint32(f.b[28:]) != 1000 || le.Uint32(f.b[32:]) != 1 {
+				t.Errorf("%s%s: bad header % x", test.layer, f.ext, f.b[:36])
+			}
+			box := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+			for _, p := range test.points {
+				box[0], box[1] = math.Min(box[0], p[0]), math.Min(box[1], p[1])
+				box[2], box[3] = math.Max(box[2], p[0]), math.Max(box[3], p[1])
+			}
+			for i, v := range box {
+				if got := math.Float64frombits(le.Uint64(f.b[36+8*i:])); got != v {
+					t.Errorf("%s%s: bounding box %d is %g, want %g", test.layer, f.ext, i, got, v)
+				}
+			}
+		}
+		if t.Failed() {
+			continue
+		}
+
+		// The records, and the index of them.
+		for i, p := range test.points {
+			off := 100 + 28*i
+			r := shp[off:]
+			if be.Uint32(r) != uint32(i+1) || be.Uint32(r[4:]) != 10 || le.Uint32(r[8:]) != 1 {
+				t.Errorf("%s: record %d: bad header % x", test.layer, i, r[:12])
+			}
+			x, y := math.Float64frombits(le.Uint64(r[12:])), math.Float64frombits(le.Uint64(r[20:]))
+			if x != p[0] || y != p[1] {
+				t.Errorf("%s: record %d: point %g,%g, want %g,%g", test.layer, i, x, y, p[0], p[1])
+			}
+			if o, l := be.Uint32(shx[100+8*i:]), be.Uint32(shx[104+8*i:]); o != uint32(off/2) || l != 10 {
+				t.Errorf("%s: index %d: offset %d length %d, want %d 10", test.layer, i, o, l, off/2)
+			}
+		}
+
+		// The attributes.
+		nf := len(peakColumns)
+		if dbf[0] != 3 || le.Uint32(dbf[4:]) != uint32(n) || int(le.Uint16(dbf[8:])) != 32+32*nf+1 {
+			t.Errorf("%s.dbf: bad header % x", test.layer, dbf[:12])
+			continue
+		}
+		rowSize := 1
+		fields := map[string][2]int{} // type and width
+		for i := 0; i < nf; i++ {
+			d := dbf[32+32*i:]
+			name := string(bytes.TrimRight(d[:11], "\x00"))
+			fields[name] = [2]int{int(d[11]), int(d[16])}
+			rowSize += int(d[16])
+		}
+		if int(le.Uint16(dbf[10:])) != rowSize {
+			t.Errorf("%s.dbf: row size %d, want %d", test.layer, le.Uint16(dbf[10:]), rowSize)
+		}
+		for name, want := range map[string][2]int{
+			"PEAK_LON":   {'N', 13},
+			"PROM":       {'N', 12},
+			"SIZE":       {'N', 15},
+			"ISLAND":     {'L', 1},
+			"CLEAN_PROM": {'N', 12},
+			"PEAK_FILL":  {'L', 1},
+			"ISO_KM":     {'N', 12},
+		} {
+			if got, ok := fields[name]; !ok || got != want {
+				t.Errorf("%s.dbf: field %s is %c %d, want %c %d", test.layer, name, got[0], got[1], want[0], want[1])
+			}
+		}
+		if len(dbf) != 32+32*nf+1+n*rowSize+1 || dbf[len(dbf)-1] != 0x1a {
+			t.Errorf("%s.dbf: %d bytes, want %d records of %d", test.layer, len(dbf), n, rowSize)
+		}
+	}
+}
+
+func TestDBFNames(t *testing.T) {
+	for _, columns := range [][]string{peakColumns, basinColumns} {
+		seen := map[string]string{}
+		for _, c := range columns {
+			name := dbfName.Replace(c)
+			if len(name) > 10 {
+				t.Errorf("%s: dBase name %s is longer than 10", c, name)
+			}
+			if seen[name] != "" {
+				t.Errorf("%s and %s both have dBase name %s", seen[name], c, name)
+			}
+			seen[name] = c
+		}
+	}
+}
+
+func TestShapefileCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The second layer can't make its .dbf file.
+	if err := os.Mkdir(filepath.Join(dir, "out_cols.dbf"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newShapeWriter(filepath.Join(dir, "out"), prominence.SimpleDataSet(nil)); err == nil {
+		t.Fatal("no error making a shapefile over a directory")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 1 {
+		t.Errorf("files left behind: %s", strings.Join(names, " "))
+	}
+}
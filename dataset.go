@@ -1,32 +1,36 @@
-package main
+package prominence
 
-// A dataSet provides an interface to topography data
+// A DataSet provides an interface to topography data
 // about the world.  A dataset is conceptually a 2d grid
 // of altitude samples.
 // Samples are identified by their (dense) grid coordinates.
 // Samples are adjacent if they differ by exactly 1 in
 // exactly one coordinate.
 // Samples which are at sea level do not need to be
-// considered part of the dataSet.
-type dataSet interface {
+// considered part of the DataSet.
+type DataSet interface {
 	// Init performs any once-only initialization.
-	Init()
+	Init() error
 
 	// Bounds returns bounds on the returned cells.
 	// minx <= x < maxx
 	// miny <= y < maxy
 	// minz <= z < maxz
-	Bounds() (minx, maxx, miny, maxy coord, minz, maxz height)
+	Bounds() (minx, maxx, miny, maxy Coord, minz, maxz Height)
 
 	// Returns a channel of all samples in the data set.
 	// For efficiency, we send a chunk of samples at a time.
 	// Multiple calls to Reader return independent channels.
-	Reader() <-chan []cell
+	// The receiver owns each chunk once it is sent.
+	// Reading stops early if done is closed.  Once the cell
+	// channel is closed, the error channel receives nil if all
+	// the samples were sent, or the error which stopped reading.
+	Reader(done <-chan struct{}) (<-chan []Cell, <-chan error)
 
 	// Pos converts from the internal integral coordinate system
-	// to standard coordinates.  lat and long are in degrees.
+	// to standard coordinates.  long and lat are in degrees.
 	// height is in meters above sea level.
-	// lat is degrees north of the equator (-90 to 90).
 	// long is degrees east from the prime meridian (-180 to 180).
-	Pos(c cell) (lat, long, height float64)
+	// lat is degrees north of the equator (-90 to 90).
+	Pos(c Cell) (long, lat, height float64)
 }
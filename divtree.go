@@ -0,0 +1,292 @@
+package prominence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Divide tree.
+//
+// ComputeProminence joins islands together as the water drains.
+// Each join of a lower island into a higher one is an edge in the
+// divide tree: it connects the lower island's peak to the higher
+// island's peak (its dom) through the key col where they joined.
+// Island tops are the roots of the tree.
+//
+// A node's parent always has more prominence than the node itself,
+// because the parent's island had not yet been joined to anything
+// when the node's key col was reached.  So pruning the tree to any
+// prominence threshold is just dropping the nodes below the
+// threshold; the parent links of the remaining nodes stay valid.
+// The same goes for prominence parents.  Line parents depend on the
+// threshold, and are recorded for the threshold the tree was computed
+// with, which is stored in the file.  To raise the threshold, follow
+// parent links from a line parent until reaching a peak with enough
+// prominence (see DivideTree.LineParent).  The threshold can't be
+// lowered: the line parents below it were never found.
+//
+// Divide tree file format (all values little-endian):
+//   magic: the 7 bytes "divtree"
+//   version: 1 byte, the ASCII digit '1'.  The version changes
+//     with the layout; files of other versions must be computed again.
+//   scalex, offsetx, scaley, offsety, scalez, offsetz: 64-bit float
+//     maps grid coordinates to long, lat, and height (see DataSet.Pos)
+//   verr: 32-bit signed, the vertical error the tree was computed
+//     with (see Result.Uncertain and Result.Clean)
+//   minProm: 32-bit signed, the minProm the tree was computed
+//     with, which line parents were chosen for
+//   [node]*n, where each node is:
+//     peak x, y, z: 32-bit signed
+//     col x, y, z: 32-bit signed (zero for island tops)
+//     parent x, y, z: 32-bit signed, the parent's peak
+//       (zero for island tops)
+//     line parent x, y, z: 32-bit signed (zero for island tops)
+//     prominence parent x, y, z: 32-bit signed (zero for island tops)
+//     peak region, col region (see Region), each:
+//       size: 64-bit signed
+//       minx, miny, maxx, maxy: 32-bit signed
+//     size: 64-bit signed
+//     flags: 8-bit, bit 0 set for island tops, bit 1 set
+//       if the key col is uncertain (see Result.Uncertain),
+//       bits 2 and 3 set if the peak or key col is in a filled
+//       void (see Result.PeakFilled)
+//
+// A node is a Result from ComputeProminence, with the
+// parent stored in its dom field.  Its clean and optimistic
+// prominence follow from verr.
+
+const (
+	treeMagic   = "divtree"
+	treeVersion = '1'
+)
+
+const treeHeaderSize = len(treeMagic) + 1 + 6*8 + 2*4
+
+const treeNodeSize = 15*4 + 2*(8+4*4) + 8 + 1
+
+// A DivideTree is a divide tree read from a file.
+type DivideTree struct {
+	scalex, offsetx, scaley, offsety, scalez, offsetz float64
+
+	// VErr is the vertical error the tree was computed with.
+	VErr Height
+	// MinProm is the minProm the tree was computed with.  The
+	// line parents in Nodes are for that threshold.
+	MinProm Height
+
+	// Nodes are the nodes of the tree, with the parent
+	// stored in the Dom field of each.
+	Nodes []Result
+
+	// index maps peak location to position in Nodes.
+	index map[Point]int
+}
+
+// Pos converts to standard coordinates, as for DataSet.Pos.
+func (t *DivideTree) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X)*t.scalex + t.offsetx,
+		float64(c.P.Y)*t.scaley + t.offsety,
+		float64(c.Z)*t.scalez + t.offsetz
+}
+
+// LineParent returns the line parent of n when the tree is pruned
+// to min prominence (in internal altitude units).  It is an error
+// for min to be less than t.MinProm.
+func (t *DivideTree) LineParent(n Result, min Height) (Cell, error) {
+	if min < t.MinProm {
+		return Cell{}, fmt.Errorf("divide tree was computed with minProm %d, can't find line parents for %d", t.MinProm, min)
+	}
+	if t.index == nil {
+		t.index = map[Point]int{}
+		for k, m := range t.Nodes {
+			t.index[m.Peak.P] = k
+		}
+	}
+	p := n.LineParent
+	for {
+		k, ok := t.index[p.P]
+		if !ok {
+			return p, nil
+		}
+		m := t.Nodes[k]
+		if m.Island || m.Peak.Z-m.Col.Z >= min {
+			return p, nil
+		}
+		p = m.Dom
+	}
+}
+
+// ReadTree reads a divide tree in the format written by a TreeWriter.
+func ReadTree(r io.Reader) (*DivideTree, error) {
+	b := bufio.NewReader(r)
+	var hdr [treeHeaderSize]byte
+	if _, err := io.ReadFull(b, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading divide tree header: %v", err)
+	}
+	if string(hdr[:len(treeMagic)]) != treeMagic {
+		return nil, fmt.Errorf("not a divide tree file")
+	}
+	if v := hdr[len(treeMagic)]; v != treeVersion {
+		return nil, fmt.Errorf("divide tree version %q is not supported (want %q), compute it again", v, treeVersion)
+	}
+	bo := binary.LittleEndian
+	f := func(i int) float64 {
+		return math.Float64frombits(bo.Uint64(hdr[len(treeMagic)+1+8*i:]))
+	}
+	t := &DivideTree{
+		scalex: f(0), offsetx: f(1),
+		scaley: f(2), offsety: f(3),
+		scalez: f(4), offsetz: f(5),
+		VErr:    Height(bo.Uint32(hdr[len(hdr)-8:])),
+		MinProm: Height(bo.Uint32(hdr[len(hdr)-4:])),
+	}
+
+	var buf [treeNodeSize]byte
+	for {
+		_, err := io.ReadFull(b, buf[:])
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading divide tree node %d: %v", len(t.Nodes), err)
+		}
+		d := nodeDecoder{buf[:]}
+		n := Result{
+			Peak:       d.cell(),
+			Col:        d.cell(),
+			Dom:        d.cell(),
+			LineParent: d.cell(),
+			PromParent: d.cell(),
+			PeakRegion: d.region(),
+			ColRegion:  d.region(),
+			Size:       d.int64(),
+			Island:     d.b[0]&1 != 0,
+			Uncertain:  d.b[0]&2 != 0,
+			PeakFilled: d.b[0]&4 != 0,
+			ColFilled:  d.b[0]&8 != 0,
+		}
+		n.setBounds(t.VErr)
+		t.Nodes = append(t.Nodes, n)
+	}
+}
+
+// A nodeDecoder decodes the fields of a divide tree node.
+type nodeDecoder struct {
+	b []byte
+}
+
+func (d *nodeDecoder) int32() int32 {
+	x := int32(binary.LittleEndian.Uint32(d.b))
+	d.b = d.b[4:]
+	return x
+}
+
+func (d *nodeDecoder) int64() int64 {
+	x := int64(binary.LittleEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return x
+}
+
+func (d *nodeDecoder) cell() Cell {
+	x := Coord(d.int32())
+	y := Coord(d.int32())
+	return Cell{Point{x, y}, Height(d.int32())}
+}
+
+func (d *nodeDecoder) region() Region {
+	r := Region{Size: d.int64()}
+	r.Min.X = Coord(d.int32())
+	r.Min.Y = Coord(d.int32())
+	r.Max.X = Coord(d.int32())
+	r.Max.Y = Coord(d.int32())
+	return r
+}
+
+// A TreeWriter writes a divide tree to a file.
+type TreeWriter struct {
+	w *bufio.Writer
+}
+
+// NewTreeWriter starts a divide tree on w, and returns any error
+// writing its header.  The coordinate mapping is taken from d, which
+// must be affine (true of all our data sets).  minProm and verr are
+// the arguments passed to ComputeProminence.
+func NewTreeWriter(w io.Writer, d DataSet, minProm, verr Height) (*TreeWriter, error) {
+	x0, y0, z0 := d.Pos(Cell{})
+	x1, y1, z1 := d.Pos(Cell{Point{1, 1}, 1})
+	hdr := make([]byte, treeHeaderSize)
+	copy(hdr, treeMagic)
+	hdr[len(treeMagic)] = treeVersion
+	bo := binary.LittleEndian
+	for i, v := range [6]float64{x1 - x0, x0, y1 - y0, y0, z1 - z0, z0} {
+		bo.PutUint64(hdr[len(treeMagic)+1+8*i:], math.Float64bits(v))
+	}
+	bo.PutUint32(hdr[len(hdr)-8:], uint32(verr))
+	bo.PutUint32(hdr[len(hdr)-4:], uint32(minProm))
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &TreeWriter{w: bufio.NewWriter(w)}, nil
+}
+
+// Add records a node in the divide tree.
+func (t *TreeWriter) Add(res Result) {
+	var buf [treeNodeSize]byte
+	e := nodeEncoder{buf[:]}
+	for _, c := range [5]Cell{res.Peak, res.Col, res.Dom, res.LineParent, res.PromParent} {
+		e.cell(c)
+	}
+	e.region(res.PeakRegion)
+	e.region(res.ColRegion)
+	e.int64(res.Size)
+	if res.Island {
+		e.b[0] |= 1
+	}
+	if res.Uncertain {
+		e.b[0] |= 2
+	}
+	if res.PeakFilled {
+		e.b[0] |= 4
+	}
+	if res.ColFilled {
+		e.b[0] |= 8
+	}
+	t.w.Write(buf[:])
+}
+
+// A nodeEncoder encodes the fields of a divide tree node.
+type nodeEncoder struct {
+	b []byte
+}
+
+func (e *nodeEncoder) int32(x int32) {
+	binary.LittleEndian.PutUint32(e.b, uint32(x))
+	e.b = e.b[4:]
+}
+
+func (e *nodeEncoder) int64(x int64) {
+	binary.LittleEndian.PutUint64(e.b, uint64(x))
+	e.b = e.b[8:]
+}
+
+func (e *nodeEncoder) cell(c Cell) {
+	e.int32(int32(c.P.X))
+	e.int32(int32(c.P.Y))
+	e.int32(int32(c.Z))
+}
+
+func (e *nodeEncoder) region(r Region) {
+	e.int64(r.Size)
+	e.int32(int32(r.Min.X))
+	e.int32(int32(r.Min.Y))
+	e.int32(int32(r.Max.X))
+	e.int32(int32(r.Max.Y))
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (t *TreeWriter) Flush() error {
+	return t.w.Flush()
+}
@@ -0,0 +1,153 @@
+package prominence
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTreeRoundTrip(t *testing.T) {
+	data := SimpleDataSet(parseTest(`
+111111111111
+132425262728
+111111111111
+`))
+	var buf bytes.Buffer
+	w, err := NewTreeWriter(&buf, data, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []Result
+	err = ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), 2, 1, nil, func(res Result) {
+		w.Add(res)
+		want = append(want, res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := ReadTree(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.VErr != 1 || tree.MinProm != 2 {
+		t.Errorf("want vertical error 1 and minProm 2, got %d and %d", tree.VErr, tree.MinProm)
+	}
+	if len(tree.Nodes) != len(want) {
+		t.Fatalf("want %d nodes, got %d", len(want), len(tree.Nodes))
+	}
+	for i := range want {
+		if tree.Nodes[i] != want[i] {
+			t.Errorf("node %d: want %v, got %v", i, want[i], tree.Nodes[i])
+		}
+	}
+	if x, y, z := tree.Pos(Cell{Point{3, 1}, 4}); x != 3 || y != 1 || z != 4 {
+		t.Errorf("bad position mapping %f %f %f", x, y, z)
+	}
+
+	// Every parent must be a node in the tree.
+	peaks := map[Cell]bool{}
+	for _, n := range tree.Nodes {
+		peaks[n.Peak] = true
+	}
+	for _, n := range tree.Nodes {
+		if !n.Island && !peaks[n.Dom] {
+			t.Errorf("parent %v of %v not in tree", n.Dom, n.Peak)
+		}
+	}
+}
+
+// failWriter fails every write.
+type failWriter struct{}
+
+func (failWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestTreeErrors(t *testing.T) {
+	data := SimpleDataSet(parseTest(`
+121
+`))
+	if _, err := NewTreeWriter(failWriter{}, data, 0, 0); err == nil || err.Error() != "disk full" {
+		t.Errorf("want header write error, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := NewTreeWriter(&buf, data, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	hdr := buf.Bytes()
+	for _, test := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"other version", append([]byte("divtree2"), hdr[8:]...), "version '2' is not supported"},
+		{"magic", append([]byte("dovtree1"), hdr[8:]...), "not a divide tree"},
+		{"short", hdr[:20], "reading divide tree header"},
+	} {
+		if _, err := ReadTree(bytes.NewReader(test.data)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: want error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestTreeLineParent(t *testing.T) {
+	// As in TestParents: P's line parent is Q below a threshold
+	// of 3, and A from 3 up.
+	data := SimpleDataSet(parseTest(`
+1111111
+1968471
+1111111
+`))
+	p := Cell{Point{5, 1}, 7}
+	q := Cell{Point{3, 1}, 8}
+	a := Cell{Point{1, 1}, 9}
+	for _, treeMin := range []Height{0, 2} {
+		var buf bytes.Buffer
+		w, err := NewTreeWriter(&buf, data, treeMin, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), treeMin, 0, nil, w.Add); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		tree, err := ReadTree(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var node Result
+		for _, n := range tree.Nodes {
+			if n.Peak == p {
+				node = n
+			}
+		}
+		for _, test := range []struct {
+			min  Height
+			want Cell
+		}{
+			{0, q},
+			{2, q},
+			{3, a},
+			{5, a},
+		} {
+			got, err := tree.LineParent(node, test.min)
+			if test.min < treeMin {
+				if err == nil {
+					t.Errorf("tree at %d: no error for line parent at %d", treeMin, test.min)
+				}
+				continue
+			}
+			if err != nil || got != test.want {
+				t.Errorf("tree at %d: line parent at %d: want %v, got %v, %v", treeMin, test.min, test.want, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package prominence
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Importer for GeoTIFF DEMs, like Copernicus GLO-30, ASTER GDEM,
+// or SRTM from current portals.
+// http://geotiff.maptools.org/spec/geotiffhome.html
+//
+// We handle one band of int16, uint16, int32 or float32 samples,
+// in strips or tiles, uncompressed or compressed with LZW or deflate,
+// with or without a predictor.  Samples equal to the GDAL nodata
+// value (or NaN) are omitted.  The raster must be in a geographic
+// (long/lat) coordinate system, located by the ModelTiepoint and
+// ModelPixelScale tags.
+//
+// Grid coordinates are as for all rasters (see raster).  Integer
+// samples are in meters.  Float samples are stored internally in
+// decimeters.
+
+// TIFF tags we use.
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagSampleFormat    = 339
+	tagPixelScale      = 33550
+	tagTiepoint        = 33922
+	tagGeoKeyDirectory = 34735
+	tagGDALNoData      = 42113
+)
+
+// GeoKeys we use.
+const (
+	keyModelType  = 1024
+	keyRasterType = 1025
+)
+
+// A GeoTIFF is a DataSet for the GeoTIFF file of the given name.
+type GeoTIFF struct {
+	name string
+	raster
+
+	order binary.ByteOrder
+	big   bool // BigTIFF
+
+	bits        int // bits per sample
+	format      int // sample format: 1 = unsigned, 2 = signed, 3 = float
+	compression int
+	predictor   int
+
+	// The raster is divided into blocks (strips or tiles), each
+	// blockw by blockh samples (strips are as wide as the raster).
+	blockw, blockh int
+	offsets        []uint64
+	counts         []uint64
+}
+
+// NewGeoTIFF returns a GeoTIFF which reads the named file.
+func NewGeoTIFF(name string) *GeoTIFF {
+	return &GeoTIFF{name: name}
+}
+
+// A tiffField is a field of a TIFF image file directory.
+type tiffField struct {
+	typ   uint16
+	count uint64
+	data  []byte // count values of typ
+}
+
+// tiffTypeSize gives the size in bytes of each TIFF field type.
+var tiffTypeSize = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 16: 8, 17: 8,
+}
+
+func (g *GeoTIFF) Init() error {
+	f, err := os.Open(g.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := g.readHeader(f); err != nil {
+		return fmt.Errorf("%s: %v", g.name, err)
+	}
+	return nil
+}
+
+// readHeader reads the first image file directory and checks
+// that we can handle the image it describes.
+func (g *GeoTIFF) readHeader(f *os.File) error {
+	var hdr [16]byte
+	if _, err := f.ReadAt(hdr[:8], 0); err != nil {
+		return err
+	}
+	switch string(hdr[:2]) {
+	case "II":
+		g.order = binary.LittleEndian
+	case "MM":
+		g.order = binary.BigEndian
+	default:
+		return fmt.Errorf("not a TIFF file")
+	}
+	var ifd uint64
+	switch g.order.Uint16(hdr[2:]) {
+	case 42:
+		ifd = uint64(g.order.Uint32(hdr[4:]))
+	case 43:
+		g.big = true
+		if _, err := f.ReadAt(hdr[:16], 0); err != nil {
+			return err
+		}
+		ifd = g.order.Uint64(hdr[8:])
+	default:
+		return fmt.Errorf("not a TIFF file")
+	}
+	fields, err := g.readIFD(f, ifd)
+	if err != nil {
+		return err
+	}
+
+	// Image layout.
+	get := func(tag uint16, def uint64) uint64 {
+		if fd, ok := fields[tag]; ok && fd.count > 0 {
+			return g.uint(fd, 0)
+		}
+		return def
+	}
+	g.width = int(get(tagImageWidth, 0))
+	g.length = int(get(tagImageLength, 0))
+	if g.width == 0 || g.length == 0 {
+		return fmt.Errorf("missing image size")
+	}
+	if n := get(tagSamplesPerPixel, 1); n != 1 {
+		return fmt.Errorf("%d samples per pixel, want 1", n)
+	}
+	g.bits = int(get(tagBitsPerSample, 1))
+	g.format = int(get(tagSampleFormat, 1))
+	switch {
+	case g.format == 1 && g.bits == 16:
+	case g.format == 2 && (g.bits == 16 || g.bits == 32):
+	case g.format == 3 && g.bits == 32:
+	default:
+		return fmt.Errorf("unsupported sample format %d with %d bits", g.format, g.bits)
+	}
+	g.compression = int(get(tagCompression, 1))
+	switch g.compression {
+	case 1, 5, 8, 32946:
+	default:
+		return fmt.Errorf("unsupported compression %d", g.compression)
+	}
+	g.predictor = int(get(tagPredictor, 1))
+	if g.predictor < 1 || g.predictor > 3 {
+		return fmt.Errorf("unsupported predictor %d", g.predictor)
+	}
+	offsetTag, countTag := uint16(tagStripOffsets), uint16(tagStripByteCounts)
+	if _, ok := fields[tagTileOffsets]; ok {
+		offsetTag, countTag = tagTileOffsets, tagTileByteCounts
+		g.blockw = int(get(tagTileWidth, 0))
+		g.blockh = int(get(tagTileLength, 0))
+		if g.blockw == 0 || g.blockh == 0 {
+			return fmt.Errorf("missing tile size")
+		}
+	} else {
+		g.blockw = g.width
+		g.blockh = int(get(tagRowsPerStrip, uint64(g.length)))
+		if g.blockh > g.length {
+			g.blockh = g.length
+		}
+	}
+	g.offsets = g.uints(fields[offsetTag])
+	g.counts = g.uints(fields[countTag])
+	n := ((g.width + g.blockw - 1) / g.blockw) * ((g.length + g.blockh - 1) / g.blockh)
+	if len(g.offsets) != n || len(g.counts) != n {
+		return fmt.Errorf("want %d strips or tiles, got %d offsets and %d byte counts", n, len(g.offsets), len(g.counts))
+	}
+	// We read each strip or tile whole, so don't trust its byte
+	// count further than its samples could take, compressed.  LZW
+	// can grow data by half, deflate by much less.
+	max := uint64(g.blockw) * uint64(g.blockh) * uint64(g.bits/8)
+	max += max/2 + 1024
+	for k, c := range g.counts {
+		if c > max {
+			return fmt.Errorf("strip or tile %d is %d bytes, want at most %d", k, c, max)
+		}
+	}
+
+	if fd, ok := fields[tagGDALNoData]; ok {
+		s := strings.TrimSpace(strings.TrimRight(string(fd.data), "\x00"))
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("bad nodata value %q", s)
+		}
+		g.nodata = v
+		g.hasNodata = true
+	}
+
+	// Georeferencing.
+	rasterType := uint64(1) // pixel is area
+	if fd, ok := fields[tagGeoKeyDirectory]; ok {
+		keys := g.uints(fd)
+		for k := 4; k+3 < len(keys); k += 4 {
+			if keys[k+1] != 0 {
+				continue // value stored elsewhere; not one we use
+			}
+			switch keys[k] {
+			case keyModelType:
+				if keys[k+3] != 2 {
+					return fmt.Errorf("model type %d, only geographic (2) is supported", keys[k+3])
+				}
+			case keyRasterType:
+				rasterType = keys[k+3]
+			}
+		}
+	}
+	scale, ok := fields[tagPixelScale]
+	if !ok || scale.count < 2 {
+		return fmt.Errorf("missing ModelPixelScale")
+	}
+	tie, ok := fields[tagTiepoint]
+	if !ok || tie.count < 6 {
+		return fmt.Errorf("missing ModelTiepoint")
+	}
+	g.scalex = g.float(scale, 0)
+	g.scaley = g.float(scale, 1)
+	i, j := g.float(tie, 0), g.float(tie, 1)
+	if rasterType == 1 {
+		// The tiepoint is at the corner of the pixel,
+		// and we want pixel centers.
+		i -= 0.5
+		j -= 0.5
+	}
+	g.long0 = g.float(tie, 3) - i*g.scalex
+	g.lat0 = g.float(tie, 4) + j*g.scaley
+
+	g.scalez = 1
+	if g.format == 3 {
+		g.scalez = 0.1
+	}
+	return nil
+}
+
+// readIFD reads the image file directory at off in f.
+func (g *GeoTIFF) readIFD(f *os.File, off uint64) (map[uint16]tiffField, error) {
+	// Entry layout: tag, type, count, value/offset.
+	countSize, entrySize, inline := 2, 12, 4
+	if g.big {
+		countSize, entrySize, inline = 8, 20, 8
+	}
+	b := make([]byte, countSize)
+	if _, err := f.ReadAt(b, int64(off)); err != nil {
+		return nil, err
+	}
+	var n uint64
+	if g.big {
+		n = g.order.Uint64(b)
+	} else {
+		n = uint64(g.order.Uint16(b))
+	}
+	b = make([]byte, int(n)*entrySize)
+	if _, err := f.ReadAt(b, int64(off)+int64(countSize)); err != nil {
+		return nil, err
+	}
+	fields := map[uint16]tiffField{}
+	for ; len(b) > 0; b = b[entrySize:] {
+		tag := g.order.Uint16(b)
+		fd := tiffField{typ: g.order.Uint16(b[2:])}
+		var v []byte
+		if g.big {
+			fd.count = g.order.Uint64(b[4:])
+			v = b[12:20]
+		} else {
+			fd.count = uint64(g.order.Uint32(b[4:]))
+			v = b[8:12]
+		}
+		size, ok := tiffTypeSize[fd.typ]
+		if !ok {
+			continue // unknown type; not one of ours
+		}
+		total := fd.count * uint64(size)
+		if total <= uint64(inline) {
+			fd.data = append([]byte(nil), v[:total]...)
+		} else {
+			if total > 1<<30 {
+				return nil, fmt.Errorf("tag %d too big", tag)
+			}
+			var at uint64
+			if g.big {
+				at = g.order.Uint64(v)
+			} else {
+				at = uint64(g.order.Uint32(v))
+			}
+			fd.data = make([]byte, total)
+			if _, err := f.ReadAt(fd.data, int64(at)); err != nil {
+				return nil, fmt.Errorf("reading tag %d: %v", tag, err)
+			}
+		}
+		fields[tag] = fd
+	}
+	return fields, nil
+}
+
+// uint returns the i'th value of an integer field.
+func (g *GeoTIFF) uint(fd tiffField, i int) uint64 {
+	switch fd.typ {
+	case 1:
+		return uint64(fd.data[i])
+	case 3:
+		return uint64(g.order.Uint16(fd.data[2*i:]))
+	case 4:
+		return uint64(g.order.Uint32(fd.data[4*i:]))
+	case 16:
+		return g.order.Uint64(fd.data[8*i:])
+	}
+	return 0
+}
+
+// uints returns all the values of an integer field.
+func (g *GeoTIFF) uints(fd tiffField) []uint64 {
+	v := make([]uint64, fd.count)
+	for i := range v {
+		v[i] = g.uint(fd, i)
+	}
+	return v
+}
+
+// float returns the i'th value of a double field.
+func (g *GeoTIFF) float(fd tiffField, i int) float64 {
+	if fd.typ != 12 {
+		return float64(g.uint(fd, i))
+	}
+	return math.Float64frombits(g.order.Uint64(fd.data[8*i:]))
+}
+
+func (g *GeoTIFF) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	return g.readRows(done, 0, Coord(g.length))
+}
+
+func (g *GeoTIFF) readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c)
+		err := g.read(c, done, miny, maxy)
+		if err != nil && err != errCanceled {
+			err = fmt.Errorf("%s: %v", g.name, err)
+		}
+		errc <- err
+	}()
+	return c, errc
+}
+
+// read sends the samples of g in the strips or tiles which
+// overlap rows [miny, maxy) to c.
+func (g *GeoTIFF) read(c chan<- []Cell, done <-chan struct{}, miny, maxy Coord) error {
+	f, err := os.Open(g.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Print("reading " + g.name)
+	chunker := cellChunker{c: c, done: done}
+	across := (g.width + g.blockw - 1) / g.blockw
+	bps := g.bits / 8
+	for k := range g.offsets {
+		x0 := k % across * g.blockw
+		y0 := k / across * g.blockh
+		if Coord(y0) >= maxy || Coord(y0+g.blockh) <= miny {
+			continue
+		}
+		raw := make([]byte, g.counts[k])
+		if _, err := f.ReadAt(raw, int64(g.offsets[k])); err != nil {
+			return err
+		}
+		b, err := g.decompress(raw, g.blockw*g.blockh*bps)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", k, err)
+		}
+		rows := len(b) / (g.blockw * bps)
+		if rows > g.blockh {
+			rows = g.blockh
+		}
+		for j := 0; j < rows; j++ {
+			row := b[j*g.blockw*bps : (j+1)*g.blockw*bps]
+			g.unpredict(row)
+			y := y0 + j
+			if y >= g.length {
+				break // padding at the bottom of the last tiles
+			}
+			for i := 0; i < g.blockw && x0+i < g.width; i++ {
+				z, ok := g.height(g.sample(row, i))
+				if !ok {
+					continue
+				}
+				if !chunker.send(Cell{Point{Coord(x0 + i), Coord(y)}, z}) {
+					return errCanceled
+				}
+			}
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
+
+// decompress decompresses a strip or tile of at most n bytes.
+func (g *GeoTIFF) decompress(b []byte, n int) ([]byte, error) {
+	switch g.compression {
+	case 5:
+		return lzwDecode(b, n)
+	case 8, 32946:
+		r, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(io.LimitReader(r, int64(n)))
+	}
+	return b, nil
+}
+
+// unpredict undoes the predictor on one row of a strip or tile.
+func (g *GeoTIFF) unpredict(row []byte) {
+	switch g.predictor {
+	case 2:
+		// Horizontal differencing of samples.
+		switch g.bits {
+		case 16:
+			for i := 2; i+1 < len(row); i += 2 {
+				g.order.PutUint16(row[i:], g.order.Uint16(row[i:])+g.order.Uint16(row[i-2:]))
+			}
+		case 32:
+			for i := 4; i+3 < len(row); i += 4 {
+				g.order.PutUint32(row[i:], g.order.Uint32(row[i:])+g.order.Uint32(row[i-4:]))
+			}
+		}
+	case 3:
+		// Floating point: horizontal differencing of bytes, which
+		// are in planes of the big-endian bytes of each sample.
+		for i := 1; i < len(row); i++ {
+			row[i] += row[i-1]
+		}
+		bps := g.bits / 8
+		w := len(row) / bps
+		tmp := make([]byte, len(row))
+		for i := 0; i < w; i++ {
+			for k := 0; k < bps; k++ {
+				tmp[i*bps+k] = row[k*w+i]
+			}
+		}
+		// Now in big-endian order; convert to file order.
+		for i := 0; i < w; i++ {
+			s := tmp[i*bps : (i+1)*bps]
+			switch bps {
+			case 4:
+				g.order.PutUint32(row[i*bps:], binary.BigEndian.Uint32(s))
+			case 2:
+				g.order.PutUint16(row[i*bps:], binary.BigEndian.Uint16(s))
+			}
+		}
+	}
+}
+
+// sample returns the i'th sample of row.
+func (g *GeoTIFF) sample(row []byte, i int) float64 {
+	switch {
+	case g.format == 1 && g.bits == 16:
+		return float64(g.order.Uint16(row[2*i:]))
+	case g.format == 2 && g.bits == 16:
+		return float64(int16(g.order.Uint16(row[2*i:])))
+	case g.format == 2 && g.bits == 32:
+		return float64(int32(g.order.Uint32(row[4*i:])))
+	default: // float32
+		return float64(math.Float32frombits(g.order.Uint32(row[4*i:])))
+	}
+}
+
+// lzwDecode decodes TIFF-flavored LZW data (MSB-first codes,
+// with the code width changing one code early), producing
+// at most n bytes.
+func lzwDecode(src []byte, n int) ([]byte, error) {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+	)
+	out := make([]byte, 0, n)
+	var table [4096][]byte
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	next := 258
+	width := uint(9)
+	var prev []byte
+	var acc uint32 // bit accumulator
+	var nacc uint  // # of bits in acc
+	for len(out) < n {
+		for nacc < width {
+			if len(src) == 0 {
+				return out, nil // some writers omit the EOI code
+			}
+			acc = acc<<8 | uint32(src[0])
+			src = src[1:]
+			nacc += 8
+		}
+		code := int(acc>>(nacc-width)) & (1<<width - 1)
+		nacc -= width
+		switch {
+		case code == eoiCode:
+			return out, nil
+		case code == clearCode:
+			next = 258
+			width = 9
+			prev = nil
+			continue
+		}
+		var entry []byte
+		switch {
+		case prev == nil:
+			if code >= 256 {
+				return nil, fmt.Errorf("bad LZW code %d", code)
+			}
+			entry = table[code]
+		case code < next:
+			entry = table[code]
+			if next < len(table) {
+				table[next] = append(append([]byte(nil), prev...), entry[0])
+				next++
+			}
+		case code == next && next < len(table):
+			entry = append(append([]byte(nil), prev...), prev[0])
+			table[next] = entry
+			next++
+		default:
+			return nil, fmt.Errorf("bad LZW code %d", code)
+		}
+		out = append(out, entry...)
+		prev = entry
+		if next >= 1<<width-1 && width < 12 {
+			width++
+		}
+	}
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
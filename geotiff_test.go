@@ -0,0 +1,397 @@
+package prominence
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A testTag is a TIFF tag to write.  vals is a []uint16,
+// []uint32, []float64 or string.
+type testTag struct {
+	tag  uint16
+	vals interface{}
+}
+
+// buildTIFF makes a TIFF file with the given tags plus the
+// offsets and byte counts of blocks, which are strips unless
+// tiled is set.
+func buildTIFF(order binary.ByteOrder, tags []testTag, blocks [][]byte, tiled bool) []byte {
+	var b bytes.Buffer
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	binary.Write(&b, order, uint16(42))
+	binary.Write(&b, order, uint32(0)) // IFD offset, patched below
+
+	var offsets, counts []uint32
+	for _, blk := range blocks {
+		offsets = append(offsets, uint32(b.Len()))
+		counts = append(counts, uint32(len(blk)))
+		b.Write(blk)
+	}
+	if tiled {
+		tags = append(tags, testTag{tagTileOffsets, offsets}, testTag{tagTileByteCounts, counts})
+	} else {
+		tags = append(tags, testTag{tagStripOffsets, offsets}, testTag{tagStripByteCounts, counts})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].tag < tags[j].tag })
+
+	if b.Len()%2 == 1 {
+		b.WriteByte(0)
+	}
+	ifd := b.Len()
+	order.PutUint32(b.Bytes()[4:], uint32(ifd))
+	extra := ifd + 2 + 12*len(tags) + 4 // where values that don't fit go
+	var ext bytes.Buffer
+	binary.Write(&b, order, uint16(len(tags)))
+	for _, t := range tags {
+		var typ uint16
+		var data bytes.Buffer
+		var n int
+		switch v := t.vals.(type) {
+		case []uint16:
+			typ, n = 3, len(v)
+			binary.Write(&data, order, v)
+		case []uint32:
+			typ, n = 4, len(v)
+			binary.Write(&data, order, v)
+		case []float64:
+			typ, n = 12, len(v)
+			binary.Write(&data, order, v)
+		case string:
+			typ, n = 2, len(v)+1
+			data.WriteString(v)
+			data.WriteByte(0)
+		}
+		binary.Write(&b, order, t.tag)
+		binary.Write(&b, order, typ)
+		binary.Write(&b, order, uint32(n))
+		if data.Len() <= 4 {
+			var v [4]byte
+			copy(v[:], data.Bytes())
+			b.Write(v[:])
+		} else {
+			binary.Write(&b, order, uint32(extra+ext.Len()))
+			ext.Write(data.Bytes())
+			if ext.Len()%2 == 1 {
+				ext.WriteByte(0)
+			}
+		}
+	}
+	binary.Write(&b, order, uint32(0)) // no next IFD
+	b.Write(ext.Bytes())
+	return b.Bytes()
+}
+
+// lzwEncode compresses src in TIFF-flavored LZW.
+func lzwEncode(src []byte) []byte {
+	var out []byte
+	var acc uint64
+	var nacc uint
+	width := uint(9)
+	emit := func(code int) {
+		acc = acc<<width | uint64(code)
+		nacc += width
+		for nacc >= 8 {
+			out = append(out, byte(acc>>(nacc-8)))
+			nacc -= 8
+		}
+	}
+	var table map[string]int
+	var next int
+	reset := func() {
+		table = map[string]int{}
+		for i := 0; i < 256; i++ {
+			table[string([]byte{byte(i)})] = i
+		}
+		next = 258
+	}
+	reset()
+	emit(256)
+	cur := ""
+	for _, c := range src {
+		s := cur + string([]byte{c})
+		if _, ok := table[s]; ok {
+			cur = s
+			continue
+		}
+		emit(table[cur])
+		table[s] = next
+		next++
+		if next > 1<<width-1 && width < 12 {
+			width++
+		}
+		if next == 4093 {
+			emit(256)
+			reset()
+			width = 9
+		}
+		cur = string([]byte{c})
+	}
+	if cur != "" {
+		emit(table[cur])
+		next++
+		if next > 1<<width-1 && width < 12 {
+			width++
+		}
+	}
+	emit(257)
+	if nacc > 0 {
+		out = append(out, byte(acc<<(8-nacc)))
+	}
+	return out
+}
+
+func TestLZW(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 100, 5000, 100000} {
+		src := make([]byte, n)
+		for i := range src {
+			src[i] = byte(rnd.Intn(4) + i/1000)
+		}
+		got, err := lzwDecode(lzwEncode(src), n)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("n=%d: round trip failed", n)
+		}
+	}
+}
+
+// geoTags returns the georeferencing tags for a raster with
+// pixel (0, 0) centered on long 10.5, lat 47.5, at 1/2 degree spacing.
+func geoTags() []testTag {
+	return []testTag{
+		{tagPixelScale, []float64{0.5, 0.5, 0}},
+		{tagTiepoint, []float64{0, 0, 0, 10.25, 47.75, 0}},
+		{tagGeoKeyDirectory, []uint16{1, 1, 0, 2, keyModelType, 0, 1, 2, keyRasterType, 0, 1, 1}},
+	}
+}
+
+// writeGeoTIFF writes a TIFF to a file in a new temporary directory.
+func writeGeoTIFF(t *testing.T, tiff []byte) (dir, name string) {
+	dir, err := ioutil.TempDir("", "geotiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, "dem.tif")
+	if err := ioutil.WriteFile(name, tiff, 0666); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, name
+}
+
+// readGeoTIFF writes a TIFF to a file, then reads it back as a GeoTIFF.
+func readGeoTIFF(t *testing.T, tiff []byte) (*GeoTIFF, map[Point]Height) {
+	dir, name := writeGeoTIFF(t, tiff)
+	defer os.RemoveAll(dir)
+	g := NewGeoTIFF(name)
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r, errc := g.Reader(nil)
+	got := map[Point]Height{}
+	for cslice := range r {
+		for _, c := range cslice {
+			got[c.P] = c.Z
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return g, got
+}
+
+func TestGeoTIFFStrips(t *testing.T) {
+	// 5x3 int16 samples in strips of 2 rows, with a nodata sample.
+	const w, h = 5, 3
+	var samples [w * h]int16
+	for i := range samples {
+		samples[i] = int16(i*100 - 300)
+	}
+	samples[7] = -9999
+	var blocks [][]byte
+	for y := 0; y < h; y += 2 {
+		var b bytes.Buffer
+		end := y + 2
+		if end > h {
+			end = h
+		}
+		binary.Write(&b, binary.LittleEndian, samples[y*w:end*w])
+		blocks = append(blocks, b.Bytes())
+	}
+	tags := append(geoTags(),
+		testTag{tagImageWidth, []uint16{w}},
+		testTag{tagImageLength, []uint16{h}},
+		testTag{tagBitsPerSample, []uint16{16}},
+		testTag{tagSampleFormat, []uint16{2}},
+		testTag{tagRowsPerStrip, []uint16{2}},
+		testTag{tagGDALNoData, "-9999"},
+	)
+	g, got := readGeoTIFF(t, buildTIFF(binary.LittleEndian, tags, blocks, false))
+
+	if len(got) != w*h-1 {
+		t.Errorf("want %d samples, got %d", w*h-1, len(got))
+	}
+	for i, z := range samples {
+		p := Point{Coord(i % w), Coord(i / w)}
+		if i == 7 {
+			if _, ok := got[p]; ok {
+				t.Errorf("nodata sample at %v reported", p)
+			}
+			continue
+		}
+		if got[p] != Height(z) {
+			t.Errorf("%v: want %d, got %d", p, z, got[p])
+		}
+	}
+	if long, lat, z := g.Pos(Cell{Point{2, 1}, 100}); long != 11.5 || lat != 47 || z != 100 {
+		t.Errorf("bad position %f %f %f", long, lat, z)
+	}
+	if minx, maxx, miny, maxy, _, _ := g.Bounds(); minx != 0 || maxx != w+1 || miny != 0 || maxy != h {
+		t.Errorf("bad bounds %d %d %d %d", minx, maxx, miny, maxy)
+	}
+}
+
+func TestGeoTIFFTiles(t *testing.T) {
+	// 20x18 float32 samples in 16x16 tiles, deflated with the
+	// floating point predictor.
+	const w, h, tw = 20, 18, 16
+	sample := func(x, y int) float32 {
+		return float32(x*37+y*101) / 4
+	}
+	var blocks [][]byte
+	for ty := 0; ty < h; ty += tw {
+		for tx := 0; tx < w; tx += tw {
+			var raw []byte
+			for y := ty; y < ty+tw; y++ {
+				// Byte planes of big-endian samples, differenced.
+				row := make([]byte, 4*tw)
+				for x := tx; x < tx+tw; x++ {
+					var v float32
+					if x < w && y < h {
+						v = sample(x, y)
+					}
+					bits := math.Float32bits(v)
+					for k := 0; k < 4; k++ {
+						row[k*tw+x-tx] = byte(bits >> uint(24-8*k))
+					}
+				}
+				for i := len(row) - 1; i > 0; i-- {
+					row[i] -= row[i-1]
+				}
+				raw = append(raw, row...)
+			}
+			var b bytes.Buffer
+			z := zlib.NewWriter(&b)
+			z.Write(raw)
+			z.Close()
+			blocks = append(blocks, b.Bytes())
+		}
+	}
+	tags := append(geoTags(),
+		testTag{tagImageWidth, []uint16{w}},
+		testTag{tagImageLength, []uint16{h}},
+		testTag{tagBitsPerSample, []uint16{32}},
+		testTag{tagSampleFormat, []uint16{3}},
+		testTag{tagCompression, []uint16{8}},
+		testTag{tagPredictor, []uint16{3}},
+		testTag{tagTileWidth, []uint16{tw}},
+		testTag{tagTileLength, []uint16{tw}},
+	)
+	g, got := readGeoTIFF(t, buildTIFF(binary.LittleEndian, tags, blocks, true))
+
+	if len(got) != w*h {
+		t.Errorf("want %d samples, got %d", w*h, len(got))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := Point{Coord(x), Coord(y)}
+			want := Height(math.Floor(float64(sample(x, y))*10 + 0.5))
+			if got[p] != want {
+				t.Errorf("%v: want %d, got %d", p, want, got[p])
+			}
+		}
+	}
+	if _, _, z := g.Pos(Cell{Point{}, 12345}); math.Abs(z-1234.5) > 1e-9 {
+		t.Errorf("want height 1234.5, got %f", z)
+	}
+}
+
+func TestGeoTIFFLZW(t *testing.T) {
+	// 64x40 big-endian int16 samples in one LZW strip,
+	// with horizontal differencing.
+	const w, h = 64, 40
+	rnd := rand.New(rand.NewSource(1))
+	samples := make([]int16, w*h)
+	for i := range samples {
+		samples[i] = int16(rnd.Intn(3000))
+	}
+	var raw bytes.Buffer
+	for y := 0; y < h; y++ {
+		prev := int16(0)
+		for x := 0; x < w; x++ {
+			v := samples[y*w+x]
+			binary.Write(&raw, binary.BigEndian, v-prev)
+			prev = v
+		}
+	}
+	tags := append(geoTags(),
+		testTag{tagImageWidth, []uint16{w}},
+		testTag{tagImageLength, []uint16{h}},
+		testTag{tagBitsPerSample, []uint16{16}},
+		testTag{tagSampleFormat, []uint16{2}},
+		testTag{tagCompression, []uint16{5}},
+		testTag{tagPredictor, []uint16{2}},
+	)
+	_, got := readGeoTIFF(t, buildTIFF(binary.BigEndian, tags, [][]byte{lzwEncode(raw.Bytes())}, false))
+
+	if len(got) != w*h {
+		t.Errorf("want %d samples, got %d", w*h, len(got))
+	}
+	for i, z := range samples {
+		p := Point{Coord(i % w), Coord(i / w)}
+		if got[p] != Height(z) {
+			t.Errorf("%v: want %d, got %d", p, z, got[p])
+		}
+	}
+}
+
+func TestGeoTIFFByteCounts(t *testing.T) {
+	// 4x2 int16 samples in one strip of 16 bytes, which can't be
+	// more than 16+8+1024 bytes even compressed.
+	tags := append(geoTags(),
+		testTag{tagImageWidth, []uint16{4}},
+		testTag{tagImageLength, []uint16{2}},
+		testTag{tagBitsPerSample, []uint16{16}},
+		testTag{tagSampleFormat, []uint16{2}},
+	)
+	for _, test := range []struct {
+		n   int // bytes in the strip
+		err string
+	}{
+		{16, ""},
+		{1048, ""},
+		{1049, "strip or tile 0 is 1049 bytes, want at most 1048"},
+	} {
+		dir, name := writeGeoTIFF(t, buildTIFF(binary.LittleEndian, tags, [][]byte{make([]byte, test.n)}, false))
+		err := NewGeoTIFF(name).Init()
+		os.RemoveAll(dir)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%d bytes: want error %q, got %v", test.n, test.err, err)
+		}
+	}
+}
@@ -1,13 +1,13 @@
-package main
+package prominence
 
 // A (hopefully) faster map than the generic maps.
 //
-// Implements map[point]islandBorder{}
+// Implements map[Point]islandBorder{}
 
 type bucket struct {
-	p   [8]point   // grid location
+	p   [8]Point   // grid location
 	i   [8]*island // island it is part of
-	c   [8]int8    // # of missing neighbors
+	c   [8]int8    // # of missing neighbors (up to 8, see neighborDirs)
 	ovf *bucket    // overflow
 }
 
@@ -22,15 +22,15 @@ func newmap() *hashmap {
 	return &hashmap{n: 0, b: make([]bucket, 1024)}
 }
 
-func hash(p point) int {
-	return int(p.x) + int(p.y)*37
+func hash(p Point) int {
+	return int(p.X) + int(p.Y)*37
 }
 
 func (m *hashmap) size() int {
 	return m.n
 }
 
-func (m *hashmap) find(p point) *island {
+func (m *hashmap) find(p Point) *island {
 	h := hash(p) & (len(m.b) - 1)
 	b := &m.b[h]
 	for {
@@ -113,7 +113,7 @@ func (m *hashmap) find(p point) *island {
 	}
 }
 
-func (m *hashmap) insert(p point, i *island, c int8) {
+func (m *hashmap) insert(p Point, i *island, c int8) {
 	if m.n >= 5*len(m.b) {
 		m.grow()
 	}
@@ -0,0 +1,386 @@
+package prominence
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Importer for SRTM .hgt tiles, like those from
+// http://dds.cr.usgs.gov/srtm/version2_1/SRTM3
+//
+// Each tile covers one degree square and is named by its lower left
+// corner, like N21W158.hgt.  The tile is a sequence of 16-bit
+// big-endian signed samples, in rows from north to south.
+// 3-arc-second tiles are 1201x1201 samples and 1-arc-second tiles
+// are 3601x3601 samples; we tell which from the file size.  Tiles
+// have one row and column of overlap with their neighbors, which we
+// skip.  Tiles may be bare or zipped (.hgt.zip), anywhere under the
+// directory.  All the tiles must have the same resolution.
+//
+// -32768 = sentinel for data voids, which are dropped unless
+//   FillVoids is set (see fillVoids)
+// 0 = sea level, which we treat as ocean unless Ocean is set
+// Heights are in meters.
+//
+// Grid coordinates are global, with (0, 0) at 180W 90N.
+
+// A Box is a range of longitudes and latitudes, in degrees.
+type Box struct {
+	MinLong, MinLat, MaxLong, MaxLat float64
+}
+
+// An HGT is a DataSet for the .hgt tiles under a directory.
+type HGT struct {
+	// FillVoids, if set before Init, fills in data voids by
+	// interpolation.  Filled reports which samples were filled.
+	FillVoids bool
+
+	// Ocean, if set before reading, decides which samples are ocean.
+	// Otherwise samples at 0 m are ocean.
+	Ocean OceanMask
+
+	dir string
+	box *Box
+
+	tiles []hgtTile // found by Init
+	n     int       // samples per degree
+
+	// Extent of the data set, in whole degrees.
+	minLong, minLat, maxLong, maxLat int
+
+	voids voidMap // filled samples, by tile
+}
+
+// An hgtTile is one .hgt tile file.
+type hgtTile struct {
+	name      string
+	long, lat int // lower left corner
+	zipped    bool
+}
+
+// NewHGT returns an HGT for the .hgt tiles under dir.
+// If box is not nil, only the tiles which overlap box are
+// used, and the data set covers box rounded out to whole degrees.
+// Otherwise the data set covers all the tiles found.
+func NewHGT(dir string, box *Box) *HGT {
+	return &HGT{dir: dir, box: box}
+}
+
+func (d *HGT) Init() error {
+	seen := map[[2]int]string{}
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(info.Name())
+		zipped := strings.HasSuffix(name, ".hgt.zip")
+		if info.IsDir() || !zipped && !strings.HasSuffix(name, ".hgt") {
+			return nil
+		}
+		t := hgtTile{name: path, zipped: zipped}
+		var ns, ew string
+		if _, err := fmt.Sscanf(strings.ToUpper(info.Name()), "%1s%d%1s%d", &ns, &t.lat, &ew, &t.long); err != nil ||
+			ns != "N" && ns != "S" || ew != "E" && ew != "W" {
+			log.Printf("skipping %s: not a tile name", path)
+			return nil
+		}
+		if ns == "S" {
+			t.lat = -t.lat
+		}
+		if ew == "W" {
+			t.long = -t.long
+		}
+		if b := d.box; b != nil {
+			if float64(t.long+1) <= b.MinLong || float64(t.long) >= b.MaxLong ||
+				float64(t.lat+1) <= b.MinLat || float64(t.lat) >= b.MaxLat {
+				return nil
+			}
+		}
+		if other, ok := seen[[2]int{t.long, t.lat}]; ok {
+			return fmt.Errorf("%s and %s are the same tile", other, path)
+		}
+		seen[[2]int{t.long, t.lat}] = path
+
+		// Find resolution from the size of the samples.
+		size := info.Size()
+		if zipped {
+			z, err := zip.OpenReader(path)
+			if err != nil {
+				return err
+			}
+			f := hgtFile(z)
+			if f == nil {
+				z.Close()
+				return fmt.Errorf("%s: no .hgt file", path)
+			}
+			size = int64(f.UncompressedSize64)
+			z.Close()
+		}
+		var n int
+		switch size {
+		case 2 * 1201 * 1201:
+			n = 1200
+		case 2 * 3601 * 3601:
+			n = 3600
+		default:
+			return fmt.Errorf("%s: bad # bytes %d, want %d or %d", path, size, 2*1201*1201, 2*3601*3601)
+		}
+		if d.n != 0 && d.n != n {
+			return fmt.Errorf("%s: tiles of different resolutions", path)
+		}
+		d.n = n
+		d.tiles = append(d.tiles, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(d.tiles) == 0 {
+		return fmt.Errorf("no .hgt tiles in %s", d.dir)
+	}
+
+	if b := d.box; b != nil {
+		d.minLong = int(math.Floor(b.MinLong))
+		d.minLat = int(math.Floor(b.MinLat))
+		d.maxLong = int(math.Ceil(b.MaxLong))
+		d.maxLat = int(math.Ceil(b.MaxLat))
+	} else {
+		d.minLong, d.minLat = 180, 90
+		d.maxLong, d.maxLat = -180, -90
+		for _, t := range d.tiles {
+			if t.long < d.minLong {
+				d.minLong = t.long
+			}
+			if t.lat < d.minLat {
+				d.minLat = t.lat
+			}
+			if t.long+1 > d.maxLong {
+				d.maxLong = t.long + 1
+			}
+			if t.lat+1 > d.maxLat {
+				d.maxLat = t.lat + 1
+			}
+		}
+	}
+	return nil
+}
+
+// hgtFile returns the .hgt file in z, or nil if there isn't one.
+func hgtFile(z *zip.ReadCloser) *zip.File {
+	for _, f := range z.File {
+		if strings.HasPrefix(filepath.Base(f.Name), ".") {
+			continue // Junk in N21E034.hgt.zip
+		}
+		if strings.HasSuffix(strings.ToLower(f.Name), ".hgt") {
+			return f
+		}
+	}
+	return nil
+}
+
+func (d *HGT) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	minx = Coord(d.n * (180 + d.minLong))
+	maxx = Coord(d.n * (180 + d.maxLong))
+	if d.maxLong-d.minLong < 360 {
+		maxx++ // empty column, so we don't wrap around
+	}
+	miny = Coord(d.n * (90 - d.maxLat))
+	maxy = Coord(d.n * (90 - d.minLat))
+	return minx, maxx, miny, maxy, -499, 8849
+}
+
+func (d *HGT) Pos(c Cell) (long, lat, height float64) {
+	n := float64(d.n)
+	return float64(c.P.X)/n - 180, 90 - float64(c.P.Y)/n, float64(c.Z)
+}
+
+// Filled reports whether the sample at p was in a data void,
+// filled in by interpolation.
+func (d *HGT) Filled(p Point) bool {
+	long := int(p.X)/d.n - 180
+	lat := 89 - int(p.Y)/d.n
+	i := int(p.Y) - d.n*(89-lat)
+	j := int(p.X) - d.n*(180+long)
+	return d.voids.get([2]int{long, lat}, i*(d.n+1)+j)
+}
+
+func (d *HGT) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	return d.readTiles(done, d.tiles)
+}
+
+// readRows reads the tiles which overlap rows [miny, maxy).
+func (d *HGT) readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	var tiles []hgtTile
+	for _, t := range d.tiles {
+		if Coord(d.n*(89-t.lat)) < maxy && Coord(d.n*(90-t.lat)) > miny {
+			tiles = append(tiles, t)
+		}
+	}
+	return d.readTiles(done, tiles)
+}
+
+// readTiles sends the samples in tiles.
+func (d *HGT) readTiles(done <-chan struct{}, tiles []hgtTile) (<-chan []Cell, <-chan error) {
+	// quit is closed to stop everything, when done is closed,
+	// on the first error, or when we finish.
+	quit := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	stop := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(quit)
+		})
+	}
+	go func() {
+		select {
+		case <-done:
+			stop(errCanceled)
+		case <-quit:
+		}
+	}()
+
+	// Put tiles to be loaded into a channel
+	work := make(chan hgtTile)
+	go func() {
+		defer close(work)
+		for _, t := range tiles {
+			select {
+			case work <- t:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	// Return channel
+	c := make(chan []Cell, workers)
+	errc := make(chan error, 1)
+
+	// Use several workers to do all the decompression.
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			chunker := cellChunker{c: c, done: quit}
+			for t := range work {
+				if err := d.readTile(t, &chunker); err != nil {
+					stop(err)
+					return
+				}
+			}
+			if !chunker.flush() {
+				stop(errCanceled)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		stop(nil)
+		errc <- firstErr
+		close(c)
+	}()
+	return c, errc
+}
+
+// readTile sends the samples in tile t to chunker.
+func (d *HGT) readTile(t hgtTile, chunker *cellChunker) error {
+	log.Print("reading " + t.name)
+
+	var b []byte
+	if t.zipped {
+		z, err := zip.OpenReader(t.name)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		zf := hgtFile(z)
+		if zf == nil {
+			return fmt.Errorf("%s: no .hgt file", t.name)
+		}
+		f, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.name, err)
+		}
+		b, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.name, err)
+		}
+	} else {
+		f, err := os.Open(t.name)
+		if err != nil {
+			return err
+		}
+		b, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	n := d.n
+	if len(b) != 2*(n+1)*(n+1) {
+		return fmt.Errorf("%s: bad # bytes, want %d got %d", t.name, 2*(n+1)*(n+1), len(b))
+	}
+
+	// Figure out where we start
+	x := n * (180 + t.long)
+	y := n * (90 - t.lat)
+
+	// Note: tiles are named by their lower left corner.  But the data starts in
+	// the upper left corner.  Plus tiles have one row overlap.
+	// Adjust for all of that.
+	y -= n
+
+	zs := make([]Height, (n+1)*(n+1))
+	void := make([]bool, len(zs))
+	for i := range zs {
+		zs[i] = Height(int16(int(b[2*i])<<8 + int(b[2*i+1])))
+		void[i] = zs[i] == -32768
+	}
+	var filled []bool
+	if d.FillVoids {
+		filled = fillVoids(zs, void, n+1, n+1)
+		d.voids.set([2]int{t.long, t.lat}, filled)
+	}
+
+	for i := 0; i < n; i++ {
+		// tiles have n+1 columns - the last column is equal to
+		// the first column of the next tile.
+		for j := 0; j < n; j++ {
+			k := i*(n+1) + j
+			z := zs[k]
+			c := Cell{Point{Coord(x + j), Coord(y + i)}, z}
+			if void[k] && (filled == nil || !filled[k]) {
+				continue // data void
+			}
+			switch {
+			case d.Ocean != nil:
+				// The mask decides for filled samples too.
+				if d.Ocean.Ocean(d.Pos(c)) {
+					continue
+				}
+			case void[k]:
+				// A filled void is land, even if filled at or
+				// below sea level.
+				if z <= 0 {
+					c.Z = 1
+				}
+			case z == 0:
+				continue // ocean
+			}
+			if !chunker.send(c) {
+				return errCanceled
+			}
+		}
+	}
+	return nil
+}
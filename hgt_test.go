@@ -0,0 +1,212 @@
+package prominence
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hgtSample is the height of sample (i, j) of the tile at long, lat.
+// It is never 0 or -32768, so every sample is reported.
+func hgtSample(long, lat, i, j int) int16 {
+	return int16(long*1000 + lat*100 + (i*7+j*3)%50 + 1)
+}
+
+// writeHGT writes a 3-arc-second tile to dir, zipped if asked.
+// sample(i, j) is the sample in row i, column j.
+func writeHGT(t *testing.T, dir, name string, zipped bool, sample func(i, j int) int16) {
+	b := make([]byte, 2*1201*1201)
+	for i := 0; i < 1201; i++ {
+		for j := 0; j < 1201; j++ {
+			z := sample(i, j)
+			b[2*(i*1201+j)] = byte(z >> 8)
+			b[2*(i*1201+j)+1] = byte(z)
+		}
+	}
+	if !zipped {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Create(filepath.Join(dir, name+".zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	w, err := z.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHGT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeHGT(t, dir, "N47E010.hgt", false, func(i, j int) int16 { return hgtSample(10, 47, i, j) })
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeHGT(t, filepath.Join(dir, "sub"), "N47E011.hgt", true, func(i, j int) int16 { return hgtSample(11, 47, i, j) })
+
+	for _, test := range []struct {
+		box   *Box
+		tiles int
+	}{
+		{nil, 2},
+		{&Box{10.2, 47.1, 10.8, 47.9}, 1},
+	} {
+		d := NewHGT(dir, test.box)
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.tiles) != test.tiles {
+			t.Errorf("box %v: want %d tiles, got %d", test.box, test.tiles, len(d.tiles))
+		}
+		minx, maxx, miny, maxy, _, _ := d.Bounds()
+		wantMaxx := Coord(1200*(180+10+test.tiles) + 1)
+		if minx != 1200*190 || maxx != wantMaxx || miny != 1200*42 || maxy != 1200*43 {
+			t.Errorf("box %v: bad bounds %d %d %d %d", test.box, minx, maxx, miny, maxy)
+		}
+
+		r, errc := d.Reader(nil)
+		n := 0
+		for cslice := range r {
+			for _, c := range cslice {
+				n++
+				tl := int(c.P.X)/1200 - 180
+				tlat := 89 - int(c.P.Y)/1200
+				i := int(c.P.Y) - 1200*(90-tlat-1)
+				j := int(c.P.X) - 1200*(180+tl)
+				if want := Height(hgtSample(tl, tlat, i, j)); c.Z != want {
+					t.Errorf("%v: want height %d, got %d", c.P, want, c.Z)
+				}
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if long, lat, _ := d.Pos(Cell{Point{1200*190 + 600, 1200*42 + 300}, 0}); long != 10.5 || lat != 47.75 {
+			t.Errorf("bad position %f %f", long, lat)
+		}
+		if want := test.tiles * 1200 * 1200; n != want {
+			t.Errorf("box %v: want %d samples, got %d", test.box, want, n)
+		}
+	}
+}
+
+func TestHGTVoids(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A ridge running east-west, with a void across it.
+	ridge := func(i, j int) int16 {
+		return int16(2000 - 3*abs(i-600))
+	}
+	writeHGT(t, dir, "S01W001.hgt", false, func(i, j int) int16 {
+		if i >= 550 && i < 650 && j >= 500 && j < 520 {
+			return -32768
+		}
+		return ridge(i, j)
+	})
+
+	for _, fill := range []bool{false, true} {
+		d := NewHGT(dir, nil)
+		d.FillVoids = fill
+		got := readDataSet(t, d)
+		n := 0
+		for i := 550; i < 650; i++ {
+			for j := 500; j < 520; j++ {
+				p := Point{Coord(1200*179 + j), Coord(1200*90 + i)}
+				z, ok := got[p]
+				if !ok {
+					continue
+				}
+				n++
+				if want := Height(ridge(i, j)); z < want-50 || z > want {
+					t.Errorf("%v: want about %d, got %d", p, want, z)
+				}
+				if !d.Filled(p) {
+					t.Errorf("%v: not reported filled", p)
+				}
+			}
+		}
+		if want := 100 * 20; fill && n != want || !fill && n != 0 {
+			t.Errorf("fill=%t: %d void samples reported", fill, n)
+		}
+		if p := (Point{1200*179 + 499, 1200*90 + 600}); d.Filled(p) {
+			t.Errorf("%v: real sample reported filled", p)
+		}
+	}
+}
+
+func TestHGTVoidsMasked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A slope from 100m down to -100m, with a void across it.
+	slope := func(i, j int) int16 {
+		return int16(100 - i/6)
+	}
+	writeHGT(t, dir, "S01W001.hgt", false, func(i, j int) int16 {
+		if j >= 500 && j < 520 {
+			return -32768
+		}
+		return slope(i, j)
+	})
+
+	for _, test := range []struct {
+		mask OceanMask
+		min  Height // least height of a reported filled sample
+		n    int    // filled samples reported
+	}{
+		{nil, 1, 1200 * 20},            // all land, raised to 1m
+		{NoOcean(), -99, 1200 * 20},    // all land, at their filled height
+		{OceanBelow(50), 50, 306 * 20}, // the mask drops filled ocean
+	} {
+		d := NewHGT(dir, nil)
+		d.FillVoids = true
+		d.Ocean = test.mask
+		got := readDataSet(t, d)
+		n := 0
+		min := Height(1 << 30)
+		for i := 0; i < 1200; i++ {
+			for j := 500; j < 520; j++ {
+				z, ok := got[Point{Coord(1200*179 + j), Coord(1200*90 + i)}]
+				if !ok {
+					continue
+				}
+				n++
+				if z < min {
+					min = z
+				}
+			}
+		}
+		if n != test.n || min != test.min {
+			t.Errorf("mask %v: want %d filled samples down to %d, got %d down to %d", test.mask, test.n, test.min, n, min)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,259 @@
+package prominence
+
+import (
+	"log"
+	"math"
+)
+
+// Isolation computation.
+//
+// The isolation of a peak is the great-circle distance to the
+// nearest point of strictly higher ground.
+//
+// We compute isolation in two passes over the data set.
+// The first pass records the maximum altitude in each
+// square block of the grid.  Using those maxima
+// we find, for each peak, the set of blocks which could possibly
+// contain the nearest higher cell.  The second pass then looks
+// at only the cells in those blocks to find the exact answer.
+//
+// Distances are computed on a spherical earth using the
+// coordinates returned by DataSet.Pos, so east-west wraparound
+// is handled naturally by the longitude arithmetic.
+
+// Mean radius of the earth, in km.
+const earthRadius = 6371.0
+
+// Target maximum number of blocks in the block-max index.
+const maxBlocks = 1 << 20
+
+// An Isolation describes the nearest strictly-higher cell to a peak.
+type Isolation struct {
+	// Higher is the nearest strictly-higher cell.
+	Higher Cell
+	// Dist is the great-circle distance from the peak to Higher, in km.
+	// It is +Inf if there is no higher cell in the data set.
+	Dist float64
+}
+
+// ComputeIsolation computes the isolation of each of the given peaks.
+// It reads data twice, so data.Reader must be callable more than once.
+func ComputeIsolation(data DataSet, peaks []Cell) ([]Isolation, error) {
+	res := make([]Isolation, len(peaks))
+	for i := range res {
+		res[i].Dist = math.Inf(1)
+	}
+	if len(peaks) == 0 {
+		return res, nil
+	}
+	minx, maxx, miny, maxy, minz, _ := data.Bounds()
+
+	// Pick a block size so that the block index isn't too big.
+	b := Coord(1)
+	for int64((maxx-minx+b-1)/b)*int64((maxy-miny+b-1)/b) > maxBlocks {
+		b *= 2
+	}
+	nbx := int((maxx - minx + b - 1) / b)
+	nby := int((maxy - miny + b - 1) / b)
+	blockIndex := func(p Point) int {
+		return int((p.Y-miny)/b)*nbx + int((p.X-minx)/b)
+	}
+
+	// Pass 1: find the maximum altitude in each block.
+	blockMax := make([]Height, nbx*nby)
+	for i := range blockMax {
+		blockMax[i] = minz - 1
+	}
+	r, errc := data.Reader(nil)
+	for cslice := range r {
+		for _, c := range cslice {
+			k := blockIndex(c.P)
+			if c.Z > blockMax[k] {
+				blockMax[k] = c.Z
+			}
+		}
+		chunkPool.Put(cslice)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	// Geographic extent of each block row and column.
+	rows := make([]interval, nby)
+	for by := range rows {
+		y0 := miny + Coord(by)*b
+		y1 := y0 + b - 1
+		if y1 >= maxy {
+			y1 = maxy - 1
+		}
+		_, lat0, _ := data.Pos(Cell{Point{minx, y0}, 0})
+		_, lat1, _ := data.Pos(Cell{Point{minx, y1}, 0})
+		rows[by] = interval{math.Min(lat0, lat1), math.Max(lat0, lat1)}
+	}
+	cols := make([]interval, nbx)
+	for bx := range cols {
+		x0 := minx + Coord(bx)*b
+		x1 := x0 + b - 1
+		if x1 >= maxx {
+			x1 = maxx - 1
+		}
+		long0, _, _ := data.Pos(Cell{Point{x0, miny}, 0})
+		long1, _, _ := data.Pos(Cell{Point{x1, miny}, 0})
+		cols[bx] = interval{math.Min(long0, long1), math.Max(long0, long1)}
+	}
+
+	// For each peak, find the blocks that might contain its
+	// nearest higher cell.  candidates maps block index to
+	// the peaks (indexes into peaks) interested in that block.
+	candidates := map[int][]int{}
+	type cand struct {
+		k  int
+		lo float64
+	}
+	var cs []cand
+	longs := make([]float64, len(peaks))
+	lats := make([]float64, len(peaks))
+	for i, p := range peaks {
+		longs[i], lats[i], _ = data.Pos(p)
+		pby := int((p.P.Y - miny) / b)
+
+		// Scan block rows outward from the peak's row.  The haversine
+		// of the latitude difference is a lower bound for every block
+		// in a row, and grows as we move away from the peak, so we can
+		// stop once it exceeds the best upper bound found so far.
+		cs = cs[:0]
+		hi := math.Inf(1) // upper bound on haversine of isolation
+		for d := 0; pby-d >= 0 || pby+d < nby; d++ {
+			for j, by := range [2]int{pby - d, pby + d} {
+				if by < 0 || by >= nby || j == 1 && d == 0 {
+					continue
+				}
+				if hav(rad(latDist(lats[i], rows[by]))) > hi {
+					continue
+				}
+				for bx := 0; bx < nbx; bx++ {
+					k := by*nbx + bx
+					if blockMax[k] <= p.Z {
+						continue
+					}
+					lo, up := havBounds(longs[i], lats[i], rows[by], cols[bx])
+					if lo > hi {
+						continue
+					}
+					if up < hi {
+						hi = up
+					}
+					cs = append(cs, cand{k, lo})
+				}
+			}
+		}
+		for _, c := range cs {
+			if c.lo <= hi {
+				candidates[c.k] = append(candidates[c.k], i)
+			}
+		}
+	}
+	log.Printf("isolation: %d candidate blocks of size %d", len(candidates), b)
+
+	// Pass 2: look at all the cells in candidate blocks.
+	r, errc = data.Reader(nil)
+	for cslice := range r {
+		for _, c := range cslice {
+			ps := candidates[blockIndex(c.P)]
+			if ps == nil {
+				continue
+			}
+			long, lat, _ := data.Pos(c)
+			for _, i := range ps {
+				if c.Z <= peaks[i].Z {
+					continue
+				}
+				d := greatCircle(longs[i], lats[i], long, lat)
+				if d < res[i].Dist {
+					res[i] = Isolation{c, d}
+				}
+			}
+		}
+		chunkPool.Put(cslice)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// An interval is a range of latitudes or longitudes, in degrees.
+type interval struct {
+	lo, hi float64
+}
+
+// greatCircle returns the distance in km between two points
+// given in degrees.
+func greatCircle(long1, lat1, long2, lat2 float64) float64 {
+	h := hav(rad(lat2-lat1)) + math.Cos(rad(lat1))*math.Cos(rad(lat2))*hav(rad(long2-long1))
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+// havBounds returns lower and upper bounds on the haversine of the
+// angular distance from (long, lat) to any point in the given block.
+// It uses the haversine formula, hav(d) = hav(Δlat) +
+// cos(lat1) cos(lat2) hav(Δlong), and bounds each term independently.
+func havBounds(long, lat float64, row, col interval) (lo, hi float64) {
+	c := math.Cos(rad(lat))
+
+	// Range of cos(lat2) over the block.
+	cmin := math.Min(math.Cos(rad(row.lo)), math.Cos(rad(row.hi)))
+	cmax := math.Max(math.Cos(rad(row.lo)), math.Cos(rad(row.hi)))
+	if row.lo <= 0 && row.hi >= 0 {
+		cmax = 1
+	}
+
+	// Range of the longitude difference, allowing for wraparound.
+	d0 := math.Abs(wrap(long - col.lo))
+	d1 := math.Abs(wrap(long - col.hi))
+	dlmin := math.Min(d0, d1)
+	if wrap(long-col.lo) >= 0 && wrap(col.hi-long) >= 0 {
+		dlmin = 0 // inside block's longitude range
+	}
+	dlmax := math.Max(d0, d1)
+	if wrap(long+180-col.lo) >= 0 && wrap(col.hi-long-180) >= 0 {
+		dlmax = 180 // block contains the antimeridian of long
+	}
+
+	dmin := latDist(lat, row)
+	dmax := math.Max(math.Abs(lat-row.lo), math.Abs(lat-row.hi))
+
+	lo = hav(rad(dmin)) + c*cmin*hav(rad(dlmin))
+	hi = hav(rad(dmax)) + c*cmax*hav(rad(dlmax))
+	return
+}
+
+// latDist returns the smallest latitude difference, in degrees,
+// between lat and the row.
+func latDist(lat float64, row interval) float64 {
+	if lat < row.lo {
+		return row.lo - lat
+	}
+	if lat > row.hi {
+		return lat - row.hi
+	}
+	return 0
+}
+
+// wrap maps a longitude difference into [-180, 180).
+func wrap(d float64) float64 {
+	d = math.Mod(d+180, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d - 180
+}
+
+func hav(x float64) float64 {
+	s := math.Sin(x / 2)
+	return s * s
+}
+
+func rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
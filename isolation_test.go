@@ -0,0 +1,81 @@
+package prominence
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A globeDataSet is a SimpleDataSet whose grid covers the whole
+// earth with 5 degree samples.
+type globeDataSet struct {
+	SimpleDataSet
+}
+
+func (data globeDataSet) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	_, _, _, _, minz, maxz = data.SimpleDataSet.Bounds()
+	return 0, 72, 0, 36, minz, maxz
+}
+
+func (data globeDataSet) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X)*5 - 180, 87.5 - float64(c.P.Y)*5, float64(c.Z)
+}
+
+func TestIsolationWraparound(t *testing.T) {
+	data := globeDataSet{SimpleDataSet{
+		{Point{0, 18}, 10},
+		{Point{1, 18}, 5},
+		{Point{30, 18}, 20},
+		{Point{71, 18}, 15},
+	}}
+	iso, err := ComputeIsolation(data, []Cell{data.SimpleDataSet[0], data.SimpleDataSet[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := data.SimpleDataSet[3]; iso[0].Higher != want {
+		t.Errorf("want %v, got %v", want, iso[0].Higher)
+	}
+	if want := greatCircle(-180, -2.5, 175, -2.5); math.Abs(iso[0].Dist-want) > 1e-9 {
+		t.Errorf("want %f km, got %f km", want, iso[0].Dist)
+	}
+	if !math.IsInf(iso[1].Dist, 1) {
+		t.Errorf("highest peak has isolation %f km to %v", iso[1].Dist, iso[1].Higher)
+	}
+}
+
+func TestIsolationRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(99))
+	var cells SimpleDataSet
+	for y := Coord(0); y < 36; y++ {
+		for x := Coord(0); x < 72; x++ {
+			if rnd.Intn(4) == 0 {
+				continue // ocean
+			}
+			cells = append(cells, Cell{Point{x, y}, Height(rnd.Intn(1000))})
+		}
+	}
+	data := globeDataSet{cells}
+	peaks := cells[:200]
+	iso, err := ComputeIsolation(data, peaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare to brute force.
+	for i, p := range peaks {
+		plong, plat, _ := data.Pos(p)
+		best := math.Inf(1)
+		for _, c := range cells {
+			if c.Z <= p.Z {
+				continue
+			}
+			long, lat, _ := data.Pos(c)
+			if d := greatCircle(plong, plat, long, lat); d < best {
+				best = d
+			}
+		}
+		if iso[i].Dist != best {
+			t.Errorf("isolation of %v: want %f km, got %f km", p, best, iso[i].Dist)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package prominence
+
+import (
+	"fmt"
+	"math"
+)
+
+// A mosaic of several data sets, resampled onto one grid.
+//
+// The target grid has n samples per degree, with global coordinates
+// like the .hgt importer's: sample (x, y) is at long x/n - 180,
+// lat 90 - y/n.  It covers a box of whole degrees.
+//
+// Each source sample covers the area halfway to its neighbors, and
+// a target sample takes its height from the source sample whose area
+// contains it.  That is nearest neighbor resampling, the only kind
+// there is: heights are never interpolated, so a source coarser than
+// the target grid comes out blocky.  A target sample missing
+// from a source (a void, or ocean) is filled from the next source in
+// priority order.  So each target sample gets its height from exactly
+// one source, and is read exactly once.
+//
+// The mosaic is built in bands of rows (see mosaicBand), each band
+// reading all the sources.  Sources which can read just some of their
+// rows (HGT, BIL, GeoTIFF, ASCII grids and masks of them) read only
+// the rows which cover the band, so each of their samples is read
+// about once.  The rest are read whole for each band: a mosaic of k
+// bands reads them k times, so they are best kept small, or
+// converted to one of the formats above first.  Those which can
+// only be read once (Stream) only work if the target grid fits in
+// one band.  Heights are in meters.
+
+// mosaicBand is the most samples we hold in memory at once, 64MB
+// of heights.  A 1-arc-second mosaic 10 degrees wide takes bands of
+// 466 rows, 78 bands for 10 degrees of latitude.  It is a variable
+// so tests can use several bands.
+var mosaicBand = 1 << 24
+
+// mosaicUnset marks target samples not yet filled from a source.
+const mosaicUnset = Height(math.MinInt32)
+
+// A rowReader is a DataSet which can read just some of its rows.
+type rowReader interface {
+	// readRows is like Reader, but it sends only the samples in
+	// rows [miny, maxy), and perhaps some near them.
+	readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error)
+}
+
+// readRows reads at least rows [miny, maxy) of d, and all of d
+// if it isn't a rowReader.
+func readRows(d DataSet, done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	if r, ok := d.(rowReader); ok {
+		return r.readRows(done, miny, maxy)
+	}
+	return d.Reader(done)
+}
+
+// A Mosaic is a DataSet made of other data sets.
+type Mosaic struct {
+	sources []DataSet
+	n       int
+
+	// Extent of the data set, in whole degrees.
+	minLong, minLat, maxLong, maxLat int
+}
+
+// NewMosaic returns a Mosaic with n samples per degree covering box
+// (rounded out to whole degrees), made from sources in priority order.
+func NewMosaic(box Box, n int, sources ...DataSet) *Mosaic {
+	return &Mosaic{
+		sources: sources,
+		n:       n,
+		minLong: int(math.Floor(box.MinLong)),
+		minLat:  int(math.Floor(box.MinLat)),
+		maxLong: int(math.Ceil(box.MaxLong)),
+		maxLat:  int(math.Ceil(box.MaxLat)),
+	}
+}
+
+func (m *Mosaic) Init() error {
+	if m.n <= 0 {
+		return fmt.Errorf("mosaic: bad resolution %d", m.n)
+	}
+	if m.minLong >= m.maxLong || m.minLat >= m.maxLat {
+		return fmt.Errorf("mosaic: empty box")
+	}
+	if len(m.sources) == 0 {
+		return fmt.Errorf("mosaic: no sources")
+	}
+	for _, s := range m.sources {
+		if err := s.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mosaic) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	minx = Coord(m.n * (180 + m.minLong))
+	maxx = Coord(m.n * (180 + m.maxLong))
+	if m.maxLong-m.minLong < 360 {
+		maxx++ // empty column, so we don't wrap around
+	}
+	miny = Coord(m.n * (90 - m.maxLat))
+	maxy = Coord(m.n * (90 - m.minLat))
+	return minx, maxx, miny, maxy, -11000, 9000
+}
+
+func (m *Mosaic) Pos(c Cell) (long, lat, height float64) {
+	n := float64(m.n)
+	return float64(c.P.X)/n - 180, 90 - float64(c.P.Y)/n, float64(c.Z)
+}
+
+func (m *Mosaic) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c)
+		errc <- m.read(c, done)
+	}()
+	return c, errc
+}
+
+// read sends the samples of m to c.
+func (m *Mosaic) read(c chan<- []Cell, done <-chan struct{}) error {
+	minx, maxx, miny, maxy, _, _ := m.Bounds()
+	if m.maxLong-m.minLong < 360 {
+		maxx-- // don't fill the empty column
+	}
+	w := int(maxx - minx)
+	rows := mosaicBand / w
+	if rows == 0 {
+		rows = 1
+	}
+	chunker := cellChunker{c: c, done: done}
+	for y0 := miny; y0 < maxy; y0 += Coord(rows) {
+		y1 := y0 + Coord(rows)
+		if y1 > maxy {
+			y1 = maxy
+		}
+		band := make([]Height, w*int(y1-y0))
+		for i := range band {
+			band[i] = mosaicUnset
+		}
+		for _, s := range m.sources {
+			if err := m.fill(band, s, minx, maxx, y0, y1, done); err != nil {
+				return err
+			}
+		}
+		for i, z := range band {
+			if z == mosaicUnset {
+				continue
+			}
+			p := Point{minx + Coord(i%w), y0 + Coord(i/w)}
+			if !chunker.send(Cell{p, z}) {
+				return errCanceled
+			}
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
+
+// fill fills the unset samples of band, which holds target rows
+// [y0,y1) and columns [minx,maxx), from source s.
+func (m *Mosaic) fill(band []Height, s DataSet, minx, maxx, y0, y1 Coord, done <-chan struct{}) error {
+	w := int(maxx - minx)
+	n := float64(m.n)
+
+	// The source coordinate mapping is affine.  Source sample k in
+	// x covers longitudes from edge(k) to edge(k+1), and likewise in y.
+	long0, lat0, z0 := s.Pos(Cell{})
+	long1, lat1, z1 := s.Pos(Cell{Point{1, 1}, 1})
+	dlong, dlat, dz := long1-long0, lat1-lat0, z1-z0
+	// tx returns the first target column at or east of long,
+	// and ty the first target row at or south of lat.
+	tx := func(long float64) Coord { return Coord(math.Ceil((long + 180) * n)) }
+	ty := func(lat float64) Coord { return Coord(math.Ceil((90 - lat) * n)) }
+
+	// Read only the source rows which cover target rows [y0,y1).
+	// Source row k covers latitudes lat0+(k±0.5)*dlat; allow a row
+	// either side for rounding.
+	smin, smax := Coord(math.MinInt32), Coord(math.MaxInt32)
+	if dlat != 0 {
+		ka := (90 - float64(y0)/n - lat0) / dlat
+		kb := (90 - float64(y1-1)/n - lat0) / dlat
+		if ka > kb {
+			ka, kb = kb, ka
+		}
+		smin = Coord(math.Floor(ka+0.5)) - 1
+		smax = Coord(math.Floor(kb+0.5)) + 2
+	}
+	r, rerr := readRows(s, done, smin, smax)
+	for cslice := range r {
+		for _, c := range cslice {
+			// Target columns and rows covered by source sample c.
+			ax := long0 + (float64(c.P.X)-0.5)*dlong
+			bx := long0 + (float64(c.P.X)+0.5)*dlong
+			ay := lat0 + (float64(c.P.Y)-0.5)*dlat
+			by := lat0 + (float64(c.P.Y)+0.5)*dlat
+			if ax > bx {
+				ax, bx = bx, ax
+			}
+			if ay < by {
+				ay, by = by, ay
+			}
+			xlo, xhi := tx(ax), tx(bx)
+			ylo, yhi := ty(ay), ty(by)
+			if xlo < minx {
+				xlo = minx
+			}
+			if xhi > maxx {
+				xhi = maxx
+			}
+			if ylo < y0 {
+				ylo = y0
+			}
+			if yhi > y1 {
+				yhi = y1
+			}
+			if xlo >= xhi || ylo >= yhi {
+				continue
+			}
+			z := Height(math.Floor(float64(c.Z)*dz + z0 + 0.5))
+			for y := ylo; y < yhi; y++ {
+				row := band[int(y-y0)*w:]
+				for x := xlo; x < xhi; x++ {
+					if row[x-minx] == mosaicUnset {
+						row[x-minx] = z
+					}
+				}
+			}
+		}
+		chunkPool.Put(cslice)
+	}
+	return <-rerr
+}
@@ -0,0 +1,123 @@
+package prominence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMosaic(t *testing.T) {
+	dir := tempFiles(t, map[string][]byte{
+		// Half degree samples, with a void.
+		"fine.asc": []byte("ncols 2\nnrows 2\nxllcenter 10\nyllcenter 47.5\ncellsize 0.5\nNODATA_value -1\n" +
+			"1 2\n" +
+			"-1 4\n"),
+		// One degree samples.
+		"coarse.asc": []byte("ncols 2\nnrows 1\nxllcenter 10.5\nyllcenter 47.5\ncellsize 1\n" +
+			"1000 2000\n"),
+		// Outside the mosaic.
+		"far.asc": []byte("ncols 1\nnrows 1\nxllcenter 50\nyllcenter 10\ncellsize 1\n" +
+			"7\n"),
+	})
+	defer os.RemoveAll(dir)
+	m := NewMosaic(Box{10, 47.2, 11.5, 48}, 2,
+		NewASCIIGrid(filepath.Join(dir, "fine.asc")),
+		NewASCIIGrid(filepath.Join(dir, "coarse.asc")),
+		NewASCIIGrid(filepath.Join(dir, "far.asc")))
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if minx, maxx, miny, maxy, _, _ := m.Bounds(); minx != 380 || maxx != 385 || miny != 84 || maxy != 86 {
+		t.Errorf("bad bounds %d %d %d %d", minx, maxx, miny, maxy)
+	}
+
+	want := map[Point]Height{
+		{380, 84}: 1, {381, 84}: 2, {382, 84}: 2000, {383, 84}: 2000,
+		{380, 85}: 1000, {381, 85}: 4, {382, 85}: 2000, {383, 85}: 2000,
+	}
+	// In one band, and in a band for each row, which reads
+	// just one row of fine.asc at a time.
+	defer func(b int) { mosaicBand = b }(mosaicBand)
+	for _, band := range []int{1 << 28, 4} {
+		mosaicBand = band
+		r, errc := m.Reader(nil)
+		got := map[Point]Height{}
+		n := 0
+		for cslice := range r {
+			for _, c := range cslice {
+				got[c.P] = c.Z
+				n++
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Errorf("band %d: want %d samples, got %d", band, len(want), n)
+		}
+		for p, z := range want {
+			if got[p] != z {
+				t.Errorf("band %d: %v: want %d, got %d", band, p, z, got[p])
+			}
+		}
+	}
+	if long, lat, z := m.Pos(Cell{Point{381, 85}, 4}); long != 10.5 || lat != 47.5 || z != 4 {
+		t.Errorf("bad position %f %f %f", long, lat, z)
+	}
+}
+
+func TestReadRows(t *testing.T) {
+	// 3 rows of 2 samples, the sample in row y being 10*y+x+1.
+	var bil bytes.Buffer
+	for i := 0; i < 6; i++ {
+		binary.Write(&bil, binary.BigEndian, int16(10*(i/2)+i%2+1))
+	}
+	dir := tempFiles(t, map[string][]byte{
+		"dem.asc": []byte("ncols 2\nnrows 3\nxllcorner 10\nyllcorner 47\ncellsize 1\n" +
+			"1 2\n11 12\n21 22\n"),
+		"dem.bil": bil.Bytes(),
+		"dem.hdr": []byte("BYTEORDER M\nNROWS 3\nNCOLS 2\nNBITS 16\nULXMAP 10\nULYMAP 49\nXDIM 1\nYDIM 1\n"),
+	})
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		d     DataSet
+		scale Height // internal units per meter
+	}{
+		{NewASCIIGrid(filepath.Join(dir, "dem.asc")), 10},
+		{NewBIL(filepath.Join(dir, "dem.bil")), 1},
+		{Masked(NewBIL(filepath.Join(dir, "dem.bil")), NoOcean()), 1},
+	} {
+		d := test.d
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		for _, rows := range [][2]Coord{{0, 3}, {1, 2}, {2, 5}, {-1, 1}} {
+			r, errc := readRows(d, nil, rows[0], rows[1])
+			var got []Height
+			for cslice := range r {
+				for _, c := range cslice {
+					if want := Height(10*c.P.Y+c.P.X+1) * test.scale; c.Z != want {
+						t.Errorf("%T %v: %v: want height %d", d, rows, c, want)
+					}
+					got = append(got, c.Z)
+				}
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			lo, hi := rows[0], rows[1]
+			if lo < 0 {
+				lo = 0
+			}
+			if hi > 3 {
+				hi = 3
+			}
+			if len(got) != 2*int(hi-lo) || len(got) > 0 && got[0] != Height(10*lo+1)*test.scale {
+				t.Errorf("%T: rows %v: got %v", d, rows, got)
+			}
+		}
+	}
+}
@@ -1,15 +1,18 @@
-package main
+package prominence
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // Importer for NOAA GLOBE Data
 // http://www.ngdc.noaa.gov/mgg/topo/gltiles.html
-// Imports one tile (for now).
+// Imports one tile.
 
 // The gzip-uncompressed file is just a sequence of
 // 16-bit little-endian signed data points.
@@ -19,54 +22,100 @@ import (
 // -500 = sentinel for ocean
 // Each sample is 30 arc seconds "square".  At the equator, that's about 1km square.
 // Heights are in meters.
+//
+// Grid coordinates are global, as for NOAA16, so we need to know
+// which tile (a through p, see offsets) the file is.
 
-type noaa1 string
+// NOAA1 is a DataSet for one gzipped NOAA GLOBE tile.
+type NOAA1 struct {
+	name string
+	tile byte
+}
+
+// NewNOAA1 returns a NOAA1 for the tile in the named file.
+// tile is the tile's letter, or 0 to get it from the file name
+// (like e10g.gz).
+func NewNOAA1(name string, tile byte) *NOAA1 {
+	return &NOAA1{name: name, tile: tile}
+}
 
-func (file noaa1) Init() {
+func (d *NOAA1) Init() error {
+	if d.tile == 0 {
+		base := strings.ToLower(filepath.Base(d.name))
+		if len(base) >= 4 && base[1:4] == "10g" {
+			d.tile = base[0]
+		}
+	}
+	if _, ok := offsets[d.tile]; !ok {
+		return fmt.Errorf("%s: can't tell which GLOBE tile it is", d.name)
+	}
+	return nil
 }
 
-func (file noaa1) Bounds() (minx, maxx coord, miny, maxy coord, minz, maxz height) {
-	// For the E tile (~western North America)
-	return 0, 10800, 0, 6000, -499, 8849
+func (d *NOAA1) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	off := offsets[d.tile]
+	// Plus an empty column, so we don't wrap around.
+	return Coord(off.x), Coord(off.x + 10800 + 1), Coord(off.y), Coord(off.y + off.size/10800), -499, 8849
 }
 
-func (file noaa1) Pos(c cell) (lat, long, height float64) {
-	// for the E tile
-	return float64(c.p.x)/120 - 180, 50 - float64(c.p.y)/120, float64(c.z)
+func (d *NOAA1) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X)/120 - 180, 90 - float64(c.P.Y)/120, float64(c.Z)
 }
 
-func (file noaa1) Reader() <-chan []cell {
-	c := make(chan []cell, 1)
+func (d *NOAA1) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
 	go func() {
-		f, err := os.Open(string(file))
-		if err != nil {
-			log.Fatal(err)
-		}
-		r, err := gzip.NewReader(f)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Print("reading " + file)
-		buf, err := ioutil.ReadAll(r)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(buf) != 2*10800*6000 && len(buf) != 2*10800*4800 {
-			log.Fatalf("bad # bytes, want %d or %d, got %d", 2*10800*6000, 2*10800*4800, len(buf))
-		}
-		var chunker cellChunker
-		chunker.c = c
-		cnt := 0
-		for len(buf) > 0 {
-			alt := height(int16(int(buf[0]) + int(buf[1])<<8))
-			buf = buf[2:]
-			if alt != -500 { // -500 is ocean
-				chunker.send(cell{point{coord(cnt % 10800), coord(cnt / 10800)}, alt})
+		defer close(c)
+		errc <- d.read(c, done)
+	}()
+	return c, errc
+}
+
+// read sends the samples in d to c.
+func (d *NOAA1) read(c chan<- []Cell, done <-chan struct{}) error {
+	f, err := os.Open(d.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.name, err)
+	}
+	log.Print("reading " + d.name)
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.name, err)
+	}
+	off := offsets[d.tile]
+	if len(buf) != 2*off.size {
+		return fmt.Errorf("%s: bad # bytes for tile %c, want %d, got %d", d.name, d.tile, 2*off.size, len(buf))
+	}
+	chunker := cellChunker{c: c, done: done}
+	if !sendGLOBE(&chunker, buf, off.x, off.y) {
+		return errCanceled
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
+
+// sendGLOBE sends the samples of the GLOBE tile in buf, whose
+// upper left sample is at x, y, to chunker.  It returns false
+// if chunker is done.
+func sendGLOBE(chunker *cellChunker, buf []byte, x, y int) bool {
+	cnt := 0
+	for len(buf) > 0 {
+		alt := Height(int16(int(buf[0]) + int(buf[1])<<8))
+		buf = buf[2:]
+		if alt != -500 { // -500 is ocean
+			if !chunker.send(Cell{Point{Coord(x + cnt%10800), Coord(y + cnt/10800)}, alt}) {
+				return false
 			}
-			cnt++
 		}
-		chunker.flush()
-		close(c)
-	}()
-	return c
+		cnt++
+	}
+	return true
 }
@@ -1,8 +1,9 @@
-package main
+package prominence
 
 import (
 	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -41,68 +42,118 @@ var offsets = map[byte]struct{ size, x, y int }{
 	'p': {10800 * 4800, 10800 * 3, 4800 + 6000*2},
 }
 
-type noaa16 string
+// NOAA16 is a DataSet for the NOAA GLOBE tiles in the named
+// gzipped tar file, which has all 16.
+type NOAA16 struct {
+	name  string
+	tiles string // letters of the tiles to read
 
-func (file noaa16) Init() {
+	// Bounds of the tiles, in grid coordinates.
+	minx, maxx, miny, maxy Coord
 }
 
-func (file noaa16) Bounds() (minx, maxx coord, miny, maxy coord, minz, maxz height) {
-	return 0, 10800 * 4, 0, 4800*2 + 6000*2, -499, 8849
+// NewNOAA16 returns a NOAA16 for the tiles in the named file.
+// tiles are the letters of the tiles to read (like "efij"), or ""
+// for all of them.
+func NewNOAA16(name, tiles string) *NOAA16 {
+	if tiles == "" {
+		tiles = "abcdefghijklmnop"
+	}
+	return &NOAA16{name: name, tiles: strings.ToLower(tiles)}
 }
 
-func (file noaa16) Pos(c cell) (lat, long, height float64) {
-	return float64(c.p.x)/120 - 180, 90 - float64(c.p.y)/120, float64(c.z)
+func (d *NOAA16) Init() error {
+	d.minx, d.miny = 10800*4, 4800*2+6000*2
+	d.maxx, d.maxy = 0, 0
+	for i := 0; i < len(d.tiles); i++ {
+		off, ok := offsets[d.tiles[i]]
+		if !ok {
+			return fmt.Errorf("%s: no GLOBE tile %c", d.name, d.tiles[i])
+		}
+		if Coord(off.x) < d.minx {
+			d.minx = Coord(off.x)
+		}
+		if Coord(off.x+10800) > d.maxx {
+			d.maxx = Coord(off.x + 10800)
+		}
+		if Coord(off.y) < d.miny {
+			d.miny = Coord(off.y)
+		}
+		if Coord(off.y+off.size/10800) > d.maxy {
+			d.maxy = Coord(off.y + off.size/10800)
+		}
+	}
+	return nil
+}
+
+func (d *NOAA16) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	maxx = d.maxx
+	if d.maxx-d.minx < 10800*4 {
+		maxx++ // empty column, so we don't wrap around
+	}
+	return d.minx, maxx, d.miny, d.maxy, -499, 8849
+}
+
+func (d *NOAA16) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X)/120 - 180, 90 - float64(c.P.Y)/120, float64(c.Z)
 }
 
-func (file noaa16) Reader() <-chan []cell {
-	c := make(chan []cell, 1)
+func (d *NOAA16) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
 	go func() {
-		f, err := os.Open(string(file))
+		defer close(c)
+		errc <- d.read(c, done)
+	}()
+	return c, errc
+}
+
+// read sends the samples in d to c.
+func (d *NOAA16) read(c chan<- []Cell, done <-chan struct{}) error {
+	f, err := os.Open(d.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.name, err)
+	}
+	t := tar.NewReader(r)
+	chunker := cellChunker{c: c, done: done}
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break // no more files
+		}
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("%s: %v", d.name, err)
 		}
-		r, err := gzip.NewReader(f)
+		name := hdr.Name
+		if !strings.HasSuffix(name, "10g") {
+			// Skip non-data files.
+			// Why both a10g and a11g?
+			continue
+		}
+		tile := name[len(name)-4]
+		if strings.IndexByte(d.tiles, tile) < 0 {
+			continue // not one we want
+		}
+		log.Print("reading " + name)
+		off := offsets[tile]
+		buf, err := ioutil.ReadAll(t)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("%s: %s: %v", d.name, name, err)
 		}
-		t := tar.NewReader(r)
-		var chunker cellChunker
-		chunker.c = c
-		for {
-			hdr, err := t.Next()
-			if err == io.EOF {
-				break // no more files
-			}
-			if err != nil {
-				log.Fatal(err)
-			}
-			name := hdr.Name
-			if !strings.HasSuffix(name, "10g") {
-				// Skip non-data files.
-				// Why both a10g and a11g?
-				continue
-			}
-			log.Print("reading " + name)
-			off := offsets[name[len(name)-4]]
-			buf, err := ioutil.ReadAll(t)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if len(buf) != 2*off.size {
-				log.Fatalf("bad # bytes, want %d got %d", 2*off.size, len(buf))
-			}
-			cnt := 0
-			for len(buf) > 0 {
-				alt := height(int16(int(buf[0]) + int(buf[1])<<8))
-				buf = buf[2:]
-				if alt != -500 { // -500 is ocean
-					chunker.send(cell{point{coord(off.x + cnt%10800), coord(off.y + cnt/10800)}, alt})
-				}
-				cnt++
-			}
+		if len(buf) != 2*off.size {
+			return fmt.Errorf("%s: %s: bad # bytes, want %d got %d", d.name, name, 2*off.size, len(buf))
 		}
-		chunker.flush()
-		close(c)
-	}()
-	return c
+		if !sendGLOBE(&chunker, buf, off.x, off.y) {
+			return errCanceled
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
 }
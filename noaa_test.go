@@ -0,0 +1,35 @@
+package prominence
+
+import "testing"
+
+func TestNOAABounds(t *testing.T) {
+	for _, test := range []struct {
+		name                   string
+		d                      DataSet
+		minx, maxx, miny, maxy Coord
+		long, lat              float64 // of the upper left sample
+	}{
+		{"e10g.gz", NewNOAA1("/data/e10g.gz", 0), 0, 10801, 4800, 10800, -180, 50},
+		{"tile p", NewNOAA1("globe.gz", 'p'), 32400, 43201, 16800, 21600, 90, -50},
+		{"all", NewNOAA16("all10g.tgz", ""), 0, 43200, 0, 21600, -180, 90},
+		{"fj", NewNOAA16("all10g.tgz", "FJ"), 10800, 21601, 4800, 16800, -90, 50},
+	} {
+		if err := test.d.Init(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		minx, maxx, miny, maxy, _, _ := test.d.Bounds()
+		if minx != test.minx || maxx != test.maxx || miny != test.miny || maxy != test.maxy {
+			t.Errorf("%s: bad bounds %d %d %d %d", test.name, minx, maxx, miny, maxy)
+		}
+		if long, lat, _ := test.d.Pos(Cell{Point{minx, miny}, 0}); long != test.long || lat != test.lat {
+			t.Errorf("%s: upper left at %f %f, want %f %f", test.name, long, lat, test.long, test.lat)
+		}
+	}
+	if err := NewNOAA1("dem.gz", 0).Init(); err == nil {
+		t.Errorf("no error for unknown tile")
+	}
+	if err := NewNOAA16("all10g.tgz", "ax").Init(); err == nil {
+		t.Errorf("no error for bad tile")
+	}
+}
@@ -0,0 +1,159 @@
+package prominence
+
+import (
+	"fmt"
+	"math"
+)
+
+// Ocean masks.
+//
+// Importers drop samples which are ocean, so that islands are
+// separated by the sea.  By default each importer uses the ocean
+// sentinel of its format (-500 in GLOBE, 0 in SRTM).  But 0 is also
+// a real height, and some land is below sea level.  An OceanMask
+// decides instead: from a sentinel height, a height threshold, or a
+// separate land/sea mask raster.  Land below 0 m which the mask
+// says is not ocean stays in the computation like any other land.
+
+// An OceanMask reports which samples are ocean.
+type OceanMask interface {
+	// Ocean reports whether the sample at long, lat (degrees)
+	// with the given height (meters) is ocean.
+	Ocean(long, lat, height float64) bool
+}
+
+// OceanAt returns a mask for which samples exactly at height h
+// (a sentinel) are ocean.
+func OceanAt(h float64) OceanMask {
+	return oceanAt(h)
+}
+
+type oceanAt float64
+
+func (h oceanAt) Ocean(long, lat, height float64) bool {
+	return height == float64(h)
+}
+
+// OceanBelow returns a mask for which samples below height h are ocean.
+func OceanBelow(h float64) OceanMask {
+	return oceanBelow(h)
+}
+
+type oceanBelow float64
+
+func (h oceanBelow) Ocean(long, lat, height float64) bool {
+	return height < float64(h)
+}
+
+// NoOcean returns a mask for which nothing is ocean.
+func NoOcean() OceanMask {
+	return oceanBelow(math.Inf(-1))
+}
+
+// A RasterMask is an OceanMask from a land/sea mask data set, in
+// which samples which are present and nonzero are land, and the
+// rest are ocean.  Each sample takes the value of the nearest mask
+// sample.  Samples outside the mask are never ocean.
+type RasterMask struct {
+	long0, lat0, dlong, dlat float64 // mask coordinate mapping
+	minx, miny               Coord
+	w, h                     int
+	land                     []uint64 // bitmap, in rows
+}
+
+// NewRasterMask reads the mask in d, which must not be initialized yet.
+func NewRasterMask(d DataSet) (*RasterMask, error) {
+	if err := d.Init(); err != nil {
+		return nil, err
+	}
+	minx, maxx, miny, maxy, _, _ := d.Bounds()
+	m := &RasterMask{minx: minx, miny: miny, w: int(maxx - minx), h: int(maxy - miny)}
+	if m.w <= 0 || m.h <= 0 {
+		return nil, fmt.Errorf("empty ocean mask")
+	}
+	var z0 float64
+	m.long0, m.lat0, z0 = d.Pos(Cell{})
+	long1, lat1, z1 := d.Pos(Cell{Point{1, 1}, 1})
+	m.dlong, m.dlat = long1-m.long0, lat1-m.lat0
+	m.land = make([]uint64, (m.w*m.h+63)/64)
+	r, rerr := d.Reader(nil)
+	for cslice := range r {
+		for _, c := range cslice {
+			if float64(c.Z)*(z1-z0)+z0 == 0 {
+				continue
+			}
+			i := int(c.P.Y-m.miny)*m.w + int(c.P.X-m.minx)
+			m.land[i/64] |= 1 << uint(i%64)
+		}
+		chunkPool.Put(cslice)
+	}
+	if err := <-rerr; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *RasterMask) Ocean(long, lat, height float64) bool {
+	x := int(math.Floor((long-m.long0)/m.dlong+0.5)) - int(m.minx)
+	y := int(math.Floor((lat-m.lat0)/m.dlat+0.5)) - int(m.miny)
+	if x < 0 || x >= m.w || y < 0 || y >= m.h {
+		return false
+	}
+	i := y*m.w + x
+	return m.land[i/64]&(1<<uint(i%64)) == 0
+}
+
+// Masked returns d without the samples which mask says are ocean.
+// Samples which d itself drops as ocean stay dropped; to keep those,
+// importers which use a sentinel height (like HGT) have an Ocean
+// field to set instead.
+func Masked(d DataSet, mask OceanMask) DataSet {
+	return &masked{d, mask}
+}
+
+type masked struct {
+	DataSet
+	mask OceanMask
+}
+
+// Filled reports whether the sample at p was filled in by d, if d is a Filler.
+func (m *masked) Filled(p Point) bool {
+	f, ok := m.DataSet.(Filler)
+	return ok && f.Filled(p)
+}
+
+func (m *masked) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	r, rerr := m.DataSet.Reader(done)
+	return m.filter(r, rerr, done)
+}
+
+func (m *masked) readRows(done <-chan struct{}, miny, maxy Coord) (<-chan []Cell, <-chan error) {
+	r, rerr := readRows(m.DataSet, done, miny, maxy)
+	return m.filter(r, rerr, done)
+}
+
+// filter sends the land samples from r.
+func (m *masked) filter(r <-chan []Cell, rerr <-chan error, done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c)
+		for cslice := range r {
+			// We own cslice, so filter it in place.
+			land := cslice[:0]
+			for _, s := range cslice {
+				if !m.mask.Ocean(m.Pos(s)) {
+					land = append(land, s)
+				}
+			}
+			select {
+			case c <- land:
+			case <-done:
+				chunkPool.Put(cslice)
+				drainCells(r)
+			}
+		}
+		errc <- <-rerr
+	}()
+	return c, errc
+}
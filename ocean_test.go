@@ -0,0 +1,68 @@
+package prominence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOceanMasks(t *testing.T) {
+	dir := tempFiles(t, map[string][]byte{
+		// Two hills joined by land below sea level, with the sea
+		// (also below sea level) to the east.
+		"dem.asc": []byte("ncols 5\nnrows 1\nxllcenter 10\nyllcenter 47\ncellsize 1\n" +
+			"30 -20 40 -2 -2\n"),
+		// The mask, at half the resolution: 1 is land, 0 is sea.
+		"mask.asc": []byte("ncols 3\nnrows 1\nxllcenter 10\nyllcenter 47\ncellsize 2\n" +
+			"1 1 0\n"),
+	})
+	defer os.RemoveAll(dir)
+	dem := filepath.Join(dir, "dem.asc")
+	mask, err := NewRasterMask(NewASCIIGrid(filepath.Join(dir, "mask.asc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		mask OceanMask
+		want []Coord // x of samples kept
+	}{
+		{"none", NoOcean(), []Coord{0, 1, 2, 3, 4}},
+		{"at", OceanAt(-2), []Coord{0, 1, 2}},
+		{"below", OceanBelow(0), []Coord{0, 2}},
+		{"raster", mask, []Coord{0, 1, 2}},
+	} {
+		got := readDataSet(t, Masked(NewASCIIGrid(dem), test.mask))
+		if len(got) != len(test.want) {
+			t.Errorf("%s: want %d samples, got %v", test.name, len(test.want), got)
+		}
+		for _, x := range test.want {
+			if _, ok := got[Point{x, 0}]; !ok {
+				t.Errorf("%s: sample %d missing", test.name, x)
+			}
+		}
+	}
+
+	// With the raster mask, the two hills are one island.
+	d := Masked(NewASCIIGrid(dem), mask)
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	minx, maxx, _, _, _, _ := d.Bounds()
+	r, rerr := d.Reader(nil)
+	islands := 0
+	err = ComputeProminence(r, rerr, minx, maxx, 0, 0, nil, func(res Result) {
+		if res.Island {
+			islands++
+		} else if res.Col.Z != -200 {
+			t.Errorf("want key col at -20m, got %v", res.Col)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if islands != 1 {
+		t.Errorf("want 1 island, got %d", islands)
+	}
+}
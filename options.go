@@ -0,0 +1,52 @@
+package prominence
+
+import "runtime"
+
+// Options are the settings of CellSort, ComputeProminence and
+// ComputeBasins.  A nil *Options, like the zero Options, selects
+// the defaults.  Options are only read, so several computations
+// can share them.
+type Options struct {
+	// Connectivity is the number of neighbors of each sample,
+	// 4 or 8.  0 means 4.
+	Connectivity int
+
+	// Plateaus selects whether connected samples of equal
+	// altitude are merged into plateaus (see patch).
+	Plateaus bool
+
+	// P is the width of parallel processing of the external sort.
+	// 0 means runtime.NumCPU().
+	P int
+
+	// TmpDir is the directory for the external sort's temporary
+	// file.  If empty, the system default is used.
+	TmpDir string
+}
+
+// neighborDirs returns the offsets to the neighbors of a sample,
+// as selected by o.Connectivity.
+func (o *Options) neighborDirs() [][2]Coord {
+	if o != nil && o.Connectivity == 8 {
+		return dirs8[:]
+	}
+	return dirs8[:4]
+}
+
+func (o *Options) plateaus() bool {
+	return o != nil && o.Plateaus
+}
+
+func (o *Options) p() int {
+	if o == nil || o.P <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.P
+}
+
+func (o *Options) tmpDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.TmpDir
+}
@@ -1,128 +1,199 @@
-package main
+package prominence
 
-import (
-	"fmt"
-	"log"
-)
+import "sync"
 
 // A patch is a contiguous chunk of points with the same altitude.
-// The first step of our algorithm is to divide the
-// world up into patches.  We do this because the world
-// has lots of flat areas, and those are easier to process
-// in bulk instead of point-by-point.
+// With Options.Plateaus set, the first step of our algorithm is to divide the
+// world up into patches.  We do this because the world has lots of
+// flat areas (particularly in 1-arc-second and lidar data), and
+// those are easier to process in bulk instead of point-by-point.
 // In particular it prevents creating islands that have
-// prominence zero.
-
-// TODO: not used.  Delete?  Make work?
+// prominence zero, and lets us report peaks and cols which
+// lie on plateaus as regions instead of arbitrary single points.
 
 type patch struct {
-	alt    height
-	border []point
+	alt    Height
+	points []Point
+	one    [1]Point // backing store for a single-point patch
 }
 
-// makePatches makes patches from input cells.
-// The returned slice of patches is sorted from highest
-// to lowest altitude.
-func makePatches(cells []cell) []patch {
-	// TODO: this code is in-memory.  For a real
-	// whole-earth dataset, we probably need to
-	// use disk.
-	// (1 arc-sec -> 840 billion points -> 9.4TB, and we can get 1/3 arc-sec data or better?)
-	// (NOTE: reduce that estimate by 2/3 because ocean doesn't count.)
-	var patches []patch
-
-	// Step 1: find min/max altitude
-	min := cells[0].z
-	max := min
-	for _, c := range cells[1:] {
-		if c.z < min {
-			min = c.z
+// A pool of unused patch slices.  flood recycles the slices it
+// receives, and singlePatches reuses them.
+var patchPool sync.Pool
+
+// A Region summarizes the extent of a patch.
+type Region struct {
+	Size     int64 // # of samples
+	Min, Max Point // bounding box, inclusive
+}
+
+// region returns the extent of p.
+// The bounding box does not account for east-west wraparound.
+func (p patch) region() Region {
+	r := Region{Size: int64(len(p.points)), Min: p.points[0], Max: p.points[0]}
+	for _, q := range p.points[1:] {
+		if q.X < r.Min.X {
+			r.Min.X = q.X
+		}
+		if q.X > r.Max.X {
+			r.Max.X = q.X
 		}
-		if c.z > max {
-			max = c.z
+		if q.Y < r.Min.Y {
+			r.Min.Y = q.Y
+		}
+		if q.Y > r.Max.Y {
+			r.Max.Y = q.Y
 		}
 	}
-	fmt.Printf("min:%d max:%d\n", min, max)
+	return r
+}
 
-	// Step 2: count altitudes
-	cnt := make([]int64, max-min+1)
-	for _, c := range cells {
-		cnt[c.z-min]++
-	}
+// makePatches makes patches from input cells, which must be
+// sorted from highest to lowest altitude.  The returned patches
+// are sorted the same way.
+// Most of the data stays on disk, in CellSort's temporary file, but
+// all the cells of one altitude are held in memory at once: in level,
+// in the map m, and in the patches made from them.  That is up to
+// about 80 bytes a cell, so memory is bound by the largest level, not
+// by the data set.  The worst case is a large flat surface at one
+// altitude, like a lake in lidar data: a billion samples of lake take
+// about 80GB.  Sea is dropped before sorting (see OceanMask), so for
+// such data mask large water bodies too, or leave Options.Plateaus off.
+// Patches wrap around left-right, like the islands in ComputeProminence.
+// If done is closed, makePatches stops sending and drains r.
+// dirs are the offsets to the neighbors of a point.
+func makePatches(r <-chan []Cell, done <-chan struct{}, minx, maxx Coord, dirs [][2]Coord) <-chan []patch {
+	c := make(chan []patch, 1)
+	go func() {
+		defer close(c)
+		defer drainCells(r)
 
-	// Step 3: find cumulative count of all points above each altitude
-	above := make([]int64, max-min+1)
-	var sum int64
-	for i := max; i >= min; i-- {
-		above[i-min] = sum
-		sum += cnt[i-min]
-	}
-	if sum != int64(len(cells)) {
-		log.Fatalf("bad sum %d %d", sum, len(cells))
-	}
+		var level []Point // all points at the current altitude
+		alt := Height(0)
 
-	// Step 2: shard by altitude
-	alt := make([][]point, max-min+1)
-	backing := make([]point, len(cells))
-	for i := max; i >= min; i-- {
-		alt[i-min] = backing[above[i-min]:][:0]
-	}
-	for _, c := range cells {
-		alt[c.z-min] = append(alt[c.z-min], c.p)
-	}
+		// Points at alt that haven't been put in a patch yet.
+		m := map[Point]struct{}{}
 
-	// Step 3: find patches at each altitude
-	backing2 := make([]point, len(cells))
-	m := map[point]struct{}{}
-	for a := max; a >= min; a-- {
-		// Add all points at this altitude to a map.
-		for _, p := range alt[a-min] {
-			m[p] = struct{}{}
-		}
-		// Find connected components at altitude a.
-		startq := alt[a-min]
-		for len(m) > 0 {
-			// Find a point we haven't used yet to start.
-			var start point
-			for {
-				p := startq[0]
-				if _, ok := m[p]; ok {
-					start = p
-					break
-				}
-				startq = startq[1:]
+		// emit finds the patches at the current altitude and sends them.
+		// It reports whether they were all sent.
+		emit := func() bool {
+			for _, p := range level {
+				m[p] = struct{}{}
 			}
+			var ps []patch
+			for _, start := range level {
+				if _, ok := m[start]; !ok {
+					continue // already in a patch
+				}
 
-			// Flood fill from starting point.
-			q := backing2[:0]
-			delete(m, start)
-			q = append(q, start)
-			i := 0
-			for i < len(q) {
-				p := q[i]
-				i++
-				for _, d := range [4][2]coord{{0, 1}, {0, -1}, {1, 0}, {-1, 0}} {
-					x := point{p.x + d[0], p.y + d[1]}
-					if _, ok := m[x]; !ok {
-						continue
+				// Flood fill from starting point.
+				delete(m, start)
+				q := []Point{start}
+				for i := 0; i < len(q); i++ {
+					p := q[i]
+					for _, d := range dirs {
+						x := Point{p.X + d[0], p.Y + d[1]}
+						if x.X == maxx {
+							x.X = minx
+						}
+						if x.X == minx-1 {
+							x.X = maxx - 1
+						}
+						if _, ok := m[x]; !ok {
+							continue
+						}
+						delete(m, x)
+						q = append(q, x)
+					}
+				}
+				// q is now a patch
+				ps = append(ps, patch{alt: alt, points: q})
+				if len(ps) == 1024 {
+					if !sendPatches(c, done, ps) {
+						return false
 					}
-					delete(m, x)
-					q = append(q, x)
+					ps = nil
+				}
+			}
+			level = level[:0]
+			return len(ps) == 0 || sendPatches(c, done, ps)
+		}
+
+		for cslice := range r {
+			for _, x := range cslice {
+				if x.Z != alt && len(level) > 0 && !emit() {
+					chunkPool.Put(cslice)
+					return
 				}
+				alt = x.Z
+				level = append(level, x.P)
+			}
+			chunkPool.Put(cslice)
+		}
+		if len(level) > 0 {
+			emit()
+		}
+	}()
+	return c
+}
+
+// patches divides sorted cells into patches, as selected by
+// opts.Plateaus.  Closing done stops it early.
+func patches(r <-chan []Cell, done <-chan struct{}, minx, maxx Coord, opts *Options) <-chan []patch {
+	// Patches don't help much for the NOAA data (the average
+	// patch size is 1.15), so we only use them when asked.
+	// For finer grids, like lidar data, they help more.
+	if opts.plateaus() {
+		return makePatches(r, done, minx, maxx, opts.neighborDirs())
+	}
+	return singlePatches(r, done)
+}
+
+// singlePatches makes a single-point patch from each input cell.
+// If done is closed, singlePatches stops sending and drains r.
+// The patches' points are stored in the patches themselves, so
+// once flood recycles a slice of them it can be reused whole.
+func singlePatches(r <-chan []Cell, done <-chan struct{}) <-chan []patch {
+	c := make(chan []patch, 1)
+	go func() {
+		defer close(c)
+		defer drainCells(r)
+		for cslice := range r {
+			var ps []patch
+			if i := patchPool.Get(); i != nil && cap(i.([]patch)) >= len(cslice) {
+				ps = i.([]patch)[:len(cslice)]
+			} else {
+				ps = make([]patch, len(cslice))
+			}
+			for i, x := range cslice {
+				pa := &ps[i]
+				pa.alt = x.Z
+				pa.one[0] = x.P
+				pa.points = pa.one[:]
+			}
+			chunkPool.Put(cslice)
+			if !sendPatches(c, done, ps) {
+				return
 			}
-			// q is now a patch
-			// TODO: border, not whole
-			//fmt.Printf("patch @%d:", a)
-			//for _, p := range q {
-			//	fmt.Printf(" %s", p)
-			//}
-			//fmt.Println()
-			patches = append(patches, patch{alt: a, border: q})
-			backing2 = backing2[len(q):]
 		}
+	}()
+	return c
+}
+
+// sendPatches sends ps on c.  It reports false, without sending,
+// if done is closed first.
+func sendPatches(c chan<- []patch, done <-chan struct{}, ps []patch) bool {
+	select {
+	case c <- ps:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// drainCells reads the rest of r, so its sender doesn't block.
+func drainCells(r <-chan []Cell) {
+	for cslice := range r {
+		chunkPool.Put(cslice)
 	}
-	fmt.Printf("  cells: %d\n", len(cells))
-	fmt.Printf("patches: %d\n", len(patches))
-	panic("stop")
-	return patches
 }
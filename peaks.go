@@ -0,0 +1,93 @@
+package prominence
+
+// Reporting peaks.
+//
+// ComputeProminence works in the internal altitude units of a data
+// set.  A PeakFilter picks out the results worth reporting, and
+// converts their prominences to meters.
+
+// A Positioner converts from internal coordinates to standard ones,
+// as DataSet.Pos does.  DataSets and DivideTrees are Positioners.
+type Positioner interface {
+	Pos(c Cell) (long, lat, height float64)
+}
+
+// Meters converts the altitude difference h, in the internal units
+// of pos, to meters.  base is any point in the data set.
+func Meters(pos Positioner, base Point, h Height) float64 {
+	_, _, z0 := pos.Pos(Cell{P: base})
+	_, _, z1 := pos.Pos(Cell{P: base, Z: h})
+	return z1 - z0
+}
+
+// ToHeight returns the smallest altitude difference, in the internal
+// units of pos, which is at least meters.  base is as for Meters.
+// It assumes heights increase with altitude units.
+func ToHeight(pos Positioner, base Point, meters float64) Height {
+	if meters <= 0 {
+		return 0
+	}
+	// Binary search for the smallest h with Meters(h) >= meters.
+	lo, hi := Height(0), Height(1)
+	for Meters(pos, base, hi) < meters && hi < 1<<30 {
+		lo, hi = hi, hi*2
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if Meters(pos, base, mid) >= meters {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// A Peak is a Result with its prominences in meters.
+type Peak struct {
+	Result
+	// Prom is the prominence of the peak.
+	Prom float64
+	// Clean and Optimistic are Result.Clean and Result.Optimistic.
+	// Without a vertical error, they are both Prom.
+	Clean, Optimistic float64
+}
+
+// A PeakFilter selects the peaks to report from the results of
+// ComputeProminence (or the nodes of a DivideTree), and converts
+// them to Peaks.
+type PeakFilter struct {
+	Pos  Positioner // the data set
+	Base Point      // any point in the data set
+
+	MinProm float64 // least optimistic prominence to report, in meters
+	MinSize int64   // least dominating island to report, in samples
+	VErr    float64 // vertical error of the data, in meters
+}
+
+// Heights returns the minProm and verr arguments of ComputeProminence,
+// in internal altitude units.  minProm is MinProm less twice VErr,
+// so that every peak whose optimistic prominence is MinProm is found.
+func (f *PeakFilter) Heights() (minProm, verr Height) {
+	return ToHeight(f.Pos, f.Base, f.MinProm-2*f.VErr), ToHeight(f.Pos, f.Base, f.VErr)
+}
+
+// Peak converts res to a Peak.
+func (f *PeakFilter) Peak(res Result) Peak {
+	return Peak{
+		Result:     res,
+		Prom:       Meters(f.Pos, f.Base, res.Peak.Z-res.Col.Z),
+		Clean:      Meters(f.Pos, f.Base, res.Clean),
+		Optimistic: Meters(f.Pos, f.Base, res.Optimistic),
+	}
+}
+
+// Add appends res to peaks, as a Peak, if it has at least MinProm
+// optimistic prominence and MinSize size.
+func (f *PeakFilter) Add(peaks []Peak, res Result) []Peak {
+	p := f.Peak(res)
+	if p.Optimistic < f.MinProm || p.Size < f.MinSize {
+		return peaks
+	}
+	return append(peaks, p)
+}
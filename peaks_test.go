@@ -0,0 +1,60 @@
+package prominence
+
+import "testing"
+
+// eighths has heights in eighths of a meter above a base of 100m.
+type eighths struct{}
+
+func (eighths) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X), float64(c.P.Y), 100 + float64(c.Z)/8
+}
+
+func TestToHeight(t *testing.T) {
+	for _, test := range []struct {
+		meters float64
+		want   Height
+	}{
+		{0, 0},
+		{-5, 0},
+		{0.125, 1},
+		{0.2, 2},
+		{100, 800},
+		{1e9, 1 << 30},
+	} {
+		if got := ToHeight(eighths{}, Point{}, test.meters); got != test.want {
+			t.Errorf("%gm: want %d, got %d", test.meters, test.want, got)
+		}
+	}
+	if m := Meters(eighths{}, Point{}, 20); m != 2.5 {
+		t.Errorf("20/8m is %gm, want 2.5m", m)
+	}
+}
+
+func TestPeakFilter(t *testing.T) {
+	f := &PeakFilter{Pos: eighths{}, MinProm: 10, MinSize: 5, VErr: 2}
+	minProm, verr := f.Heights()
+	if minProm != 48 || verr != 16 {
+		t.Errorf("want heights 48 and 16, got %d and %d", minProm, verr)
+	}
+	for _, test := range []struct {
+		res                     Result
+		ok                      bool
+		prom, clean, optimistic float64
+	}{
+		{Result{Peak: Cell{Z: 240}, Col: Cell{Z: 80}, Size: 5}, true, 20, 16, 24},
+		{Result{Peak: Cell{Z: 240}, Island: true, Size: 5}, true, 30, 28, 32},
+		// Only the optimistic prominence reaches MinProm.
+		{Result{Peak: Cell{Z: 136}, Col: Cell{Z: 80}, Size: 5}, true, 7, 3, 11},
+		{Result{Peak: Cell{Z: 104}, Col: Cell{Z: 80}, Size: 5}, false, 3, 0, 7},
+		{Result{Peak: Cell{Z: 240}, Col: Cell{Z: 80}, Size: 4}, false, 20, 16, 24},
+	} {
+		test.res.setBounds(verr)
+		p := f.Peak(test.res)
+		if p.Prom != test.prom || p.Clean != test.clean || p.Optimistic != test.optimistic {
+			t.Errorf("%v: want %g (%g-%g), got %g (%g-%g)", test.res.Peak, test.prom, test.clean, test.optimistic, p.Prom, p.Clean, p.Optimistic)
+		}
+		if got := f.Add(nil, test.res); (len(got) == 1) != test.ok {
+			t.Errorf("%v size %d: selected %t, want %t", test.res.Peak, test.res.Size, len(got) == 1, test.ok)
+		}
+	}
+}
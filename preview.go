@@ -0,0 +1,128 @@
+package prominence
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+// Previews.
+//
+// A Preview draws a whole data set as one image, in the
+// equirectangular projection (long and lat scaled linearly), with
+// its width and height in proportion to the ground it covers.  Like
+// a TileRenderer it can watch the samples go by on their way to the
+// computation, or it can read the data set itself.
+
+// A ColorMap returns the color of a pixel with height z, in meters.
+// lo and hi are the lowest and highest pixels in the image.
+type ColorMap func(z, lo, hi float64) color.NRGBA
+
+// GrayColors shades from dark gray at the lowest pixel to white at
+// the highest.
+func GrayColors(z, lo, hi float64) color.NRGBA {
+	v := uint8(255)
+	if hi > lo {
+		v = uint8(64 + (z-lo)*(255-64)/(hi-lo) + 0.5)
+	}
+	return color.NRGBA{v, v, v, 255}
+}
+
+// HypsometricColors colors by height, from green lowlands to white
+// peaks, the same at every scale.
+func HypsometricColors(z, lo, hi float64) color.NRGBA {
+	return hypsometric(z)
+}
+
+// A Preview draws a data set as a single image.
+type Preview struct {
+	// Colors maps heights to colors.  The default is GrayColors.
+	Colors ColorMap
+
+	d DataSet
+	c *canvas
+}
+
+// NewPreview returns a preview of d, which must be initialized.
+// The image fits in w by h pixels, with its other dimension set by
+// the shape of d; if w or h is 0, it is set by the other.  agg says
+// how the heights of the samples in each pixel are combined.
+func NewPreview(d DataSet, w, h int, agg Aggregation) (*Preview, error) {
+	box, _, err := dataBox(d)
+	if err != nil {
+		return nil, fmt.Errorf("preview: %v", err)
+	}
+	if w < 0 || h < 0 || w == 0 && h == 0 {
+		return nil, fmt.Errorf("preview: bad size %dx%d", w, h)
+	}
+	// Ground width per ground height.  A degree of longitude
+	// shrinks away from the equator.
+	mid := (box[1] + box[3]) / 2 * math.Pi / 180
+	aspect := (box[2] - box[0]) * math.Max(math.Cos(mid), 0.01) / (box[3] - box[1])
+	switch {
+	case h == 0 || w > 0 && float64(w) < float64(h)*aspect:
+		h = int(float64(w)/aspect + 0.5)
+	default:
+		w = int(float64(h)*aspect + 0.5)
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	sx := float64(w) / (box[2] - box[0])
+	sy := float64(h) / (box[3] - box[1])
+	c := newCanvas(d, w, h,
+		func(long float64) float64 { return (long - box[0]) * sx },
+		func(lat float64) float64 { return (box[3] - lat) * sy },
+		agg)
+	return &Preview{d: d, c: c}, nil
+}
+
+// Sniff returns a channel which passes along the samples of r,
+// recording them for drawing.  Closing done stops it.
+func (p *Preview) Sniff(r <-chan []Cell, done <-chan struct{}) <-chan []Cell {
+	return p.c.sniff(r, done)
+}
+
+// ReadAll reads the samples of the data set, instead of Sniff.
+func (p *Preview) ReadAll() error {
+	r, rerr := p.d.Reader(nil)
+	for cslice := range p.Sniff(r, nil) {
+		chunkPool.Put(cslice)
+	}
+	return <-rerr
+}
+
+// Image returns the preview.  Pixels with no samples are
+// transparent.  It waits for Sniff to see all the samples.
+func (p *Preview) Image() *image.NRGBA {
+	<-p.c.finished
+	colors := p.Colors
+	if colors == nil {
+		colors = GrayColors
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, z := range p.c.pix {
+		if z := float64(z); !math.IsNaN(z) {
+			lo = math.Min(lo, z)
+			hi = math.Max(hi, z)
+		}
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, p.c.w, p.c.h))
+	for i, z := range p.c.pix {
+		if z := float64(z); !math.IsNaN(z) {
+			img.SetNRGBA(i%p.c.w, i/p.c.w, colors(z, lo, hi))
+		}
+	}
+	return img
+}
+
+// WritePNG writes the preview to w as a PNG.
+func (p *Preview) WritePNG(w io.Writer) error {
+	return png.Encode(w, p.Image())
+}
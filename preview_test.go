@@ -0,0 +1,61 @@
+package prominence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	// One row, with a void.  The data set adds another, empty,
+	// column on the east.
+	dir := tempFiles(t, map[string][]byte{
+		"row.asc": []byte("ncols 5\nnrows 1\nxllcenter 10\nyllcenter 0\ncellsize 0.5\nnodata_value -9999\n" +
+			"10 20 30 40 -9999\n"),
+	})
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		w, h int
+		agg  Aggregation
+		want []float32 // heights of the pixels, in rows; 0 for none
+		ww   int       // width of the image
+	}{
+		// The row is six times as wide as it is high.
+		{6, 0, AggregateMax, []float32{10, 20, 30, 40, 0, 0}, 6},
+		{3, 0, AggregateMax, []float32{20, 40, 0}, 3},
+		{3, 100, AggregateMean, []float32{15, 35, 0}, 3},
+		{0, 2, AggregateMax, []float32{10, 10, 20, 20, 30, 30, 40, 40, 0, 0, 0, 0, 10, 10, 20, 20, 30, 30, 40, 40, 0, 0, 0, 0}, 12},
+	} {
+		d := NewASCIIGrid(filepath.Join(dir, "row.asc"))
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewPreview(d, test.w, test.h, test.agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+		img := p.Image()
+		if img.Rect.Dx() != test.ww || img.Rect.Dx()*img.Rect.Dy() != len(test.want) {
+			t.Errorf("%dx%d: image is %v, want %d wide with %d pixels", test.w, test.h, img.Rect, test.ww, len(test.want))
+			continue
+		}
+		for i, z := range test.want {
+			got := p.c.pix[i]
+			c := img.NRGBAAt(i%test.ww, i/test.ww)
+			switch {
+			case z == 0 && c.A != 0:
+				t.Errorf("%dx%d: pixel %d is %v, want transparent", test.w, test.h, i, c)
+			case z != 0 && got != z:
+				t.Errorf("%dx%d: pixel %d is %gm, want %gm", test.w, test.h, i, got, z)
+			}
+		}
+		// Gray from 64 at the lowest pixel to 255 at the highest.
+		if c := img.NRGBAAt(0, 0); c.R != 64 || c.A != 255 {
+			t.Errorf("%dx%d: lowest pixel is %v", test.w, test.h, c)
+		}
+	}
+}
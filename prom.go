@@ -1,8 +1,12 @@
-package main
+// Package prominence computes the prominence of mountains, and
+// related measures, from a grid of altitude samples (a DataSet).
+// The prominence of every peak is found by ComputeProminence.
+package prominence
 
 import (
 	"fmt"
 	"log"
+	"math"
 	"unsafe"
 )
 
@@ -24,32 +28,45 @@ import (
 // Our world is a 2d grid of altitude samples.  When we
 // say "walk" above, we mean travel from a sample to an
 // adjacent sample in one of the 4 cardinal directions.
-// (Allowing 8 directions will cost more and doesn't seem
-// like it would change anything materially.)
+// With Options.Connectivity = 8 we also allow the 4 diagonal directions.
+// That costs more, but finds cols on ridges which run diagonally
+// to the grid.  (With only 4 directions such a ridge looks like
+// a chain of separate peaks, and its cols are found much lower.)
 //
-// We break altitude ties arbitrarily.  Internally, between
+// We break altitude ties by position.  Internally, between
 // two equal-altitude samples the first one processed is
-// considered higher.
+// considered higher, and CellSort orders equal-altitude samples
+// by y, then x.  So of two equal-altitude samples, the one in the
+// earlier row (or in the same row, the earlier column) is higher.
+// Results are the same from run to run and for any Options.P.
 
 const debug = false
 
-type coord int32
-type height int32
+// Offsets to the neighbors of a sample.  The 4 cardinal directions
+// come first, so dirs8[:4] is the 4-connected neighborhood.
+var dirs8 = [8][2]Coord{{0, 1}, {0, -1}, {1, 0}, {-1, 0}, {1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
 
-// A point is a location in a 2d grid.
-type point struct {
-	x, y coord
+// A Coord is a grid coordinate of a sample.
+type Coord int32
+
+// A Height is the altitude of a sample, in the internal units
+// of its DataSet (see DataSet.Pos).
+type Height int32
+
+// A Point is a location in a 2d grid.
+type Point struct {
+	X, Y Coord
 }
 
-func (p point) String() string {
-	return fmt.Sprintf("{%d,%d}", p.x, p.y)
+func (p Point) String() string {
+	return fmt.Sprintf("{%d,%d}", p.X, p.Y)
 }
 
-// A cell is a location in a 2d grid together with its
+// A Cell is a location in a 2d grid together with its
 // altitude in the 3rd dimension.
-type cell struct {
-	p point
-	z height
+type Cell struct {
+	P Point
+	Z Height
 }
 
 // TODO: pack cells into a 64-bit number?
@@ -58,19 +75,56 @@ type cell struct {
 // 21+21+14 = 56.  That would use 8 instead of 12 bytes
 // per cell.
 
-func (c cell) String() string {
-	return fmt.Sprintf("%s:%d", c.p, c.z)
+func (c Cell) String() string {
+	return fmt.Sprintf("%s:%d", c.P, c.Z)
 }
 
 // An island is a contiguous group of points which have an altitude
 // greater than or equal to the altitude currently being processed.
 type island struct {
 	// peak is the highest point in the island
-	peak cell
+	peak Cell
 	// # of cells comprising this island
 	size int64
 	// when this island is joined to another, parent points to the containing island.
 	parent *island
+	// joined is the island this island was joined into.  Following
+	// joined links (see next) walks the merge history of the island.
+	// Unlike parent it is only compressed past islands with zero
+	// prominence, which are never a parent or a result.
+	joined *island
+	// col is the altitude of the key col at which this island was joined.
+	col Height
+	// plateau is the plateau containing peak, or nil if peak
+	// is a single sample.
+	plateau *Region
+	// uncertain is set when the key col of peak could change
+	// within the vertical error (see Result.Uncertain).
+	uncertain bool
+}
+
+// region returns the plateau containing i's peak.
+func (i *island) region() Region {
+	if i.plateau != nil {
+		return *i.plateau
+	}
+	return Region{1, i.peak.P, i.peak.P}
+}
+
+// prom returns the prominence of i's peak.  i must have been joined.
+func (i *island) prom() Height {
+	return i.peak.Z - i.col
+}
+
+// next returns the island after i in i's merge history, or nil if
+// i has not been joined.  Islands of zero prominence (like the
+// first 3 of 334, without Options.Plateaus) are dropped from the
+// history, so they can be collected once no border point uses them.
+func (i *island) next() *island {
+	for j := i.joined; j != nil && j.joined != nil && j.prom() == 0; j = i.joined {
+		i.joined = j.joined
+	}
+	return i.joined
 }
 
 // root returns the top island to which i has been joined.
@@ -106,31 +160,133 @@ type islandBorder struct {
 type islandCount struct {
 	i *island
 	n int
+	// raw is the island recorded for the first neighboring
+	// point in i, before following parent links.  It is the
+	// smallest island in i's merge history which touches the cell.
+	raw *island
 }
 
-// computeProminence computes the prominence of all the peaks returned by r.
-// computeProminence will call f with info about each peak:
-//   peak = local maximum
-//   col = key col for that peak
-//   dom = dominating peak
-//   island = is top of an island (or continent).
-func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom cell, size int64, island bool)) {
-	// Turns out patches don't really help much.
-	// At least for NOAA-OCEAN, the average patch
-	// size is 1.15.  For finer grids it may help more and
-	// for finer altitude distinctions it may help less.
-	/*
-		for _, patch := range makePatches(cells) {
-			fmt.Printf("%d:", patch.z)
-			for _, p := range patch.border {
-				fmt.Printf(" %s", p)
-			}
-			fmt.Println()
-		}
-	*/
+// A Result describes a peak found by ComputeProminence.
+type Result struct {
+	Peak Cell // local maximum
+	Col  Cell // key col for that peak
+	Dom  Cell // dominating peak
+
+	// LineParent is the nearest higher peak with at least minProm prominence.
+	LineParent Cell
+	// PromParent is the nearest peak with more prominence.
+	PromParent Cell
+
+	// PeakRegion and ColRegion are the plateaus containing
+	// the peak and the col.  Without Options.Plateaus, they are
+	// always single samples.
+	PeakRegion, ColRegion Region
 
+	// Size is the # of samples in the dominating island.
+	Size int64
+	// Island reports whether Peak is the top of an island (or continent).
+	// If so, Col, Dom, LineParent and PromParent are undefined.
+	Island bool
+	// Uncertain reports whether the key col could change if
+	// altitudes were off by up to the vertical error.  That happens
+	// when another col is within twice the error below the key col,
+	// or when a peak on either side of the key col is within twice
+	// the error of Peak.  It errs on the side of being set.
+	Uncertain bool
+	// Clean and Optimistic are the least and greatest prominence
+	// (Peak.Z-Col.Z) which are plausible given the vertical error:
+	// what peak baggers call the clean and optimistic prominence.
+	// Both the peak and the key col may be off by the error, except
+	// for island tops, whose key col is the sea.
+	Clean, Optimistic Height
+	// PeakFilled and ColFilled report whether the peak or key col
+	// is in a void filled in by interpolation.  ComputeProminence
+	// doesn't know; see MarkFilled.
+	PeakFilled, ColFilled bool
+}
+
+// ComputeProminence computes the prominence of all the peaks returned by r.
+// ComputeProminence will call f with info about each peak.
+// "Nearest" in the description of parents is measured from the key col,
+// over the islands which were joined together to form the dominating island.
+// verr is the vertical error of the data, used to set Result.Uncertain,
+// Result.Clean and Result.Optimistic.  To find all the peaks whose
+// optimistic prominence is at least some minimum, and their line
+// parents, pass minProm as that minimum less twice verr.
+// rerr reports errors reading r, as for CellSort.  If ComputeProminence
+// returns an error, the results passed to f are incomplete.
+// opts may be nil, for the default Options.
+func ComputeProminence(r <-chan []Cell, rerr <-chan error, minx, maxx Coord, minProm, verr Height, opts *Options, f func(r Result)) error {
 	// Sort data in descending altitude.
-	r = cellSort(r)
+	sorted, errc := CellSort(r, rerr, opts)
+	done := make(chan struct{})
+	defer close(done)
+	flood(patches(sorted, done, minx, maxx, opts), minx, maxx, minProm, verr, nil, opts, f)
+	return <-errc
+}
+
+// setBounds sets res.Clean and res.Optimistic for the vertical error verr.
+func (res *Result) setBounds(verr Height) {
+	e := 2 * verr
+	if res.Island {
+		e = verr
+	}
+	prom := res.Peak.Z - res.Col.Z
+	res.Clean, res.Optimistic = prom-e, prom+e
+	if res.Clean < 0 {
+		res.Clean = 0
+	}
+}
+
+// higher reports whether a is higher than b, breaking ties
+// the same way as CellSort orders the cells (see above).
+func higher(a, b Cell) bool {
+	if a.Z != b.Z {
+		return a.Z > b.Z
+	}
+	return a.P.Y < b.P.Y || a.P.Y == b.P.Y && a.P.X < b.P.X
+}
+
+// seaPeak is the altitude of the peak of the pseudo-island
+// representing the sea.  It dominates all real islands.
+const seaPeak = Height(math.MaxInt32)
+
+// flood runs the After Noah's Flood algorithm on r, which must be
+// sorted in descending altitude.  Its arguments are as for ComputeProminence.
+// If sea is not nil, it reports points which are not part of the
+// data set but are instead part of a single pseudo-island, the sea,
+// which is present before any cell is processed.  Islands which join
+// the sea report a dom with altitude seaPeak.
+func flood(r <-chan []patch, minx, maxx Coord, minProm, verr Height, sea func(p Point) bool, opts *Options, f func(r Result)) {
+	var seaIsland *island
+	if sea != nil {
+		seaIsland = &island{peak: Cell{Z: seaPeak}}
+	}
+
+	// Altitudes within slop of each other could be in either
+	// order, given the vertical error.
+	slop := 2 * verr
+
+	// With a vertical error, a result isn't final until we have
+	// processed every altitude within slop of its key col, as we
+	// might find another col for it there.  Until then we keep
+	// it in pending, which is in order of descending key col.
+	type pendingResult struct {
+		res Result
+		j   *island
+	}
+	var pending []pendingResult
+	flush := func(alt Height) {
+		k := 0
+		for ; k < len(pending) && pending[k].res.Col.Z-slop > alt; k++ {
+			res := pending[k].res
+			res.Uncertain = pending[k].j.uncertain
+			f(res)
+			pending[k] = pendingResult{}
+		}
+		pending = pending[k:]
+	}
+	seen := map[*island]struct{}{}
 
 	// Keep track of the border of all the current islands.
 	// This is the major data structure that needs to be kept
@@ -140,70 +296,113 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 	m := newmap()
 	maxm := 0
 
-	var neighborStore [4]islandCount
+	var neighbors []islandCount
+	var adjs []int8
+	inPatch := map[Point]struct{}{}
+	dirs := opts.neighborDirs()
+	n := int8(len(dirs)) // # of neighbors of each cell
 
-	// Process all of the cells in sorted order.
-	for cslice := range r {
-		for _, c := range cslice {
+	// Process all of the patches in sorted order.
+	// All the samples in a patch are processed together.
+	for pslice := range r {
+		for _, pa := range pslice {
+			pts := pa.points
+			c := Cell{pts[0], pa.alt} // representative cell for the patch
 			if debug {
-				fmt.Printf("@%v\n", c)
+				fmt.Printf("@%v (%d samples)\n", c, len(pts))
+			}
+			if len(pending) > 0 {
+				flush(pa.alt)
 			}
 			if m.size() > maxm {
 				maxm = m.size()
 			}
-			// Find unique neighboring islands of c plus their frequency.
-			neighbors := neighborStore[:0]
-			var adj int8
-		outer:
-			for _, d := range [4][2]coord{{0, 1}, {0, -1}, {1, 0}, {-1, 0}} {
-				// Find out which island is in this direction.
-				p := point{c.p.x + d[0], c.p.y + d[1]}
-
-				// Earth wraps around left-right
-				if p.x == maxx {
-					p.x = minx
+			if len(pts) > 1 {
+				for k := range inPatch {
+					delete(inPatch, k)
 				}
-				if p.x == minx-1 {
-					p.x = maxx - 1
+				for _, q := range pts {
+					inPatch[q] = struct{}{}
 				}
+			}
 
-				i := m.find(p)
-				if i == nil {
-					// No island is in this direction.
-					continue
-				}
-				i = i.root()
-
-				// Add i to list of neighbors of the current cell c.
-				adj++
-				for a := range neighbors {
-					if i == neighbors[a].i {
-						neighbors[a].n++
-						continue outer
+			// Find unique neighboring islands of the patch plus their frequency.
+			// adjs[k] is the # of processed neighbors of pts[k].
+			neighbors = neighbors[:0]
+			adjs = adjs[:0]
+			for _, q := range pts {
+				var adj int8
+			outer:
+				for _, d := range dirs {
+					// Find out which island is in this direction.
+					p := Point{q.X + d[0], q.Y + d[1]}
+
+					// Earth wraps around left-right
+					if p.X == maxx {
+						p.X = minx
+					}
+					if p.X == minx-1 {
+						p.X = maxx - 1
 					}
+
+					if len(pts) > 1 {
+						if _, ok := inPatch[p]; ok {
+							// Part of this patch, processed along with q.
+							adj++
+							continue
+						}
+					}
+
+					var raw *island
+					if sea != nil && sea(p) {
+						raw = seaIsland
+					} else {
+						raw = m.find(p)
+						if raw == nil {
+							// No island is in this direction.
+							continue
+						}
+					}
+					i := raw.root()
+
+					// Add i to list of neighbors of the patch.
+					adj++
+					for a := range neighbors {
+						if i == neighbors[a].i {
+							neighbors[a].n++
+							if slop > 0 && raw != neighbors[a].raw {
+								// Another way into i.  This patch
+								// may be a col for the islands that
+								// were joined to form i.
+								markCols(raw, neighbors[a].raw, pa.alt, slop, seen)
+							}
+							continue outer
+						}
+					}
+					neighbors = append(neighbors, islandCount{i, 1, raw})
 				}
-				neighbors = append(neighbors, islandCount{i, 1})
+				adjs = append(adjs, adj)
 			}
 
+			var i *island
 			switch len(neighbors) {
 			case 0:
-				// Cell makes a new island.
-				i := &island{peak: c, size: 1, parent: nil}
+				// Patch makes a new island.
+				i = &island{peak: c, size: 0, parent: nil}
+				if len(pts) > 1 {
+					reg := pa.region()
+					i.plateau = &reg
+				}
 				if debug {
 					fmt.Printf("  new island %p\n", i)
 				}
-				m.insert(c.p, i, 4)
 
 			case 1:
-				// Cell attaches to a single island.
-				i := neighbors[0].i
+				// Patch attaches to a single island.
+				i = neighbors[0].i
 				if debug {
 					fmt.Printf("  enlarge island %p\n", i)
 				}
-				i.size++
-				if adj != 4 {
-					m.insert(c.p, i, 4-adj)
-				}
 
 			default:
 				// Connecting 2 or more islands.  This case identifies
@@ -211,10 +410,12 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 				// islands that are being joined.
 
 				// Find the dominant island.
-				i := neighbors[0].i
+				i = neighbors[0].i
+				raw := neighbors[0].raw
 				for _, q := range neighbors[1:] {
-					if q.i.peak.z > i.peak.z {
+					if higher(q.i.peak, i.peak) {
 						i = q.i
+						raw = q.raw
 					}
 				}
 
@@ -227,10 +428,31 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 					}
 					if debug {
 						fmt.Printf("  col (joining %p into %p)\n", j, i)
-						fmt.Printf("  prominence of %v is %d (key col %v to %v)\n", j.peak, j.peak.z-c.z, c, i.peak)
+						fmt.Printf("  prominence of %v is %d (key col %v to %v)\n", j.peak, j.peak.Z-c.Z, c, i.peak)
+					}
+					if slop > 0 && i.peak.Z-j.peak.Z <= slop {
+						// Either peak might be the higher one.
+						i.uncertain = true
+						j.uncertain = true
 					}
-					if j.peak.z-c.z > 0 {
-						f(j.peak, c, i.peak, i.size, false)
+					if j.peak.Z-c.Z > 0 {
+						lineParent, promParent := parents(raw, j.peak, j.peak.Z-c.Z, minProm)
+						res := Result{
+							Peak:       j.peak,
+							Col:        c,
+							Dom:        i.peak,
+							LineParent: lineParent,
+							PromParent: promParent,
+							PeakRegion: j.region(),
+							ColRegion:  pa.region(),
+							Size:       i.size,
+						}
+						res.setBounds(verr)
+						if slop > 0 {
+							pending = append(pending, pendingResult{res, j})
+						} else {
+							f(res)
+						}
 					}
 					// Note: the j.peak.z-c.z == 0 case is unfortunate.
 					// If we have a situation like 334 we generate an island
@@ -239,23 +461,29 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 					// that order).  If we had processed the 3s in the opposite
 					// order, we would have never generated that temporary
 					// island and incurred that additional overhead.
-					// I tried joining patches of connected uniform height areas
-					// (see patch.go) but the case when we allocate 0-prominence
-					// islands just doesn't happen that often.
+					// With Options.Plateaus, both 3s are processed together as
+					// a single patch and we never generate that island.
 
 					// Join islands.  We do joining lazily (see island.root()).
 					j.parent = i
+					j.joined = i
+					j.col = c.Z
 					i.size += j.size
 				}
+			}
 
-				// Add col point itself to the dominant island.
-				i.size++
-				if adj != 4 {
-					m.insert(c.p, i, 4-adj)
+			// Add the patch itself to the island.
+			i.size += int64(len(pts))
+			for k, q := range pts {
+				if adjs[k] != n {
+					m.insert(q, i, n-adjs[k])
 				}
 			}
 		}
-		chunkPool.Put(cslice)
+		for k := range pslice {
+			pslice[k] = patch{} // don't keep plateaus alive in the pool
+		}
+		patchPool.Put(pslice[:0])
 	}
 
 	//fmt.Println("remaining border")
@@ -263,11 +491,16 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 	//	fmt.Printf("  %v %d %p\n", p, b.n, b.i)
 	//}
 
+	flush(math.MinInt32)
+
 	// Report remaining islands, which are now islands in the
 	// real sense.  Their prominence is equal to their altitude.
 	islands := map[*island]struct{}{}
 	for _, i := range m.contents() {
 		i = i.root()
+		if i == seaIsland {
+			continue
+		}
 		if _, ok := islands[i]; ok {
 			// already know about this island
 			continue
@@ -276,11 +509,80 @@ func computeProminence(r <-chan []cell, minx, maxx coord, f func(peak, col, dom
 		if debug {
 			fmt.Printf("island %p: @%v\n", i, i.peak)
 		}
-		f(i.peak, cell{}, cell{}, i.size, true)
+		res := Result{Peak: i.peak, PeakRegion: i.region(), Size: i.size, Island: true}
+		res.setBounds(verr)
+		f(res)
 	}
 
-	size := int(unsafe.Sizeof(point{}) + unsafe.Sizeof(islandBorder{})) // one entry
+	size := int(unsafe.Sizeof(Point{}) + unsafe.Sizeof(islandBorder{})) // one entry
 	size *= maxm                                                        // all entries
 	size *= 2                                                           // approx. map overhead
 	log.Printf("approx mem used: %d MB\n", size/(1<<20))
 }
+
+// markCols handles a patch at altitude alt which touches islands a
+// and b, both of which are now part of the same island.  The patch
+// is another col between the islands in a's merge history and the
+// ones in b's, up to the island where the two histories meet.
+// Those islands whose key col is within slop of alt are marked
+// uncertain.  seen is scratch space.
+func markCols(a, b *island, alt, slop Height, seen map[*island]struct{}) {
+	for k := range seen {
+		delete(seen, k)
+	}
+	for i := a; i != nil; i = i.next() {
+		seen[i] = struct{}{}
+	}
+	var top *island
+	for i := b; i != nil; i = i.next() {
+		if _, ok := seen[i]; ok {
+			top = i
+			break
+		}
+		if i.col-alt <= slop {
+			i.uncertain = true
+		}
+	}
+	for i := a; i != top; i = i.next() {
+		if i.col-alt <= slop {
+			i.uncertain = true
+		}
+	}
+}
+
+// parents finds the line parent and prominence parent of peak,
+// which has prominence prom.  raw is the smallest island on the
+// dominant side of peak's key col that touches the col.
+// We walk up raw's merge history, which visits islands containing
+// the col in order of increasing size (and increasing peak altitude),
+// until we find suitable peaks.  The dominating island's peak is
+// always suitable.
+func parents(raw *island, peak Cell, prom, minProm Height) (lineParent, promParent Cell) {
+	var haveLine, haveProm bool
+	for i := raw; !haveLine || !haveProm; i = i.next() {
+		if i.next() == nil {
+			// The dominating island.
+			if !haveLine {
+				lineParent = i.peak
+			}
+			if !haveProm {
+				promParent = i.peak
+			}
+			break
+		}
+		p := i.prom()
+		if p == 0 {
+			// Not a real peak.
+			continue
+		}
+		if !haveLine && higher(i.peak, peak) && p >= minProm {
+			lineParent = i.peak
+			haveLine = true
+		}
+		if !haveProm && p > prom {
+			promParent = i.peak
+			haveProm = true
+		}
+	}
+	return
+}
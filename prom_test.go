@@ -1,4 +1,4 @@
-package main
+package prominence
 
 import (
 	"fmt"
@@ -8,7 +8,7 @@ import (
 
 // parseTest converts a ASCII representation of an altitude map
 // (characters 0-9) and returns the cells comprising that map.
-func parseTest(s string) []cell {
+func parseTest(s string) []Cell {
 	// Trim /n.
 	for s[0] == '\n' {
 		s = s[1:]
@@ -18,24 +18,24 @@ func parseTest(s string) []cell {
 	}
 
 	// Read altitude grid, make cells from it.
-	var r []cell
-	var p point
+	var r []Cell
+	var p Point
 	for _, c := range s {
 		if c == '\n' {
-			p = point{0, p.y + 1}
+			p = Point{0, p.Y + 1}
 			continue
 		}
-		r = append(r, cell{p, height(c - '0')})
-		p = point{p.x + 1, p.y}
+		r = append(r, Cell{p, Height(c - '0')})
+		p = Point{p.X + 1, p.Y}
 	}
 	return r
 }
 
 // A prominenceRecord is pne prominence calculation result.
 type prominenceRecord struct {
-	peak   cell
-	col    cell
-	dom    cell
+	peak   Cell
+	col    Cell
+	dom    Cell
 	island bool
 }
 
@@ -58,7 +58,7 @@ type byPeak []prominenceRecord
 func (a byPeak) Len() int      { return len(a) }
 func (a byPeak) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a byPeak) Less(i, j int) bool {
-	return a[i].peak.p.x < a[j].peak.p.x || (a[i].peak.p.x == a[j].peak.p.x && a[i].peak.p.y < a[j].peak.p.y)
+	return a[i].peak.P.X < a[j].peak.P.X || (a[i].peak.P.X == a[j].peak.P.X && a[i].peak.P.Y < a[j].peak.P.Y)
 }
 
 // print displays a prominence result nicely for test failures.
@@ -72,30 +72,38 @@ func print(a []prominenceRecord) string {
 
 // runTest parses s, computes prominences on it, and sorts and returns the results.
 func runTest(s string) []prominenceRecord {
+	return runTestOpts(s, nil)
+}
+
+// runTestOpts is runTest, with the given Options.
+func runTestOpts(s string, opts *Options) []prominenceRecord {
 	var r []prominenceRecord
 	data := parseTest(s)
-	computeProminence(simpleReader(data), minx(data), maxx(data), func(peak, col, dom cell, island bool) {
-		r = append(r, prominenceRecord{peak, col, dom, island})
+	err := ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), 0, 0, opts, func(res Result) {
+		r = append(r, prominenceRecord{res.Peak, res.Col, res.Dom, res.Island})
 	})
+	if err != nil {
+		panic(err)
+	}
 	sort.Sort(byPeak(r))
 	return r
 }
 
-func minx(d []cell) coord {
-	x := d[0].p.x
+func minx(d []Cell) Coord {
+	x := d[0].P.X
 	for _, c := range d[1:] {
-		if c.p.x < x {
-			x = c.p.x
+		if c.P.X < x {
+			x = c.P.X
 		}
 	}
 	return x
 }
 
-func maxx(d []cell) coord {
-	x := d[0].p.x
+func maxx(d []Cell) Coord {
+	x := d[0].P.X
 	for _, c := range d[1:] {
-		if c.p.x > x {
-			x = c.p.x
+		if c.P.X > x {
+			x = c.P.X
 		}
 	}
 	return x + 1
@@ -111,7 +119,7 @@ func TestSingle(t *testing.T) {
 33433
 `)
 	want := []prominenceRecord{
-		{cell{point{2, 2}, 6}, cell{}, cell{}, true},
+		{Cell{Point{2, 2}, 6}, Cell{}, Cell{}, true},
 	}
 	sort.Sort(byPeak(want))
 	if !equal(got, want) {
@@ -129,8 +137,8 @@ func TestPair(t *testing.T) {
 33433
 `)
 	want := []prominenceRecord{
-		{cell{point{1, 2}, 8}, cell{}, cell{}, true},
-		{cell{point{3, 2}, 7}, cell{point{2, 2}, 6}, cell{point{1, 2}, 8}, false},
+		{Cell{Point{1, 2}, 8}, Cell{}, Cell{}, true},
+		{Cell{Point{3, 2}, 7}, Cell{Point{2, 2}, 6}, Cell{Point{1, 2}, 8}, false},
 	}
 	sort.Sort(byPeak(want))
 	if !equal(got, want) {
@@ -148,9 +156,9 @@ func TestTripleCol(t *testing.T) {
 333333
 `)
 	want := []prominenceRecord{
-		{cell{point{2, 0}, 8}, cell{}, cell{}, true},
-		{cell{point{0, 2}, 7}, cell{point{2, 2}, 5}, cell{point{2, 0}, 8}, false},
-		{cell{point{4, 2}, 7}, cell{point{2, 2}, 5}, cell{point{2, 0}, 8}, false},
+		{Cell{Point{2, 0}, 8}, Cell{}, Cell{}, true},
+		{Cell{Point{0, 2}, 7}, Cell{Point{2, 2}, 5}, Cell{Point{2, 0}, 8}, false},
+		{Cell{Point{4, 2}, 7}, Cell{Point{2, 2}, 5}, Cell{Point{2, 0}, 8}, false},
 	}
 	sort.Sort(byPeak(want))
 	if !equal(got, want) {
@@ -166,12 +174,12 @@ func TestJoin(t *testing.T) {
 111111111111
 `)
 	want := []prominenceRecord{
-		{cell{point{1, 1}, 3}, cell{point{2, 1}, 2}, cell{point{3, 1}, 4}, false},
-		{cell{point{3, 1}, 4}, cell{point{4, 1}, 2}, cell{point{5, 1}, 5}, false},
-		{cell{point{5, 1}, 5}, cell{point{6, 1}, 2}, cell{point{7, 1}, 6}, false},
-		{cell{point{7, 1}, 6}, cell{point{8, 1}, 2}, cell{point{9, 1}, 7}, false},
-		{cell{point{9, 1}, 7}, cell{point{10, 1}, 2}, cell{point{11, 1}, 8}, false},
-		{cell{point{11, 1}, 8}, cell{}, cell{}, true},
+		{Cell{Point{1, 1}, 3}, Cell{Point{2, 1}, 2}, Cell{Point{3, 1}, 4}, false},
+		{Cell{Point{3, 1}, 4}, Cell{Point{4, 1}, 2}, Cell{Point{5, 1}, 5}, false},
+		{Cell{Point{5, 1}, 5}, Cell{Point{6, 1}, 2}, Cell{Point{7, 1}, 6}, false},
+		{Cell{Point{7, 1}, 6}, Cell{Point{8, 1}, 2}, Cell{Point{9, 1}, 7}, false},
+		{Cell{Point{9, 1}, 7}, Cell{Point{10, 1}, 2}, Cell{Point{11, 1}, 8}, false},
+		{Cell{Point{11, 1}, 8}, Cell{}, Cell{}, true},
 	}
 	sort.Sort(byPeak(want))
 	if !equal(got, want) {
@@ -191,13 +199,209 @@ func TestWraparound(t *testing.T) {
 1113111
 `)
 	want := []prominenceRecord{
-		{cell{point{3, 1}, 5}, cell{point{3, 3}, 2}, cell{point{5, 3}, 7}, false},
-		{cell{point{1, 3}, 5}, cell{point{6, 3}, 3}, cell{point{5, 3}, 7}, false},
-		{cell{point{3, 5}, 6}, cell{point{3, 3}, 2}, cell{point{5, 3}, 7}, false},
-		{cell{point{5, 3}, 7}, cell{}, cell{}, true},
+		{Cell{Point{3, 1}, 5}, Cell{Point{3, 3}, 2}, Cell{Point{5, 3}, 7}, false},
+		{Cell{Point{1, 3}, 5}, Cell{Point{6, 3}, 3}, Cell{Point{5, 3}, 7}, false},
+		{Cell{Point{3, 5}, 6}, Cell{Point{3, 3}, 2}, Cell{Point{5, 3}, 7}, false},
+		{Cell{Point{5, 3}, 7}, Cell{}, Cell{}, true},
 	}
 	sort.Sort(byPeak(want))
 	if !equal(got, want) {
 		t.Errorf("want\n%s, got\n%s", print(want), print(got))
 	}
 }
+
+func TestParents(t *testing.T) {
+	// P (7) is joined across a col of 4 to an island whose
+	// nearest higher peak, Q (8), has less prominence than P.
+	data := parseTest(`
+1111111
+1968471
+1111111
+`)
+	p := Cell{Point{5, 1}, 7}
+	q := Cell{Point{3, 1}, 8}
+	a := Cell{Point{1, 1}, 9}
+	for _, test := range []struct {
+		minProm                Height
+		lineParent, promParent Cell
+	}{
+		{0, q, a},
+		{2, q, a},
+		{3, a, a},
+	} {
+		found := false
+		err := ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), test.minProm, 0, nil, func(res Result) {
+			if res.Peak != p {
+				return
+			}
+			found = true
+			if res.Dom != a {
+				t.Errorf("dom: want %v, got %v", a, res.Dom)
+			}
+			if res.LineParent != test.lineParent {
+				t.Errorf("minProm=%d line parent: want %v, got %v", test.minProm, test.lineParent, res.LineParent)
+			}
+			if res.PromParent != test.promParent {
+				t.Errorf("minProm=%d prominence parent: want %v, got %v", test.minProm, test.promParent, res.PromParent)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Errorf("peak %v not reported", p)
+		}
+	}
+}
+
+func TestDiagonalRidge(t *testing.T) {
+	// A ridge running diagonally to the grid.
+	s := `
+111111
+191111
+116111
+111511
+111181
+111111
+`
+	// With 4 directions, the ridge is broken and 8's key col is at the base.
+	for _, r := range runTestOpts(s, &Options{Connectivity: 4}) {
+		if r.peak.Z == 8 && r.col.Z != 1 {
+			t.Errorf("4-connected: want key col of 8 at altitude 1, got %v", r.col)
+		}
+	}
+
+	// With 8 directions, the key col is on the ridge.
+	got := runTestOpts(s, &Options{Connectivity: 8})
+	want := []prominenceRecord{
+		{Cell{Point{1, 1}, 9}, Cell{}, Cell{}, true},
+		{Cell{Point{4, 4}, 8}, Cell{Point{3, 3}, 5}, Cell{Point{1, 1}, 9}, false},
+	}
+	sort.Sort(byPeak(want))
+	if !equal(got, want) {
+		t.Errorf("want\n%s, got\n%s", print(want), print(got))
+	}
+}
+
+func TestPlateaus(t *testing.T) {
+	// Two peaks and the col between them are all flat.
+	data := parseTest(`
+111111111
+188755991
+111111111
+`)
+	var got []Result
+	err := ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), 0, 0, &Options{Plateaus: true}, func(res Result) {
+		got = append(got, res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 peaks, got %v", got)
+	}
+	if got[0].Island {
+		got[0], got[1] = got[1], got[0]
+	}
+	peak, island := got[0], got[1]
+	if want := (Region{2, Point{1, 1}, Point{2, 1}}); peak.Peak.Z != 8 || peak.PeakRegion != want {
+		t.Errorf("peak: want plateau %v at 8, got %v at %d", want, peak.PeakRegion, peak.Peak.Z)
+	}
+	if want := (Region{2, Point{4, 1}, Point{5, 1}}); peak.Col.Z != 5 || peak.ColRegion != want {
+		t.Errorf("col: want plateau %v at 5, got %v at %d", want, peak.ColRegion, peak.Col.Z)
+	}
+	if want := (Region{2, Point{6, 1}, Point{7, 1}}); !island.Island || island.Peak.Z != 9 || island.PeakRegion != want {
+		t.Errorf("island: want plateau %v at 9, got %v", want, island)
+	}
+}
+
+func TestTies(t *testing.T) {
+	// Two equal peaks.  The one in the earlier column is higher,
+	// no matter how many workers sort the data.
+	want := []prominenceRecord{
+		{Cell{Point{2, 1}, 5}, Cell{}, Cell{}, true},
+		{Cell{Point{4, 1}, 5}, Cell{Point{3, 1}, 3}, Cell{Point{2, 1}, 5}, false},
+	}
+	sort.Sort(byPeak(want))
+	for _, p := range []int{1, 3, 8} {
+		got := runTestOpts(`
+1111111
+1353531
+1111111
+`, &Options{P: p})
+		if !equal(got, want) {
+			t.Errorf("P=%d: want\n%s, got\n%s", p, print(want), print(got))
+		}
+	}
+}
+
+func TestVerticalError(t *testing.T) {
+	// A lower peak joined to a higher one by two ridges.
+	tests := []struct {
+		name      string
+		data      string
+		uncertain bool
+	}{
+		{"second col close", `
+111111111
+155555551
+191111161
+144444441
+111111111
+`, true},
+		{"second col far", `
+111111111
+155555551
+191111161
+122222221
+111111111
+`, false},
+		{"peaks close", `
+111111111
+155555551
+191111181
+122222221
+111111111
+`, true},
+	}
+	for _, test := range tests {
+		for _, verr := range []Height{0, 1} {
+			data := parseTest(test.data)
+			var got []Result
+			err := ComputeProminence(simpleReader(data), nil, minx(data), maxx(data), 0, verr, nil, func(res Result) {
+				got = append(got, res)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 {
+				t.Fatalf("%s: want 2 peaks, got %v", test.name, got)
+			}
+			if got[0].Island {
+				got[0], got[1] = got[1], got[0]
+			}
+			peak, island := got[0], got[1]
+			if peak.Col.Z != 5 {
+				t.Errorf("%s: want key col at 5, got %v", test.name, peak.Col)
+			}
+			want := test.uncertain && verr > 0
+			if peak.Uncertain != want {
+				t.Errorf("%s, verr=%d: want uncertain=%t, got %t", test.name, verr, want, peak.Uncertain)
+			}
+			if island.Uncertain {
+				t.Errorf("%s, verr=%d: island top is uncertain", test.name, verr)
+			}
+			prom := peak.Peak.Z - peak.Col.Z
+			clean := prom - 2*verr
+			if clean < 0 {
+				clean = 0
+			}
+			if peak.Clean != clean || peak.Optimistic != prom+2*verr {
+				t.Errorf("%s, verr=%d: want prominence %d-%d, got %d-%d", test.name, verr, clean, prom+2*verr, peak.Clean, peak.Optimistic)
+			}
+			if island.Clean != 9-verr || island.Optimistic != 9+verr {
+				t.Errorf("%s, verr=%d: want island prominence %d-%d, got %d-%d", test.name, verr, 9-verr, 9+verr, island.Clean, island.Optimistic)
+			}
+		}
+	}
+}
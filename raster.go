@@ -0,0 +1,45 @@
+package prominence
+
+import "math"
+
+// A raster is the georeferencing shared by our single-file DEM
+// formats (GeoTIFF, ESRI ASCII grid, BIL).  Grid coordinates are the
+// column and row of the raster, with rows from north to south.
+//
+// Unless the raster covers all 360 degrees of longitude, Bounds
+// adds an empty column on the east edge so that the prominence
+// computation doesn't wrap the east edge around to the west one.
+type raster struct {
+	width, length int
+
+	// Pixel (i, j) has its center at long, lat
+	// (long0 + i*scalex, lat0 - j*scaley).
+	long0, lat0, scalex, scaley float64
+	scalez                      float64 // meters per internal unit
+
+	nodata    float64
+	hasNodata bool
+}
+
+func (r *raster) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	maxx = Coord(r.width)
+	if math.Abs(float64(r.width)*r.scalex-360) > r.scalex/2 {
+		maxx++ // don't wrap around
+	}
+	return 0, maxx, 0, Coord(r.length), Height(-11000 / r.scalez), Height(9000 / r.scalez)
+}
+
+func (r *raster) Pos(c Cell) (long, lat, height float64) {
+	return r.long0 + float64(c.P.X)*r.scalex,
+		r.lat0 - float64(c.P.Y)*r.scaley,
+		float64(c.Z) * r.scalez
+}
+
+// height converts sample v, in meters, to internal units.
+// It returns false if v is missing (nodata or NaN).
+func (r *raster) height(v float64) (Height, bool) {
+	if math.IsNaN(v) || r.hasNodata && v == r.nodata {
+		return 0, false
+	}
+	return Height(math.Floor(v/r.scalez + 0.5)), true
+}
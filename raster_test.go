@@ -0,0 +1,125 @@
+package prominence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readDataSet reads all the samples of d.
+func readDataSet(t *testing.T, d DataSet) map[Point]Height {
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r, errc := d.Reader(nil)
+	got := map[Point]Height{}
+	for cslice := range r {
+		for _, c := range cslice {
+			got[c.P] = c.Z
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// tempFiles writes files (name to contents) to a new temporary directory.
+func tempFiles(t *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "raster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0666); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestASCIIGrid(t *testing.T) {
+	for _, test := range []struct {
+		header     string
+		long, lat  float64 // center of cell (0, 0)
+		wrapAround bool
+	}{
+		{"ncols 4\nnrows 3\nxllcorner 10.0\nyllcorner 47.0\ncellsize 0.5\nNODATA_value -9999\n", 10.25, 48.25, false},
+		{"NCOLS 4\r\nNROWS 3\r\nXLLCENTER -180\r\nYLLCENTER 47.0\r\nCELLSIZE 90\r\nNODATA_VALUE -9999\r\n", -180, 227, true},
+	} {
+		dir := tempFiles(t, map[string][]byte{"dem.asc": []byte(test.header +
+			"1 2 3 4\n" +
+			"5.5 -9999 7 8\n" +
+			"-1.04 10 11 12\n")})
+		defer os.RemoveAll(dir)
+		g := NewASCIIGrid(filepath.Join(dir, "dem.asc"))
+		got := readDataSet(t, g)
+		want := map[Point]Height{
+			{0, 0}: 10, {1, 0}: 20, {2, 0}: 30, {3, 0}: 40,
+			{0, 1}: 55, {2, 1}: 70, {3, 1}: 80,
+			{0, 2}: -10, {1, 2}: 100, {2, 2}: 110, {3, 2}: 120,
+		}
+		if len(got) != len(want) {
+			t.Errorf("want %d samples, got %d", len(want), len(got))
+		}
+		for p, z := range want {
+			if got[p] != z {
+				t.Errorf("%v: want %d, got %d", p, z, got[p])
+			}
+		}
+		long, lat, z := g.Pos(Cell{Point{0, 0}, 125})
+		if math.Abs(long-test.long) > 1e-9 || math.Abs(lat-test.lat) > 1e-9 || math.Abs(z-12.5) > 1e-9 {
+			t.Errorf("bad position %f %f %f", long, lat, z)
+		}
+		wantMaxx := Coord(5)
+		if test.wrapAround {
+			wantMaxx = 4
+		}
+		if _, maxx, _, maxy, _, _ := g.Bounds(); maxx != wantMaxx || maxy != 3 {
+			t.Errorf("bad bounds %d %d", maxx, maxy)
+		}
+	}
+}
+
+func TestBIL(t *testing.T) {
+	// 3x2 big-endian int16 samples, with padded rows.
+	samples := []int16{100, -5, 300, 400, -32768, 600}
+	var b bytes.Buffer
+	b.WriteString("junk")
+	for i, v := range samples {
+		binary.Write(&b, binary.BigEndian, v)
+		if i%3 == 2 {
+			b.WriteString("pad")
+		}
+	}
+	hdr := "BYTEORDER M\nLAYOUT BIL\nNROWS 2\nNCOLS 3\nNBANDS 1\nNBITS 16\n" +
+		"SKIPBYTES 4\nTOTALROWBYTES 9\nULXMAP -120.5\nULYMAP 38.25\nXDIM 0.25\nYDIM 0.125\nNODATA -32768\n"
+	dir := tempFiles(t, map[string][]byte{"dem.bil": b.Bytes(), "dem.hdr": []byte(hdr)})
+	defer os.RemoveAll(dir)
+
+	d := NewBIL(filepath.Join(dir, "dem.bil"))
+	got := readDataSet(t, d)
+	if len(got) != len(samples)-1 {
+		t.Errorf("want %d samples, got %d", len(samples)-1, len(got))
+	}
+	for i, z := range samples {
+		p := Point{Coord(i % 3), Coord(i / 3)}
+		if z == -32768 {
+			if _, ok := got[p]; ok {
+				t.Errorf("nodata sample at %v reported", p)
+			}
+			continue
+		}
+		if got[p] != Height(z) {
+			t.Errorf("%v: want %d, got %d", p, z, got[p])
+		}
+	}
+	if long, lat, z := d.Pos(Cell{Point{2, 1}, 7}); long != -120 || lat != 38.125 || z != 7 {
+		t.Errorf("bad position %f %f %f", long, lat, z)
+	}
+}
@@ -0,0 +1,587 @@
+package prominence
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Rendering.
+//
+// A canvas gathers the samples of a data set into a grid of pixels
+// as they go by on their way to the computation (see Sniff), so
+// drawing a data set doesn't need another pass over it.  Each pixel
+// holds the highest sample in it, or their mean.  The coordinate
+// mapping of every data set is affine, so the pixel columns covered
+// by each sample column, and the pixel rows covered by each sample
+// row, are worked out once up front.
+//
+// A TileRenderer draws a canvas as a pyramid of 256x256 web map
+// tiles, in the spherical Mercator projection used by OpenStreetMap
+// and Leaflet, stored as DIR/z/x/y.png.  The canvas holds the most
+// detailed zoom level, and each less detailed level is made by
+// halving the one before.
+
+// An Aggregation says how the height of a pixel is made from
+// the heights of the samples in it.
+type Aggregation int
+
+const (
+	AggregateMax  Aggregation = iota // the highest sample
+	AggregateMean                    // the mean of the samples
+)
+
+// A canvas is a grid of heights, in meters, made from the samples
+// of a data set.  Pixels with no samples are NaN.
+type canvas struct {
+	w, h       int
+	minx, miny Coord
+	// Sample column minx+i covers pixel columns [xlo[i], xhi[i]),
+	// and likewise for rows.
+	xlo, xhi, ylo, yhi []int32
+	z0, dz             float64 // a sample's height in meters is z0 + dz*Z
+	agg                Aggregation
+	pix                []float32
+	// For AggregateMean, the sum and number of the samples in
+	// each pixel.  A float32 sum would lose the small heights
+	// added to a big one, so the sums are float64 until finish.
+	sum      []float64
+	n        []uint32
+	finished chan struct{} // closed when all samples are in
+}
+
+// newCanvas returns a w by h canvas for the samples of d.  fx and fy
+// map longitude and latitude to pixel coordinates, in which pixel i
+// covers [i, i+1).
+func newCanvas(d DataSet, w, h int, fx, fy func(float64) float64, agg Aggregation) *canvas {
+	minx, maxx, miny, maxy, _, _ := d.Bounds()
+	c := &canvas{w: w, h: h, minx: minx, miny: miny, agg: agg, finished: make(chan struct{})}
+	long0, lat0, z0 := d.Pos(Cell{})
+	long1, lat1, z1 := d.Pos(Cell{Point{1, 1}, 1})
+	c.z0, c.dz = z0, z1-z0
+	c.xlo, c.xhi = pixelRanges(int(maxx-minx), w, func(i float64) float64 {
+		return fx(long0 + (float64(minx)+i)*(long1-long0))
+	})
+	c.ylo, c.yhi = pixelRanges(int(maxy-miny), h, func(i float64) float64 {
+		return fy(lat0 + (float64(miny)+i)*(lat1-lat0))
+	})
+	c.pix = make([]float32, w*h)
+	if agg == AggregateMean {
+		c.sum = make([]float64, w*h)
+		c.n = make([]uint32, w*h)
+	}
+	nan := float32(math.NaN())
+	for i := range c.pix {
+		c.pix[i] = nan // no samples
+	}
+	return c
+}
+
+// pixelRanges returns, for each of n samples, the pixels [lo, hi)
+// in [0, size) whose centers it covers.  f maps sample coordinates
+// to pixel coordinates; sample i covers [i-0.5, i+0.5).  A sample
+// which covers no pixel centers gets the pixel its own center is in.
+func pixelRanges(n, size int, f func(float64) float64) (lo, hi []int32) {
+	lo = make([]int32, n)
+	hi = make([]int32, n)
+	for i := 0; i < n; i++ {
+		a, b := f(float64(i)-0.5), f(float64(i)+0.5)
+		if a > b {
+			a, b = b, a
+		}
+		l, h := math.Ceil(a-0.5), math.Ceil(b-0.5)
+		if l >= h {
+			l = math.Floor(f(float64(i)))
+			h = l + 1
+		}
+		l = math.Max(l, 0)
+		h = math.Min(h, float64(size))
+		if l < h {
+			lo[i], hi[i] = int32(l), int32(h)
+		}
+	}
+	return lo, hi
+}
+
+// add adds sample s to the canvas.
+func (c *canvas) add(s Cell) {
+	i, j := s.P.X-c.minx, s.P.Y-c.miny
+	z := c.z0 + c.dz*float64(s.Z)
+	for y := c.ylo[j]; y < c.yhi[j]; y++ {
+		k := int(y) * c.w
+		if c.agg == AggregateMean {
+			sum, n := c.sum[k:], c.n[k:]
+			for x := c.xlo[i]; x < c.xhi[i]; x++ {
+				sum[x] += z
+				n[x]++
+			}
+			continue
+		}
+		row := c.pix[k:]
+		for x := c.xlo[i]; x < c.xhi[i]; x++ {
+			if !(row[x] >= float32(z)) { // NaN compares false
+				row[x] = float32(z)
+			}
+		}
+	}
+}
+
+// finish finishes the canvas once all the samples are in.
+func (c *canvas) finish() {
+	if c.agg == AggregateMean {
+		for i, n := range c.n {
+			if n > 0 {
+				c.pix[i] = float32(c.sum[i] / float64(n))
+			}
+		}
+		c.sum, c.n = nil, nil
+	}
+}
+
+// sniff returns a channel which passes along the samples of r,
+// adding them to c on the way.
+func (c *canvas) sniff(r <-chan []Cell, done <-chan struct{}) <-chan []Cell {
+	r2 := make(chan []Cell, 1)
+	go func() {
+		defer close(c.finished)
+		defer close(r2)
+		for cslice := range r {
+			for _, s := range cslice {
+				c.add(s)
+			}
+			select {
+			case r2 <- cslice:
+			case <-done:
+				return
+			}
+		}
+		c.finish()
+	}()
+	return r2
+}
+
+// tileSize is the width and height of a tile, in pixels.
+const tileSize = 256
+
+// tileMaxPixels is the most pixels we allow at the most detailed
+// zoom level.  We pick a less detailed one if need be.
+const tileMaxPixels = 1 << 26
+
+// maxLat is the latitude of the top of the Mercator map, in degrees.
+var maxLat = 180 / math.Pi * math.Atan(math.Sinh(math.Pi))
+
+// worldSize returns the width and height of the whole map, in pixels, at zoom level z.
+func worldSize(z int) float64 {
+	return float64(int64(tileSize) << uint(z))
+}
+
+// mercX and mercY return the Mercator pixel coordinates of a
+// longitude and latitude (in degrees) at zoom level z.
+func mercX(long float64, z int) float64 {
+	return (long + 180) / 360 * worldSize(z)
+}
+
+func mercY(lat float64, z int) float64 {
+	lat = math.Max(-maxLat, math.Min(maxLat, lat)) * math.Pi / 180
+	return (1 - math.Log(math.Tan(math.Pi/4+lat/2))/math.Pi) / 2 * worldSize(z)
+}
+
+// mercLat returns the latitude, in degrees, of Mercator pixel row y at zoom level z.
+func mercLat(y float64, z int) float64 {
+	return 180 / math.Pi * math.Atan(math.Sinh(math.Pi*(1-2*y/worldSize(z))))
+}
+
+// A TileRenderer draws a data set as a pyramid of web map tiles.
+type TileRenderer struct {
+	// Hillshade shades the terrain as if lit from the northwest.
+	Hillshade bool
+
+	c      *canvas
+	zoom   int
+	x0, y0 int        // pixel coordinates of the canvas at zoom
+	box    [4]float64 // min long, min lat, max long, max lat
+	peaks  []tilePeak
+}
+
+// A tilePeak is a peak to draw.
+type tilePeak struct {
+	long, lat, prom float64
+}
+
+// NewTileRenderer returns a renderer for d, which must be initialized,
+// with the most detailed tiles at the given zoom level.  If zoom is
+// negative, it picks the zoom level which best matches the
+// resolution of d, limited by the memory it would take.
+func NewTileRenderer(d DataSet, zoom int) (*TileRenderer, error) {
+	box, dlong, err := dataBox(d)
+	if err != nil {
+		return nil, fmt.Errorf("tiles: %v", err)
+	}
+	t := &TileRenderer{box: box}
+
+	if zoom < 0 {
+		// The zoom level with pixels at least as big as samples.
+		zoom = int(math.Floor(math.Log2(360 / (tileSize * dlong))))
+		if zoom < 0 {
+			zoom = 0
+		}
+		for zoom > 0 && t.pixels(zoom) > tileMaxPixels {
+			zoom--
+		}
+	} else if t.pixels(zoom) > 4*tileMaxPixels {
+		return nil, fmt.Errorf("tiles: zoom %d is too detailed for this data set", zoom)
+	}
+	t.zoom = zoom
+	x0, y0, x1, y1 := t.extent(zoom)
+	t.x0, t.y0 = x0, y0
+	t.c = newCanvas(d, x1-x0, y1-y0,
+		func(long float64) float64 { return mercX(long, zoom) - float64(x0) },
+		func(lat float64) float64 { return mercY(lat, zoom) - float64(y0) },
+		AggregateMax)
+	return t, nil
+}
+
+// dataBox returns the edges of d (halfway between samples), as
+// min long, min lat, max long, max lat, and the sample spacing in
+// longitude, all in degrees.
+func dataBox(d DataSet) (box [4]float64, dlong float64, err error) {
+	minx, maxx, miny, maxy, _, _ := d.Bounds()
+	if minx >= maxx || miny >= maxy {
+		return box, 0, fmt.Errorf("empty data set")
+	}
+	long0, lat0, _ := d.Pos(Cell{P: Point{minx, miny}})
+	long1, lat1, _ := d.Pos(Cell{P: Point{maxx, maxy}})
+	dlong = (long1 - long0) / float64(maxx-minx)
+	dlat := (lat1 - lat0) / float64(maxy-miny)
+	long0, long1 = long0-dlong/2, long1-dlong/2
+	lat0, lat1 = lat0-dlat/2, lat1-dlat/2
+	box = [4]float64{
+		math.Min(long0, long1), math.Min(lat0, lat1),
+		math.Max(long0, long1), math.Max(lat0, lat1),
+	}
+	return box, math.Abs(dlong), nil
+}
+
+// extent returns the pixels [x0, x1) and [y0, y1) covering the data set at zoom level z.
+func (t *TileRenderer) extent(z int) (x0, y0, x1, y1 int) {
+	x0 = int(math.Floor(mercX(t.box[0], z)))
+	x1 = int(math.Ceil(mercX(t.box[2], z)))
+	y0 = int(math.Floor(mercY(t.box[3], z)))
+	y1 = int(math.Ceil(mercY(t.box[1], z)))
+	if x1 == x0 {
+		x1++
+	}
+	if y1 == y0 {
+		y1++
+	}
+	return x0, y0, x1, y1
+}
+
+// pixels returns the number of pixels of the data set at zoom level z.
+func (t *TileRenderer) pixels(z int) int64 {
+	x0, y0, x1, y1 := t.extent(z)
+	return int64(x1-x0) * int64(y1-y0)
+}
+
+// Sniff returns a channel which passes along the samples of r,
+// recording them for drawing.  Closing done stops it.
+func (t *TileRenderer) Sniff(r <-chan []Cell, done <-chan struct{}) <-chan []Cell {
+	return t.c.sniff(r, done)
+}
+
+// AddPeak adds a peak at long, lat with prominence prom (in meters),
+// to draw over the terrain.
+func (t *TileRenderer) AddPeak(long, lat, prom float64) {
+	t.peaks = append(t.peaks, tilePeak{long, lat, prom})
+}
+
+// A tileLevel is the canvas at one zoom level.
+type tileLevel struct {
+	z      int
+	x0, y0 int // pixel coordinates of pix[0]
+	w, h   int
+	pix    []float32
+}
+
+// half returns the next less detailed level.  Each of its pixels
+// holds the highest of the four pixels it covers in l.
+func (l *tileLevel) half() *tileLevel {
+	x0, y0 := l.x0>>1, l.y0>>1
+	h := &tileLevel{z: l.z - 1, x0: x0, y0: y0,
+		w: (l.x0+l.w+1)>>1 - x0,
+		h: (l.y0+l.h+1)>>1 - y0,
+	}
+	h.pix = make([]float32, h.w*h.h)
+	nan := float32(math.NaN())
+	for i := range h.pix {
+		h.pix[i] = nan
+	}
+	for y := 0; y < l.h; y++ {
+		dst := h.pix[((l.y0+y)>>1-y0)*h.w:]
+		for x, z := range l.pix[y*l.w : (y+1)*l.w] {
+			p := &dst[(l.x0+x)>>1-x0]
+			if !(*p >= z) {
+				*p = z
+			}
+		}
+	}
+	return h
+}
+
+// WriteTiles writes the tiles to dir/z/x/y.png for every zoom level
+// up to the renderer's, along with dir/index.html, a Leaflet page to
+// browse them.  It waits for Sniff to see all the samples.
+func (t *TileRenderer) WriteTiles(dir string) error {
+	<-t.c.finished
+	// Draw the most prominent peaks last, on top.
+	sort.Slice(t.peaks, func(i, j int) bool { return t.peaks[i].prom < t.peaks[j].prom })
+
+	l := &tileLevel{z: t.zoom, x0: t.x0, y0: t.y0, w: t.c.w, h: t.c.h, pix: t.c.pix}
+	for {
+		if err := t.writeLevel(dir, l); err != nil {
+			return err
+		}
+		if l.z == 0 {
+			break
+		}
+		l = l.half()
+	}
+	return t.writeIndex(dir)
+}
+
+// writeLevel writes the tiles of level l.
+func (t *TileRenderer) writeLevel(dir string, l *tileLevel) error {
+	// The tiles to draw, with the peaks on each.
+	type tile struct{ x, y int }
+	tiles := map[tile][]tilePeak{}
+	for ty := l.y0 / tileSize; ty <= (l.y0+l.h-1)/tileSize; ty++ {
+		for tx := l.x0 / tileSize; tx <= (l.x0+l.w-1)/tileSize; tx++ {
+			tiles[tile{tx, ty}] = nil
+		}
+	}
+	n := 1 << uint(l.z)
+	for _, p := range t.peaks {
+		x, y := mercX(p.long, l.z), mercY(p.lat, l.z)
+		r := float64(peakRadius(p.prom) + 1)
+		for ty := int(y-r) / tileSize; ty <= int(y+r)/tileSize; ty++ {
+			for tx := int(x-r) / tileSize; tx <= int(x+r)/tileSize; tx++ {
+				if tx >= 0 && tx < n && ty >= 0 && ty < n {
+					tiles[tile{tx, ty}] = append(tiles[tile{tx, ty}], p)
+				}
+			}
+		}
+	}
+
+	work := make(chan tile)
+	errc := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				if err := t.writeTile(dir, l, k.x, k.y, tiles[k]); err != nil {
+					errc <- err
+					for range work {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for k := range tiles {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
+
+// writeTile draws tile tx, ty of level l, with the given peaks, and
+// writes it.  It skips tiles with nothing on them.
+func (t *TileRenderer) writeTile(dir string, l *tileLevel, tx, ty int, peaks []tilePeak) error {
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	empty := len(peaks) == 0
+	get := func(x, y int) float32 {
+		if x < 0 || x >= l.w || y < 0 || y >= l.h {
+			return float32(math.NaN())
+		}
+		return l.pix[y*l.w+x]
+	}
+	for py := 0; py < tileSize; py++ {
+		y := ty*tileSize + py - l.y0
+		if y < 0 || y >= l.h {
+			continue
+		}
+		// Meters per pixel, for hillshading.
+		m := 2 * math.Pi * 6371e3 * math.Cos(mercLat(float64(ty*tileSize+py)+0.5, l.z)*math.Pi/180) / worldSize(l.z)
+		for px := 0; px < tileSize; px++ {
+			x := tx*tileSize + px - l.x0
+			z := get(x, y)
+			if math.IsNaN(float64(z)) {
+				continue // no data
+			}
+			empty = false
+			c := hypsometric(float64(z))
+			if t.Hillshade {
+				// Use z for missing neighbors.
+				nb := func(x, y int) float64 {
+					if v := float64(get(x, y)); !math.IsNaN(v) {
+						return v
+					}
+					return float64(z)
+				}
+				c = shade(c, (nb(x+1, y)-nb(x-1, y))/(2*m), (nb(x, y-1)-nb(x, y+1))/(2*m))
+			}
+			img.SetNRGBA(px, py, c)
+		}
+	}
+	if empty {
+		return nil
+	}
+	for _, p := range peaks {
+		drawPeak(img, mercX(p.long, l.z)-float64(tx*tileSize), mercY(p.lat, l.z)-float64(ty*tileSize), p.prom)
+	}
+
+	name := filepath.Join(dir, fmt.Sprint(l.z), fmt.Sprint(tx), fmt.Sprintf("%d.png", ty))
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hypsometricRamp is the color of the terrain at each height, in meters.
+var hypsometricRamp = []struct {
+	z float64
+	c color.NRGBA
+}{
+	{-500, color.NRGBA{0, 97, 71, 255}},
+	{0, color.NRGBA{16, 122, 47, 255}},
+	{300, color.NRGBA{232, 215, 125, 255}},
+	{1000, color.NRGBA{161, 67, 0, 255}},
+	{2000, color.NRGBA{130, 30, 30, 255}},
+	{3000, color.NRGBA{110, 110, 110, 255}},
+	{5000, color.NRGBA{255, 255, 255, 255}},
+}
+
+// hypsometric returns the color of terrain at height z, in meters.
+func hypsometric(z float64) color.NRGBA {
+	r := hypsometricRamp
+	if z <= r[0].z {
+		return r[0].c
+	}
+	for i := 1; i < len(r); i++ {
+		if z < r[i].z {
+			f := (z - r[i-1].z) / (r[i].z - r[i-1].z)
+			a, b := r[i-1].c, r[i].c
+			mix := func(a, b uint8) uint8 { return uint8(float64(a) + f*(float64(b)-float64(a)) + 0.5) }
+			return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+		}
+	}
+	return r[len(r)-1].c
+}
+
+// shade darkens or lightens c for terrain with the given slopes
+// toward the east and north, lit from the northwest 45° up.
+// Flat terrain keeps its color.
+func shade(c color.NRGBA, east, north float64) color.NRGBA {
+	const s = math.Sqrt2 / 2 // sine and cosine of 45°
+	// Dot product of the surface normal (-east, -north, 1) with
+	// the direction of the light (-s*s, s*s, s), relative to flat.
+	f := (east*s*s - north*s*s + s) / math.Sqrt(east*east+north*north+1) / s
+	f = math.Max(0.25, math.Min(1.25, f))
+	scale := func(v uint8) uint8 { return uint8(math.Min(255, float64(v)*f)) }
+	return color.NRGBA{scale(c.R), scale(c.G), scale(c.B), c.A}
+}
+
+// peakClasses are the radius and color of the peaks in each prominence class.
+var peakClasses = []struct {
+	prom float64 // least prominence of the class, in meters
+	r    int
+	c    color.NRGBA
+}{
+	{1500, 6, color.NRGBA{255, 0, 0, 255}},
+	{600, 5, color.NRGBA{255, 128, 0, 255}},
+	{300, 4, color.NRGBA{255, 255, 0, 255}},
+	{100, 3, color.NRGBA{0, 255, 0, 255}},
+	{math.Inf(-1), 2, color.NRGBA{255, 255, 255, 255}},
+}
+
+// peakClass returns the class of a peak with prominence prom.
+func peakClass(prom float64) int {
+	k := 0
+	for prom < peakClasses[k].prom {
+		k++
+	}
+	return k
+}
+
+// peakRadius returns the radius, in pixels, of a peak with prominence prom.
+func peakRadius(prom float64) int {
+	return peakClasses[peakClass(prom)].r
+}
+
+// drawPeak draws a peak with prominence prom at x, y on img,
+// as a dot outlined in black.
+func drawPeak(img *image.NRGBA, x, y, prom float64) {
+	k := peakClass(prom)
+	r := peakClasses[k].r
+	cx, cy := int(math.Floor(x)), int(math.Floor(y))
+	for dy := -r - 1; dy <= r+1; dy++ {
+		for dx := -r - 1; dx <= r+1; dx++ {
+			d := dx*dx + dy*dy
+			switch {
+			case d <= r*r:
+				img.SetNRGBA(cx+dx, cy+dy, peakClasses[k].c)
+			case d <= (r+1)*(r+1):
+				img.SetNRGBA(cx+dx, cy+dy, color.NRGBA{0, 0, 0, 255})
+			}
+		}
+	}
+}
+
+// writeIndex writes dir/index.html, a Leaflet page showing the tiles.
+func (t *TileRenderer) writeIndex(dir string) error {
+	b := t.box
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prominence</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css">
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>html, body, #map { height: 100%%; margin: 0; }</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+var bounds = [[%f, %f], [%f, %f]];
+var map = L.map('map');
+L.tileLayer('{z}/{x}/{y}.png', {maxNativeZoom: %d, maxZoom: %d, bounds: bounds}).addTo(map);
+map.fitBounds(bounds);
+</script>
+</body>
+</html>
+`, b[1], b[0], b[3], b[2], t.zoom, t.zoom+3)
+	// dir doesn't exist yet if there were no tiles to write.
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(page), 0666)
+}
@@ -0,0 +1,137 @@
+package prominence
+
+import (
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPixelRanges(t *testing.T) {
+	for _, test := range []struct {
+		n, size int
+		scale   float64 // pixels per sample
+		lo, hi  []int32
+	}{
+		// One sample per pixel.
+		{3, 3, 1, []int32{0, 1, 2}, []int32{1, 2, 3}},
+		// Two pixels per sample.
+		{2, 4, 2, []int32{0, 2}, []int32{2, 4}},
+		// Two samples per pixel: each gets the pixel it is in.
+		{4, 2, 0.5, []int32{0, 0, 1, 1}, []int32{1, 1, 2, 2}},
+		// Samples off the edge get no pixels.
+		{3, 2, 1, []int32{0, 1, 0}, []int32{1, 2, 0}},
+	} {
+		lo, hi := pixelRanges(test.n, test.size, func(i float64) float64 { return (i + 0.5) * test.scale })
+		for i := range lo {
+			if lo[i] != test.lo[i] || hi[i] != test.hi[i] {
+				t.Errorf("%d samples at %g: sample %d covers [%d,%d), want [%d,%d)",
+					test.n, test.scale, i, lo[i], hi[i], test.lo[i], test.hi[i])
+			}
+		}
+	}
+}
+
+func TestCanvasMean(t *testing.T) {
+	// 300x300 samples in one pixel, alternately 8848m and 8849m.
+	// Their sum is too big to hold exactly in a float32.
+	var cells []Cell
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 300; x++ {
+			cells = append(cells, Cell{Point{Coord(x), Coord(y)}, Height(8848 + (x+y)%2)})
+		}
+	}
+	d := SimpleDataSet(cells)
+	scale := func(v float64) float64 { return (v + 0.5) / 300 }
+	for _, test := range []struct {
+		agg  Aggregation
+		want float32
+	}{
+		{AggregateMax, 8849},
+		{AggregateMean, 8848.5},
+	} {
+		c := newCanvas(d, 2, 1, scale, scale, test.agg)
+		for _, s := range cells {
+			c.add(s)
+		}
+		c.finish()
+		if c.pix[0] != test.want {
+			t.Errorf("aggregation %d: pixel is %g, want %g", test.agg, c.pix[0], test.want)
+		}
+		if z := c.pix[1]; z == z {
+			t.Errorf("aggregation %d: empty pixel is %g, want NaN", test.agg, z)
+		}
+	}
+}
+
+func TestTileRenderer(t *testing.T) {
+	s := NewSynthetic(1, 600, 400, 0, 0)
+	tr, err := NewTileRenderer(s, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Hillshade = true
+	tr.AddPeak(0, 0, 1000)
+	r, rerr := s.Reader(nil)
+	n := 0
+	for cslice := range tr.Sniff(r, nil) {
+		n += len(cslice)
+	}
+	if err := <-rerr; err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no samples passed along")
+	}
+
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := tr.WriteTiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data set is at 1200 samples per degree, so its most
+	// detailed tiles are at zoom level 10.  It is centered on 0,0,
+	// where four tiles meet at every zoom level.
+	if tr.zoom != 10 {
+		t.Errorf("zoom level %d, want 10", tr.zoom)
+	}
+	for _, name := range []string{"index.html", "0/0/0.png", "5/15/15.png", "10/511/511.png", "10/512/512.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "10/500/500.png")); err == nil {
+		t.Error("tile written outside the data set")
+	}
+
+	f, err := os.Open(filepath.Join(dir, "10/512/512.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != tileSize || b.Dy() != tileSize {
+		t.Errorf("tile is %v, want %dx%d", b, tileSize, tileSize)
+	}
+	// The peak is drawn at the top left corner of the tile.
+	if _, _, _, a := img.At(0, 0).RGBA(); a == 0 {
+		t.Error("peak not drawn")
+	}
+
+	// The index is written even where no tile made the directory.
+	empty := filepath.Join(dir, "empty")
+	if err := tr.writeIndex(empty); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(empty, "index.html")); err != nil {
+		t.Error(err)
+	}
+}
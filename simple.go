@@ -1,37 +1,38 @@
-package main
+package prominence
 
-// A simpleDataSet is a dataSet specified by a slice of cells.
+// A SimpleDataSet is a DataSet specified by a slice of cells.
 //  It has trivial mappings to real-world coordinates.
-type simpleDataSet []cell
+type SimpleDataSet []Cell
 
-func (file simpleDataSet) Init() {
+func (file SimpleDataSet) Init() error {
+	return nil
 }
 
-func (data simpleDataSet) Bounds() (minx, maxx coord, miny, maxy coord, minz, maxz height) {
-	minx = data[0].p.x
+func (data SimpleDataSet) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	minx = data[0].P.X
 	maxx = minx
-	miny = data[0].p.y
+	miny = data[0].P.Y
 	maxy = miny
-	minz = data[0].z
+	minz = data[0].Z
 	maxz = minz
 	for _, c := range data[1:] {
-		if c.p.x < minx {
-			minx = c.p.x
+		if c.P.X < minx {
+			minx = c.P.X
 		}
-		if c.p.x > maxx {
-			maxx = c.p.x
+		if c.P.X > maxx {
+			maxx = c.P.X
 		}
-		if c.p.y < miny {
-			miny = c.p.y
+		if c.P.Y < miny {
+			miny = c.P.Y
 		}
-		if c.p.y > maxy {
-			maxy = c.p.y
+		if c.P.Y > maxy {
+			maxy = c.P.Y
 		}
-		if c.z < minz {
-			minz = c.z
+		if c.Z < minz {
+			minz = c.Z
 		}
-		if c.z > maxz {
-			maxz = c.z
+		if c.Z > maxz {
+			maxz = c.Z
 		}
 	}
 	maxx++
@@ -39,20 +40,21 @@ func (data simpleDataSet) Bounds() (minx, maxx coord, miny, maxy coord, minz, ma
 	maxz++
 	return
 }
-func (data simpleDataSet) Pos(c cell) (lat, long, height float64) {
-	return float64(c.p.x), float64(c.p.y), float64(c.z)
+func (data SimpleDataSet) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X), float64(c.P.Y), float64(c.Z)
 }
-func (data simpleDataSet) Reader() <-chan []cell {
-	c := make(chan []cell, 1)
-	c <- data
-	close(c)
-	return c
+func (data SimpleDataSet) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	errc := make(chan error, 1)
+	errc <- nil
+	return simpleReader(data), errc
 }
 
 // simpleReader returns a reader which returns cells from data.
-func simpleReader(data []cell) <-chan []cell {
-	c := make(chan []cell, 1)
-	c <- data
+// Readers recycle the chunks they receive (see chunkPool), so
+// we send a copy of data.
+func simpleReader(data []Cell) <-chan []Cell {
+	c := make(chan []Cell, 1)
+	c <- append([]Cell(nil), data...)
 	close(c)
 	return c
 }
@@ -1,6 +1,8 @@
-package main
+package prominence
 
 import (
+	"container/heap"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,13 +18,30 @@ type fileRange struct {
 	len int
 }
 
-// cellSort externally sorts the cells in descending altitude order.
-// Returns a channel producing the sorted data.
-func cellSort(r <-chan []cell) <-chan []cell {
+// CellSort externally sorts the cells in descending altitude order.
+// Cells of equal altitude are sorted by y, then x.
+// Returns a channel producing the sorted data.  Once that channel
+// is closed, the error channel reports nil if all the data was sent,
+// or the error which stopped the sort.
+// rerr reports errors reading r, as for DataSet.Reader.  It may be
+// nil if reading r can't fail.  If CellSort fails before reading all
+// of r, it stops reading; the sender must then be stopped some other
+// way (for instance, by closing its done channel).
+// opts.P and opts.TmpDir control the sort; opts may be nil.
+func CellSort(r <-chan []Cell, rerr <-chan error, opts *Options) (<-chan []Cell, <-chan error) {
+	nproc := opts.p()
+	c := make(chan []Cell, 1)
+	errc := make(chan error, 1)
+	fail := func(err error) (<-chan []Cell, <-chan error) {
+		close(c)
+		errc <- err
+		return c, errc
+	}
+
 	// Make a temp file for the external sort.
-	f, err := ioutil.TempFile(*tmpDirPtr, "prominenceAltitudeSort")
+	f, err := ioutil.TempFile(opts.tmpDir(), "prominenceAltitudeSort")
 	if err != nil {
-		log.Fatal(err)
+		return fail(err)
 	}
 	// Remove the file to keep the filesystem clean.
 	// Note: this call deletes the file before we've even used it.
@@ -30,103 +49,154 @@ func cellSort(r <-chan []cell) <-chan []cell {
 	// the right thing here.
 	os.Remove(f.Name())
 
-	// Lock on the temporary file and the range map, below.
+	// Lock on the temporary file, the range map, and
+	// writeErr, below.
 	var lock sync.Mutex
 	var fileLen int64
 
+	// writeErr is the first error writing the temporary file.
+	// When it is set, abort is closed to stop reading input.
+	var writeErr error
+	abort := make(chan struct{})
+
 	// We'll divide up the input into contiguous chunks of cells
 	// that all have the same altitude, then write that chunk to
 	// the temporary file.  This map keeps track of which altitudes
 	// are where.
-	ranges := map[height][]fileRange{}
+	ranges := map[Height][]fileRange{}
 
 	// Step 1: Divide input data into stripes.  We do this so that
 	// any particular altitude is buffered by only one worker.
-	var stripes = make([]chan []cell, *P)
-	for i := 0; i < *P; i++ {
-		stripes[i] = make(chan []cell, 1)
+	var stripes = make([]chan []Cell, nproc)
+	for i := 0; i < nproc; i++ {
+		stripes[i] = make(chan []Cell, 1)
 	}
 	// Read input data, send to the correct stripe.
 	var wg1 sync.WaitGroup
-	wg1.Add(*P)
-	for i := 0; i < *P; i++ {
+	wg1.Add(nproc)
+	for i := 0; i < nproc; i++ {
 		go func() {
-			k := make([]cellChunker, *P)
-			for j := 0; j < *P; j++ {
+			defer wg1.Done()
+			k := make([]cellChunker, nproc)
+			for j := 0; j < nproc; j++ {
 				k[j].c = stripes[j]
+				k[j].done = abort
 			}
-			for cslice := range r {
+			for {
+				var cslice []Cell
+				var ok bool
+				select {
+				case cslice, ok = <-r:
+				case <-abort:
+					return
+				}
+				if !ok {
+					break
+				}
 				for _, c := range cslice {
-					k[uint(c.z)%uint(*P)].send(c)
+					if !k[uint(c.Z)%uint(nproc)].send(c) {
+						return
+					}
 				}
 				chunkPool.Put(cslice)
 			}
-			for j := 0; j < *P; j++ {
-				k[j].flush()
+			for j := 0; j < nproc; j++ {
+				if !k[j].flush() {
+					return
+				}
 			}
-			wg1.Done()
 		}()
 	}
 	// When all data is striped, close the stripe channels.
 	go func() {
 		wg1.Wait()
-		for i := 0; i < *P; i++ {
+		for i := 0; i < nproc; i++ {
 			close(stripes[i])
 		}
 	}()
 
 	// Step 2: Read stripe, split into individual altitude buffers.
 	// When buffers fill up, write the buffer to the temporary file.
+	// write writes s to the temporary file as the next range of
+	// altitude h.  It reports whether the write succeeded.
+	write := func(h Height, s []byte) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if writeErr != nil {
+			return false
+		}
+		if _, err := f.Write(s); err != nil {
+			writeErr = err
+			close(abort)
+			return false
+		}
+		ranges[h] = append(ranges[h], fileRange{fileLen, len(s)})
+		fileLen += int64(len(s))
+		return true
+	}
 	var wg2 sync.WaitGroup
-	wg2.Add(*P)
-	for i := 0; i < *P; i++ {
+	wg2.Add(nproc)
+	for i := 0; i < nproc; i++ {
 		i := i
 		go func() {
+			defer wg2.Done()
 			// Keep a write buffer for each altitude.
-			wbufs := map[height]*wbuf{}
+			wbufs := map[Height]*wbuf{}
+			failed := false
 			for cslice := range stripes[i] {
+				if failed {
+					// Drain the stripe so the stripers don't block.
+					chunkPool.Put(cslice)
+					continue
+				}
 				for _, c := range cslice {
-					w := wbufs[c.z]
+					w := wbufs[c.Z]
 					if w == nil {
 						w = &wbuf{}
-						wbufs[c.z] = w
+						wbufs[c.Z] = w
 					}
 					if w.n == len(w.buf) {
 						// Write full buffer to the temp file.
+						sort.Sort(byYX(w.buf[:]))
 						b := int(unsafe.Sizeof(w.buf))
 						s := *(*[]byte)(unsafe.Pointer(&slice{unsafe.Pointer(&w.buf), b, b}))
-						lock.Lock()
-						_, err = f.Write(s)
-						if err != nil {
-							log.Fatal(err)
+						if !write(c.Z, s) {
+							failed = true
+							break
 						}
-						ranges[c.z] = append(ranges[c.z], fileRange{fileLen, b})
-						fileLen += int64(b)
-						lock.Unlock()
 						w.n = 0
 					}
-					w.buf[w.n] = c.p
+					w.buf[w.n] = c.P
 					w.n++
 				}
 				chunkPool.Put(cslice)
 			}
+			if failed {
+				return
+			}
 			// Write any remaining parital buffers to the temp file.
 			for h, w := range wbufs {
-				b := w.n * int(unsafe.Sizeof(point{}))
+				sort.Sort(byYX(w.buf[:w.n]))
+				b := w.n * int(unsafe.Sizeof(Point{}))
 				s := *(*[]byte)(unsafe.Pointer(&slice{unsafe.Pointer(&w.buf), b, b}))
-				lock.Lock()
-				_, err = f.Write(s)
-				if err != nil {
-					log.Fatal(err)
+				if !write(h, s) {
+					return
 				}
-				ranges[h] = append(ranges[h], fileRange{fileLen, b})
-				fileLen += int64(b)
-				lock.Unlock()
 			}
-			wg2.Done()
 		}()
 	}
 	wg2.Wait()
+	if writeErr != nil {
+		f.Close()
+		return fail(writeErr)
+	}
+	if rerr != nil {
+		// r is closed, so rerr is ready.
+		if err := <-rerr; err != nil {
+			f.Close()
+			return fail(err)
+		}
+	}
 	log.Printf("temp file size: %d", fileLen)
 
 	// Step 3: Compute descending altitude order.
@@ -137,38 +207,150 @@ func cellSort(r <-chan []cell) <-chan []cell {
 	sort.Sort(sort.Reverse(sort.IntSlice(alts)))
 
 	// Step 4: Make a channel and shove the sorted data into it.
-	c := make(chan []cell, 1)
+	// Within an altitude, cells are sorted by (y, x), so that the
+	// order doesn't depend on goroutine scheduling or on the order
+	// of writes to the temporary file.  This is the tie-breaking
+	// order for equal-altitude cells (see prom.go).  Each range is
+	// already sorted (step 2), so we merge the ranges of an altitude,
+	// holding only a small window of each in memory.
 	go func() {
-		var points [bufSize]point
-		var chunker cellChunker
-		chunker.c = c
+		defer close(c)
+		defer f.Close()
+		chunker := cellChunker{c: c}
+		var m rangeMerge
 		for _, a := range alts {
-			h := height(a)
-
-			// Read chunks from temporary file.
-			for _, rng := range ranges[h] {
-				b := rng.len
-				if b > int(unsafe.Sizeof(points)) {
-					log.Fatal("block too big")
-				}
-				s := *(*[]byte)(unsafe.Pointer(&slice{unsafe.Pointer(&points), b, b}))
-				_, err := f.ReadAt(s, rng.off)
+			h := Height(a)
+			if err := m.init(f, ranges[h]); err != nil {
+				errc <- err
+				return
+			}
+			for len(m.cursors) > 0 {
+				p, err := m.next()
 				if err != nil {
-					log.Fatal(err)
-				}
-				for i := 0; i < b/int(unsafe.Sizeof(point{})); i++ {
-					chunker.send(cell{points[i], h})
+					errc <- err
+					return
 				}
+				chunker.send(Cell{p, h})
 			}
 		}
 		chunker.flush()
-		close(c)
+		errc <- nil
 	}()
-	return c
+	return c, errc
+}
+
+// mergeWindow is the number of points of each range a rangeMerge
+// holds in memory at once.
+const mergeWindow = 1 << 10
+
+// A rangeMerge merges sorted ranges of the temporary file
+// into (y, x) order.
+type rangeMerge struct {
+	f       *os.File
+	cursors []*rangeCursor // a heap, by the cursors' next points
+	free    []*rangeCursor // cursors to reuse
+}
+
+// A rangeCursor is a position in a range of the temporary file.
+type rangeCursor struct {
+	off  int64 // file offset of the first point not yet in buf
+	left int   // points not yet read into buf
+	buf  []Point
+	i    int // next point in buf
+}
+
+// init starts merging the given ranges of f.
+func (m *rangeMerge) init(f *os.File, ranges []fileRange) error {
+	m.f = f
+	m.free = append(m.free, m.cursors...)
+	m.cursors = m.cursors[:0]
+	for _, rng := range ranges {
+		if rng.len > bufSize*int(unsafe.Sizeof(Point{})) {
+			return fmt.Errorf("block too big")
+		}
+		var r *rangeCursor
+		if n := len(m.free); n > 0 {
+			r, m.free = m.free[n-1], m.free[:n-1]
+		} else {
+			r = &rangeCursor{buf: make([]Point, 0, mergeWindow)}
+		}
+		r.off, r.left = rng.off, rng.len/int(unsafe.Sizeof(Point{}))
+		if err := m.fill(r); err != nil {
+			return err
+		}
+		if len(r.buf) == 0 {
+			m.free = append(m.free, r)
+			continue
+		}
+		m.cursors = append(m.cursors, r)
+	}
+	heap.Init(m)
+	return nil
+}
+
+// fill reads the next window of r's range.
+func (m *rangeMerge) fill(r *rangeCursor) error {
+	n := r.left
+	if n > mergeWindow {
+		n = mergeWindow
+	}
+	r.buf, r.i = r.buf[:n], 0
+	if n == 0 {
+		return nil
+	}
+	b := n * int(unsafe.Sizeof(Point{}))
+	s := *(*[]byte)(unsafe.Pointer(&slice{unsafe.Pointer(&r.buf[0]), b, b}))
+	if _, err := m.f.ReadAt(s, r.off); err != nil {
+		return err
+	}
+	r.off += int64(b)
+	r.left -= n
+	return nil
+}
+
+// next returns the least point left in the ranges.
+// There must be one.
+func (m *rangeMerge) next() (Point, error) {
+	r := m.cursors[0]
+	p := r.buf[r.i]
+	r.i++
+	if r.i == len(r.buf) {
+		if err := m.fill(r); err != nil {
+			return p, err
+		}
+		if len(r.buf) == 0 {
+			m.free = append(m.free, heap.Pop(m).(*rangeCursor))
+			return p, nil
+		}
+	}
+	heap.Fix(m, 0)
+	return p, nil
+}
+
+func (m *rangeMerge) Len() int { return len(m.cursors) }
+func (m *rangeMerge) Less(i, j int) bool {
+	p, q := m.cursors[i].buf[m.cursors[i].i], m.cursors[j].buf[m.cursors[j].i]
+	return p.Y < q.Y || (p.Y == q.Y && p.X < q.X)
+}
+func (m *rangeMerge) Swap(i, j int)      { m.cursors[i], m.cursors[j] = m.cursors[j], m.cursors[i] }
+func (m *rangeMerge) Push(x interface{}) { m.cursors = append(m.cursors, x.(*rangeCursor)) }
+func (m *rangeMerge) Pop() interface{} {
+	r := m.cursors[len(m.cursors)-1]
+	m.cursors = m.cursors[:len(m.cursors)-1]
+	return r
+}
+
+// byYX sorts points by y, then x.
+type byYX []Point
+
+func (a byYX) Len() int      { return len(a) }
+func (a byYX) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byYX) Less(i, j int) bool {
+	return a[i].Y < a[j].Y || (a[i].Y == a[j].Y && a[i].X < a[j].X)
 }
 
 type wbuf struct {
-	buf [bufSize]point
+	buf [bufSize]Point
 	n   int
 }
 
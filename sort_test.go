@@ -1,34 +1,38 @@
-package main
+package prominence
 
 import (
+	"errors"
 	"math/rand"
 	"reflect"
 	"testing"
 )
 
-func testSort(t *testing.T, cells []cell) {
-	// sort using cellSort
-	var cells2 []cell
-	r := cellSort(simpleReader(cells))
+func testSort(t *testing.T, cells []Cell) {
+	// sort using CellSort
+	var cells2 []Cell
+	r, errc := CellSort(simpleReader(cells), nil, nil)
 	for cslice := range r {
 		for _, c := range cslice {
 			cells2 = append(cells2, c)
 		}
 	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
 
 	// Check ordering.
 	if len(cells2) != len(cells) {
 		t.Errorf("lengths don't match %d %d", len(cells2), len(cells))
 	}
 	for i := 0; i < len(cells2)-1; i++ {
-		if cells2[i].z < cells2[i+1].z {
+		if cells2[i].Z < cells2[i+1].Z {
 			t.Errorf("bad sort %d %v %v\n", i, cells2[i], cells2[i+1])
 		}
 	}
 
 	// Check to make sure nothing was lost or added.
-	m := map[cell]struct{}{}
-	m2 := map[cell]struct{}{}
+	m := map[Cell]struct{}{}
+	m2 := map[Cell]struct{}{}
 	for _, c := range cells {
 		m[c] = struct{}{}
 	}
@@ -41,29 +45,107 @@ func testSort(t *testing.T, cells []cell) {
 }
 
 func TestCellSort(t *testing.T) {
-	cells := []cell{
-		{point{0, 0}, 5},
-		{point{1, 1}, 3},
-		{point{2, 2}, 7},
-		{point{3, 3}, 2},
-		{point{4, 4}, 8},
-		{point{5, 5}, 2},
-		{point{6, 6}, 1},
-		{point{7, 7}, 2},
-		{point{8, 8}, 7},
-		{point{9, 9}, 9},
+	cells := []Cell{
+		{Point{0, 0}, 5},
+		{Point{1, 1}, 3},
+		{Point{2, 2}, 7},
+		{Point{3, 3}, 2},
+		{Point{4, 4}, 8},
+		{Point{5, 5}, 2},
+		{Point{6, 6}, 1},
+		{Point{7, 7}, 2},
+		{Point{8, 8}, 7},
+		{Point{9, 9}, 9},
 	}
 	testSort(t, cells)
 }
 
 func TestCellSortBig(t *testing.T) {
 	rnd := rand.New(rand.NewSource(127))
-	var cells []cell
+	var cells []Cell
 	for i := 0; i < 100000; i++ {
-		x := coord(rnd.Intn(1000))
-		y := coord(rnd.Intn(1000))
-		z := height(rnd.Intn(100))
-		cells = append(cells, cell{point{x, y}, z})
+		x := Coord(rnd.Intn(1000))
+		y := Coord(rnd.Intn(1000))
+		z := Height(rnd.Intn(100))
+		cells = append(cells, Cell{Point{x, y}, z})
 	}
 	testSort(t, cells)
 }
+
+func TestCellSortTies(t *testing.T) {
+	// Equal-altitude cells come out in (y, x) order, for any P.
+	rnd := rand.New(rand.NewSource(5))
+	var cells []Cell
+	for i := 0; i < 10000; i++ {
+		x := Coord(rnd.Intn(1000))
+		y := Coord(rnd.Intn(1000))
+		z := Height(rnd.Intn(10))
+		cells = append(cells, Cell{Point{x, y}, z})
+	}
+	var first []Cell
+	for _, p := range []int{1, 2, 3, 8} {
+		var got []Cell
+		r, errc := CellSort(simpleReader(cells), nil, &Options{P: p})
+		for cslice := range r {
+			got = append(got, cslice...)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(got)-1; i++ {
+			a, b := got[i], got[i+1]
+			if a.Z == b.Z && (a.P.Y > b.P.Y || a.P.Y == b.P.Y && a.P.X > b.P.X) {
+				t.Errorf("P=%d: bad tie order %d %v %v", p, i, a, b)
+				break
+			}
+		}
+		if first == nil {
+			first = got
+		} else if !reflect.DeepEqual(got, first) {
+			t.Errorf("P=%d: order differs from P=1", p)
+		}
+	}
+}
+
+func TestCellSortMerge(t *testing.T) {
+	// More cells of one altitude than fit in a buffer are
+	// written as several sorted ranges, and merged.
+	rnd := rand.New(rand.NewSource(9))
+	var cells []Cell
+	for i := 0; i < 3*bufSize+17; i++ {
+		x := Coord(rnd.Intn(1000))
+		y := Coord(rnd.Intn(1000))
+		cells = append(cells, Cell{Point{x, y}, Height(i % 2)})
+	}
+	r, errc := CellSort(simpleReader(cells), nil, nil)
+	var got []Cell
+	for cslice := range r {
+		got = append(got, cslice...)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(cells) {
+		t.Fatalf("want %d cells, got %d", len(cells), len(got))
+	}
+	for i := 0; i < len(got)-1; i++ {
+		a, b := got[i], got[i+1]
+		if a.Z < b.Z || a.Z == b.Z && (a.P.Y > b.P.Y || a.P.Y == b.P.Y && a.P.X > b.P.X) {
+			t.Fatalf("bad order at %d: %v %v", i, a, b)
+		}
+	}
+}
+
+func TestCellSortReaderError(t *testing.T) {
+	// A reader which fails partway through.
+	bad := errors.New("bad input")
+	rerr := make(chan error, 1)
+	rerr <- bad
+	r, errc := CellSort(simpleReader([]Cell{{Point{0, 0}, 1}, {Point{1, 0}, 2}}), rerr, nil)
+	for cslice := range r {
+		t.Errorf("got cells %v from a failed sort", cslice)
+	}
+	if err := <-errc; err != bad {
+		t.Errorf("want error %v, got %v", bad, err)
+	}
+}
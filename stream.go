@@ -1,51 +1,128 @@
-package main
+package prominence
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"io/ioutil"
 	"math"
 )
 
 // Stream importer.  Used to import data from sources which are
-// hard to generate from Go.
+// hard to generate from Go.  WriteStream writes any data set in
+// this format, to cache or crop it, in either layout.
 
-// Stream format:
+// Stream format, version 1:
 //   minx, maxx, miny, maxy, minz, maxz: 32-bit signed little-endian
 //   scalex, offsetx, scaley, offsety, scalez, offsetz: 64-bit float little-endian
 //   [x y z]*n: 32-bit signed little-endian samples
+//
+// Stream format, version 2 (all values little-endian):
+//   magic: the 8 bytes "promstrm"
+//   version: 32-bit unsigned, 2
+//   minx, maxx, miny, maxy, minz, maxz: 32-bit signed
+//   scalex, offsetx, scaley, offsety, scalez, offsetz: 64-bit float
+//   compression: 8-bit, 0 = none, 1 = gzip
+//   layout: 8-bit, 0 = xyz triples, 1 = dense grid
+//   flags: 8-bit, bit 0 set if nodata is used
+//   reserved: 8-bit, 0
+//   nodata: 32-bit signed, heights of missing grid samples
+//   checksum: 32-bit CRC-32 (IEEE) of all the header bytes above
+// The rest of the stream is compressed as a whole if compression
+// is not 0, and is a sequence of blocks:
+//   length: 32-bit unsigned, the number of payload bytes (at most 64MB)
+//   payload
+//   checksum: 32-bit CRC-32 (IEEE) of payload
+// ending with a block of length 0 (with no payload or checksum).
+// A compressed body ends with the end block.
+// Payloads hold 32-bit signed samples.  For the xyz layout, they are
+// x y z triples, as for version 1.  For the grid layout they are
+// heights, in rows from miny to maxy-1, each row from minx to maxx-1.
+// A sample may be split across blocks.  Grid samples equal to nodata
+// (if used) are missing.
+//
+// There is no zstd compression.  The standard library has no zstd
+// package, and this package depends on nothing outside it; gzip is
+// the only compression until that changes.  Code 2 is left for zstd.
 
-type stream struct {
+const streamMagic = "promstrm"
+
+const (
+	streamHeaderSize = len(streamMagic) + 4 + 6*4 + 6*8 + 4 + 4 + 4
+	streamMaxBlock   = 64 << 20
+)
+
+// Stream compressions.
+const (
+	streamNone = 0
+	streamGzip = 1
+)
+
+// streamNodata is the nodata height WriteStream uses for grids.
+const streamNodata = math.MinInt32
+
+// Stream layouts.
+const (
+	streamXYZ  = 0
+	streamGrid = 1
+)
+
+// A Stream is a DataSet read in the stream format.
+// It can only be read once.
+type Stream struct {
 	r io.Reader     // underlying reader
 	b *bufio.Reader // buffered wrapper
 
-	minx, maxx, miny, maxy                            coord
-	minz, maxz                                        height
+	version                                           int
+	minx, maxx, miny, maxy                            Coord
+	minz, maxz                                        Height
 	scalex, offsetx, scaley, offsety, scalez, offsetz float64
 
+	// Version 2 only.
+	layout    int
+	nodata    Height
+	hasNodata bool
+	body      io.Reader // blocks, decompressed
+	gzipped   bool
+
 	reader bool
 }
 
-func (s *stream) Init() {
+// NewStream returns a Stream which reads from r.
+func NewStream(r io.Reader) *Stream {
+	return &Stream{r: r}
+}
+
+func (s *Stream) Init() error {
 	s.b = bufio.NewReader(s.r)
+	if m, err := s.b.Peek(len(streamMagic)); err == nil && string(m) == streamMagic {
+		return s.readHeader2()
+	}
+	s.version = 1
 
 	// read header
 	var b [6*4 + 6*8]byte
-	n, err := s.b.Read(b[:])
-	if err != nil {
-		log.Fatal(err)
-	}
-	if n != len(b) {
-		log.Fatal("not enough header")
+	if _, err := io.ReadFull(s.b, b[:]); err != nil {
+		return fmt.Errorf("reading stream header: %v", err)
 	}
+	s.setBounds(b[:])
+	return nil
+}
+
+// setBounds sets the bounds and coordinate mapping from b,
+// which is in the layout common to both versions.
+func (s *Stream) setBounds(b []byte) {
 	bo := binary.LittleEndian
-	s.minx = coord(bo.Uint32(b[0:4]))
-	s.maxx = coord(bo.Uint32(b[4:8]))
-	s.miny = coord(bo.Uint32(b[8:12]))
-	s.maxy = coord(bo.Uint32(b[12:16]))
-	s.minz = height(bo.Uint32(b[16:20]))
-	s.maxz = height(bo.Uint32(b[20:24]))
+	s.minx = Coord(bo.Uint32(b[0:4]))
+	s.maxx = Coord(bo.Uint32(b[4:8]))
+	s.miny = Coord(bo.Uint32(b[8:12]))
+	s.maxy = Coord(bo.Uint32(b[12:16]))
+	s.minz = Height(bo.Uint32(b[16:20]))
+	s.maxz = Height(bo.Uint32(b[20:24]))
 	s.scalex = math.Float64frombits(bo.Uint64(b[24:32]))
 	s.offsetx = math.Float64frombits(bo.Uint64(b[32:40]))
 	s.scaley = math.Float64frombits(bo.Uint64(b[40:48]))
@@ -54,54 +131,351 @@ func (s *stream) Init() {
 	s.offsetz = math.Float64frombits(bo.Uint64(b[64:72]))
 }
 
-func (s *stream) Bounds() (minx, maxx coord, miny, maxy coord, minz, maxz height) {
+// readHeader2 reads a version 2 header.
+func (s *Stream) readHeader2() error {
+	var b [streamHeaderSize]byte
+	if _, err := io.ReadFull(s.b, b[:]); err != nil {
+		return fmt.Errorf("reading stream header: %v", err)
+	}
+	bo := binary.LittleEndian
+	n := len(b) - 4
+	if crc32.ChecksumIEEE(b[:n]) != bo.Uint32(b[n:]) {
+		return fmt.Errorf("stream header checksum mismatch")
+	}
+	h := b[len(streamMagic):]
+	if v := bo.Uint32(h); v != 2 {
+		return fmt.Errorf("unknown stream version %d", v)
+	}
+	s.version = 2
+	h = h[4:]
+	s.setBounds(h)
+	h = h[6*4+6*8:]
+	compression, layout, flags := h[0], h[1], h[2]
+	s.nodata = Height(bo.Uint32(h[4:]))
+	s.hasNodata = flags&1 != 0
+
+	switch layout {
+	case streamXYZ:
+	case streamGrid:
+		if s.maxx <= s.minx || s.maxy <= s.miny {
+			return fmt.Errorf("empty stream grid")
+		}
+	default:
+		return fmt.Errorf("unknown stream layout %d", layout)
+	}
+	s.layout = int(layout)
+
+	switch compression {
+	case streamNone:
+		s.body = s.b
+	case streamGzip:
+		z, err := gzip.NewReader(s.b)
+		if err != nil {
+			return fmt.Errorf("reading stream: %v", err)
+		}
+		s.body = bufio.NewReader(z)
+		s.gzipped = true
+	default:
+		return fmt.Errorf("unknown stream compression %d", compression)
+	}
+	return nil
+}
+
+func (s *Stream) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
 	return s.minx, s.maxx, s.miny, s.maxy, s.minz, s.maxz
 }
 
-func (s *stream) Pos(c cell) (lat, long, height float64) {
-	return float64(c.p.x)*s.scalex + s.offsetx,
-		float64(c.p.y)*s.scaley + s.offsety,
-		float64(c.z)*s.scalez + s.offsetz
+func (s *Stream) Pos(c Cell) (long, lat, height float64) {
+	return float64(c.P.X)*s.scalex + s.offsetx,
+		float64(c.P.Y)*s.scaley + s.offsety,
+		float64(c.Z)*s.scalez + s.offsetz
 }
 
-func (s *stream) Reader() <-chan []cell {
+func (s *Stream) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	c := make(chan []Cell, workers)
+	errc := make(chan error, 1)
 	if s.reader {
-		panic("can't reuse stream reader")
+		close(c)
+		errc <- fmt.Errorf("can't reuse stream reader")
+		return c, errc
 	}
 	s.reader = true
 
-	c := make(chan []cell, *P)
 	go func() {
-		var chunker cellChunker
-		chunker.c = c
-		bo := binary.LittleEndian
-		var b [12]byte
-		for {
-			cnt := 0
-			for {
-				n, err := s.b.Read(b[cnt:])
-				if err == io.EOF {
-					if cnt != 0 {
-						log.Fatalf("not enough data %d", n)
-					}
-					// no more data
-					chunker.flush()
-					close(c)
-					return
+		defer close(c)
+		if s.version == 1 {
+			errc <- s.read(c, done)
+		} else {
+			errc <- s.read2(c, done)
+		}
+	}()
+	return c, errc
+}
+
+// read sends the samples in a version 1 stream to c.
+func (s *Stream) read(c chan<- []Cell, done <-chan struct{}) error {
+	chunker := cellChunker{c: c, done: done}
+	bo := binary.LittleEndian
+	var b [12]byte
+	for {
+		n, err := io.ReadFull(s.b, b[:])
+		if err == io.EOF {
+			// no more data
+			if !chunker.flush() {
+				return errCanceled
+			}
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("not enough data %d", n)
+		}
+		if err != nil {
+			return err
+		}
+		x := Coord(bo.Uint32(b[0:4]))
+		y := Coord(bo.Uint32(b[4:8]))
+		z := Height(bo.Uint32(b[8:12]))
+		if !chunker.send(Cell{Point{x, y}, z}) {
+			return errCanceled
+		}
+	}
+}
+
+// read2 sends the samples in a version 2 stream to c.
+func (s *Stream) read2(c chan<- []Cell, done <-chan struct{}) error {
+	chunker := cellChunker{c: c, done: done}
+	bo := binary.LittleEndian
+	w := int64(s.maxx - s.minx)
+	size := w * int64(s.maxy-s.miny) // grid samples
+
+	var buf []byte  // current block
+	var part []byte // partial sample left from the previous block
+	var n int64     // samples seen so far
+	for blk := 0; ; blk++ {
+		var b [4]byte
+		if _, err := io.ReadFull(s.body, b[:]); err != nil {
+			return fmt.Errorf("stream block %d: truncated (%v)", blk, err)
+		}
+		k := bo.Uint32(b[:])
+		if k == 0 {
+			break
+		}
+		if k > streamMaxBlock {
+			return fmt.Errorf("stream block %d: too big (%d bytes)", blk, k)
+		}
+		buf = append(buf[:0], part...)
+		buf = append(buf, make([]byte, k+4)...)
+		payload := buf[len(part) : len(buf)-4]
+		if _, err := io.ReadFull(s.body, buf[len(part):]); err != nil {
+			return fmt.Errorf("stream block %d: truncated (%v)", blk, err)
+		}
+		if crc32.ChecksumIEEE(payload) != bo.Uint32(buf[len(buf)-4:]) {
+			return fmt.Errorf("stream block %d: checksum mismatch", blk)
+		}
+		data := buf[:len(buf)-4]
+
+		if s.layout == streamXYZ {
+			for ; len(data) >= 12; data = data[12:] {
+				x := Coord(bo.Uint32(data[0:4]))
+				y := Coord(bo.Uint32(data[4:8]))
+				z := Height(bo.Uint32(data[8:12]))
+				if !chunker.send(Cell{Point{x, y}, z}) {
+					return errCanceled
 				}
-				if err != nil {
-					log.Fatal(err)
+			}
+		} else {
+			for ; len(data) >= 4; data = data[4:] {
+				if n == size {
+					return fmt.Errorf("stream block %d: more than %d grid samples", blk, size)
+				}
+				z := Height(bo.Uint32(data))
+				p := Point{s.minx + Coord(n%w), s.miny + Coord(n/w)}
+				n++
+				if s.hasNodata && z == s.nodata {
+					continue
 				}
-				cnt += n
-				if cnt == len(b) {
-					break
+				if !chunker.send(Cell{p, z}) {
+					return errCanceled
 				}
 			}
-			x := coord(bo.Uint32(b[0:4]))
-			y := coord(bo.Uint32(b[4:8]))
-			z := height(bo.Uint32(b[8:12]))
-			chunker.send(cell{point{x, y}, z})
 		}
-	}()
-	return c
+		part = append(part[:0], data...)
+	}
+	if len(part) != 0 {
+		return fmt.Errorf("stream ends in a partial sample")
+	}
+	if s.layout == streamGrid && n != size {
+		return fmt.Errorf("stream has %d grid samples, want %d", n, size)
+	}
+	if s.gzipped {
+		// Read to the end of the gzip data, so its trailer
+		// (length and checksum) is checked too.
+		k, err := io.Copy(ioutil.Discard, s.body)
+		if err != nil {
+			return fmt.Errorf("stream: %v", err)
+		}
+		if k != 0 {
+			return fmt.Errorf("stream has %d bytes after the end block", k)
+		}
+	}
+	if !chunker.flush() {
+		return errCanceled
+	}
+	return nil
+}
+
+// StreamOptions are the options of WriteStream.
+type StreamOptions struct {
+	// Gzip compresses the stream.
+	Gzip bool
+	// Grid writes the grid layout instead of xyz triples.  The whole
+	// grid is held in memory, 4 bytes a sample, so it suits data
+	// sets which are dense and not too big.
+	Grid bool
+}
+
+// WriteStream writes the samples of d, which must be initialized,
+// to w as a version 2 stream.  opts may be nil, for xyz triples
+// without compression.  If box is not nil, only the samples within
+// box are written, and the bounds are cropped to match.
+func WriteStream(w io.Writer, d DataSet, box *Box, opts *StreamOptions) error {
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+	minx, maxx, miny, maxy, minz, maxz := d.Bounds()
+	x0, y0, z0 := d.Pos(Cell{})
+	x1, y1, z1 := d.Pos(Cell{Point{1, 1}, 1})
+	if box != nil {
+		// Invert the (affine) coordinate mapping for the box corners,
+		// and keep the samples whose centers are in the box.
+		ax := (box.MinLong - x0) / (x1 - x0)
+		bx := (box.MaxLong - x0) / (x1 - x0)
+		ay := (box.MinLat - y0) / (y1 - y0)
+		by := (box.MaxLat - y0) / (y1 - y0)
+		lox, hix := Coord(math.Ceil(math.Min(ax, bx))), Coord(math.Floor(math.Max(ax, bx)))
+		loy, hiy := Coord(math.Ceil(math.Min(ay, by))), Coord(math.Floor(math.Max(ay, by)))
+		if lox > minx || hix < maxx-1 {
+			if lox > minx {
+				minx = lox
+			}
+			if hix < maxx-1 {
+				maxx = hix + 1
+			}
+			maxx++ // an empty column, so we don't wrap around
+		}
+		if loy > miny {
+			miny = loy
+		}
+		if hiy < maxy-1 {
+			maxy = hiy + 1
+		}
+		if minx >= maxx || miny >= maxy {
+			return fmt.Errorf("crop box %v contains no samples", *box)
+		}
+	}
+
+	// Header.
+	var h bytes.Buffer
+	bo := binary.LittleEndian
+	h.WriteString(streamMagic)
+	binary.Write(&h, bo, uint32(2))
+	binary.Write(&h, bo, [6]int32{int32(minx), int32(maxx), int32(miny), int32(maxy), int32(minz), int32(maxz)})
+	binary.Write(&h, bo, [6]float64{x1 - x0, x0, y1 - y0, y0, z1 - z0, z0})
+	compression := byte(streamNone)
+	if opts.Gzip {
+		compression = streamGzip
+	}
+	var grid []int32
+	if opts.Grid {
+		// Missing samples are nodata, which no height is.
+		grid = make([]int32, int(maxx-minx)*int(maxy-miny))
+		for i := range grid {
+			grid[i] = streamNodata
+		}
+		h.Write([]byte{compression, streamGrid, 1, 0})
+		binary.Write(&h, bo, int32(streamNodata))
+	} else {
+		h.Write([]byte{compression, streamXYZ, 0, 0})
+		binary.Write(&h, bo, int32(0)) // nodata
+	}
+	binary.Write(&h, bo, crc32.ChecksumIEEE(h.Bytes()))
+	bw := bufio.NewWriter(w)
+	bw.Write(h.Bytes())
+
+	// Body.
+	var z *gzip.Writer
+	body := io.Writer(bw)
+	if opts.Gzip {
+		z = gzip.NewWriter(bw)
+		body = z
+	}
+	var blk []byte
+	var werr error
+	writeBlock := func() {
+		if werr != nil {
+			return
+		}
+		var b [4]byte
+		bo.PutUint32(b[:], uint32(len(blk)))
+		body.Write(b[:])
+		if len(blk) > 0 {
+			body.Write(blk)
+			bo.PutUint32(b[:], crc32.ChecksumIEEE(blk))
+			_, werr = body.Write(b[:])
+		}
+		blk = blk[:0]
+	}
+
+	done := make(chan struct{})
+	r, rerr := d.Reader(done)
+	for cslice := range r {
+		for _, c := range cslice {
+			if c.P.X < minx || c.P.X >= maxx || c.P.Y < miny || c.P.Y >= maxy {
+				continue
+			}
+			if grid != nil {
+				grid[int(c.P.Y-miny)*int(maxx-minx)+int(c.P.X-minx)] = int32(c.Z)
+				continue
+			}
+			var b [12]byte
+			bo.PutUint32(b[0:], uint32(c.P.X))
+			bo.PutUint32(b[4:], uint32(c.P.Y))
+			bo.PutUint32(b[8:], uint32(c.Z))
+			blk = append(blk, b[:]...)
+			if len(blk) >= 1<<20 {
+				writeBlock()
+			}
+		}
+		if werr != nil {
+			close(done)
+			for range r {
+			}
+			<-rerr
+			return werr
+		}
+	}
+	if err := <-rerr; err != nil {
+		return err
+	}
+	for _, z := range grid {
+		var b [4]byte
+		bo.PutUint32(b[:], uint32(z))
+		blk = append(blk, b[:]...)
+		if len(blk) >= 1<<20 {
+			writeBlock()
+		}
+	}
+	if len(blk) > 0 {
+		writeBlock()
+	}
+	writeBlock() // end block
+	if werr != nil {
+		return werr
+	}
+	if z != nil {
+		if err := z.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
 }
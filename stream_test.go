@@ -0,0 +1,240 @@
+package prominence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// streamHeader returns a stream header (the part common to both
+// versions) for bounds [0,4)x[0,3) and heights in decimeters.
+func streamHeader() []byte {
+	var b bytes.Buffer
+	bo := binary.LittleEndian
+	binary.Write(&b, bo, []int32{0, 4, 0, 3, -100, 1000})
+	binary.Write(&b, bo, []float64{0.5, 10, -0.5, 48, 0.1, 0})
+	return b.Bytes()
+}
+
+// stream2 builds a version 2 stream with the given samples,
+// split into blocks of at most blockSize bytes.
+func stream2(compression, layout byte, nodata *int32, samples []int32, blockSize int) []byte {
+	var b bytes.Buffer
+	bo := binary.LittleEndian
+	b.WriteString(streamMagic)
+	binary.Write(&b, bo, uint32(2))
+	b.Write(streamHeader())
+	var flags byte
+	var nd int32
+	if nodata != nil {
+		flags, nd = 1, *nodata
+	}
+	b.Write([]byte{compression, layout, flags, 0})
+	binary.Write(&b, bo, nd)
+	binary.Write(&b, bo, crc32.ChecksumIEEE(b.Bytes()))
+
+	var body bytes.Buffer
+	var data bytes.Buffer
+	binary.Write(&data, bo, samples)
+	for p := data.Bytes(); len(p) > 0; {
+		n := blockSize
+		if n > len(p) {
+			n = len(p)
+		}
+		binary.Write(&body, bo, uint32(n))
+		body.Write(p[:n])
+		binary.Write(&body, bo, crc32.ChecksumIEEE(p[:n]))
+		p = p[n:]
+	}
+	binary.Write(&body, bo, uint32(0))
+
+	if compression == streamGzip {
+		z := gzip.NewWriter(&b)
+		z.Write(body.Bytes())
+		z.Close()
+	} else {
+		b.Write(body.Bytes())
+	}
+	return b.Bytes()
+}
+
+// readStream reads all of the samples in stream b.
+func readStream(b []byte) (map[Point]Height, *Stream, error) {
+	s := NewStream(bytes.NewReader(b))
+	if err := s.Init(); err != nil {
+		return nil, nil, err
+	}
+	r, errc := s.Reader(nil)
+	got := map[Point]Height{}
+	for cslice := range r {
+		for _, c := range cslice {
+			got[c.P] = c.Z
+		}
+	}
+	return got, s, <-errc
+}
+
+func TestStream(t *testing.T) {
+	xyz := []int32{0, 0, 5, 3, 2, 70, 1, 1, -3}
+	wantXYZ := map[Point]Height{{0, 0}: 5, {3, 2}: 70, {1, 1}: -3}
+	nodata := int32(-9999)
+	grid := []int32{
+		1, 2, 3, 4,
+		5, -9999, 7, 8,
+		9, 10, 11, 12,
+	}
+	wantGrid := map[Point]Height{}
+	for i, z := range grid {
+		if z != nodata {
+			wantGrid[Point{Coord(i % 4), Coord(i / 4)}] = Height(z)
+		}
+	}
+	var v1 bytes.Buffer
+	v1.Write(streamHeader())
+	binary.Write(&v1, binary.LittleEndian, xyz)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want map[Point]Height
+	}{
+		{"v1", v1.Bytes(), wantXYZ},
+		{"v2 xyz", stream2(streamNone, streamXYZ, nil, xyz, 12), wantXYZ},
+		{"v2 xyz split samples", stream2(streamNone, streamXYZ, nil, xyz, 7), wantXYZ},
+		{"v2 grid gzip", stream2(streamGzip, streamGrid, &nodata, grid, 16), wantGrid},
+	} {
+		got, s, err := readStream(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: want %d samples, got %d", test.name, len(test.want), len(got))
+		}
+		for p, z := range test.want {
+			if got[p] != z {
+				t.Errorf("%s: %v: want %d, got %d", test.name, p, z, got[p])
+			}
+		}
+		if long, lat, z := s.Pos(Cell{Point{2, 2}, 15}); long != 11 || lat != 47 || z != 1.5 {
+			t.Errorf("%s: bad position %f %f %f", test.name, long, lat, z)
+		}
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	good := stream2(streamNone, streamGrid, nil, make([]int32, 12), 16)
+	corrupt := func(i int) []byte {
+		b := append([]byte(nil), good...)
+		b[i] ^= 1
+		return b
+	}
+	// gzipCorrupt corrupts byte i of the 8-byte gzip trailer.
+	gzipped := stream2(streamGzip, streamGrid, nil, make([]int32, 12), 16)
+	gzipCorrupt := func(i int) []byte {
+		b := append([]byte(nil), gzipped...)
+		b[len(b)-8+i] ^= 1
+		return b
+	}
+	// stream2Extra has extra compressed data after the end block.
+	stream2Extra := func(extra []byte) []byte {
+		var b bytes.Buffer
+		b.Write(gzipped[:streamHeaderSize])
+		z, err := gzip.NewReader(bytes.NewReader(gzipped[streamHeaderSize:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := gzip.NewWriter(&b)
+		w.Write(body)
+		w.Write(extra)
+		w.Close()
+		return b.Bytes()
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"header checksum", corrupt(20), "header checksum"},
+		{"block checksum", corrupt(streamHeaderSize + 6), "block 0: checksum"},
+		{"truncated", good[:len(good)-3], "block 3: truncated"},
+		{"short grid", stream2(streamNone, streamGrid, nil, make([]int32, 11), 16), "11 grid samples"},
+		{"compression", stream2(2, streamGrid, nil, nil, 16), "unknown stream compression 2"},
+		{"gzip trailer", gzipCorrupt(0), "gzip: invalid checksum"},
+		{"gzip length", gzipCorrupt(4), "gzip: invalid checksum"},
+		{"after end block", stream2Extra([]byte{1, 2, 3}), "3 bytes after the end block"},
+	} {
+		_, _, err := readStream(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: want error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	dir := tempFiles(t, map[string][]byte{"dem.asc": []byte(
+		"ncols 4\nnrows 3\nxllcorner 10\nyllcorner 47\ncellsize 0.5\nNODATA_value -9999\n" +
+			"1 2 3 4\n" +
+			"5 -9999 7 8\n" +
+			"9 10 11 12\n")})
+	defer os.RemoveAll(dir)
+	g := NewASCIIGrid(filepath.Join(dir, "dem.asc"))
+	all := readDataSet(t, g)
+
+	for _, test := range []struct {
+		box                    *Box
+		minx, maxx, miny, maxy Coord
+	}{
+		{nil, 0, 5, 0, 3},
+		{&Box{10.5, 47.5, 11.5, 48.5}, 1, 4, 0, 2},
+	} {
+		for _, opts := range []StreamOptions{{}, {Gzip: true}, {Grid: true}, {Gzip: true, Grid: true}} {
+			var b bytes.Buffer
+			if err := WriteStream(&b, g, test.box, &opts); err != nil {
+				t.Fatal(err)
+			}
+			if layout := b.Bytes()[len(streamMagic)+4+6*4+6*8+1]; opts.Grid != (layout == streamGrid) {
+				t.Errorf("box %v, %+v: layout %d", test.box, opts, layout)
+			}
+			got, s, err := readStream(b.Bytes())
+			if err != nil {
+				t.Fatalf("box %v, %+v: %v", test.box, opts, err)
+			}
+			minx, maxx, miny, maxy, _, _ := s.Bounds()
+			if minx != test.minx || maxx != test.maxx || miny != test.miny || maxy != test.maxy {
+				t.Errorf("box %v: bad bounds %d %d %d %d", test.box, minx, maxx, miny, maxy)
+			}
+			n := 0
+			for p, z := range all {
+				if p.X < minx || p.X >= maxx || p.Y < miny || p.Y >= maxy {
+					continue
+				}
+				n++
+				if got[p] != z {
+					t.Errorf("box %v: %v: want %d, got %d", test.box, p, z, got[p])
+				}
+			}
+			if len(got) != n {
+				t.Errorf("box %v: want %d samples, got %d", test.box, n, len(got))
+			}
+			for _, c := range []Cell{{Point{1, 2}, 15}, {Point{3, 0}, -20}} {
+				x0, y0, z0 := g.Pos(c)
+				x1, y1, z1 := s.Pos(c)
+				if math.Abs(x0-x1) > 1e-9 || math.Abs(y0-y1) > 1e-9 || math.Abs(z0-z1) > 1e-9 {
+					t.Errorf("%v: want position %f %f %f, got %f %f %f", c, x0, y0, z0, x1, y1, z1)
+				}
+			}
+		}
+	}
+}
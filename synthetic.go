@@ -0,0 +1,177 @@
+package prominence
+
+import (
+	"math"
+	"sync"
+)
+
+// Synthetic terrain, for benchmarks and tests at any size without
+// downloading a DEM.
+//
+// Heights are fractal (Perlin) noise: octaves of gradient noise, each
+// at half the wavelength and half the amplitude of the one before.
+// The gradients come from hashing the lattice points with the seed,
+// so each sample is computed independently of the others, and the
+// terrain is the same no matter how it is generated or how big it is.
+// Samples at or below sea level are ocean and are omitted.
+//
+// Where a second, smoother noise field is high, heights are rounded
+// up to multiples of a terrace step, making flat plateaus.  The
+// plateau frequency is roughly the fraction of the terrain terraced.
+//
+// Samples are 3 arc-seconds apart (or closer, if needed to fit the
+// globe), centered on long 0, lat 0.  Heights are in meters.
+
+const (
+	syntheticAmplitude  = 4000 // meters, roughly the highest peak
+	syntheticWavelength = 512  // samples, of the lowest octave
+	syntheticTerrace    = 25   // meters, the terrace step
+)
+
+// A Synthetic is a DataSet of generated terrain.
+type Synthetic struct {
+	seed          uint64
+	width, length int
+	sea           Height
+	plateau       float64
+	scale         float64 // degrees per sample
+}
+
+// NewSynthetic returns width by length samples of terrain generated
+// from seed.  Samples at or below seaLevel (meters) are omitted.
+// plateaus, from 0 to 1, is the fraction of the terrain which is
+// terraced into plateaus.
+func NewSynthetic(seed int64, width, length int, seaLevel Height, plateaus float64) *Synthetic {
+	s := &Synthetic{seed: uint64(seed), width: width, length: length, sea: seaLevel, plateau: plateaus}
+	s.scale = 1.0 / 1200
+	if w := 360 / float64(width); w < s.scale {
+		s.scale = w
+	}
+	if l := 180 / float64(length); l < s.scale {
+		s.scale = l
+	}
+	return s
+}
+
+func (s *Synthetic) Init() error {
+	return nil
+}
+
+func (s *Synthetic) Bounds() (minx, maxx Coord, miny, maxy Coord, minz, maxz Height) {
+	// Add an empty column so we don't wrap around.
+	return 0, Coord(s.width) + 1, 0, Coord(s.length), s.sea, syntheticAmplitude + 1
+}
+
+func (s *Synthetic) Pos(c Cell) (long, lat, height float64) {
+	return (float64(c.P.X) - float64(s.width)/2) * s.scale,
+		(float64(s.length)/2 - float64(c.P.Y)) * s.scale,
+		float64(c.Z)
+}
+
+// At returns the height of the sample at x, y, in meters,
+// including samples at or below sea level.
+func (s *Synthetic) At(x, y int) Height {
+	fx, fy := float64(x), float64(y)
+	z := 0.0
+	amp := 0.5
+	for w := float64(syntheticWavelength); w >= 2; w /= 2 {
+		z += amp * s.noise(fx/w, fy/w, uint64(w))
+		amp /= 2
+	}
+	h := syntheticAmplitude * z // z is roughly in [-1, 1]
+	if s.plateau > 0 && s.noise(fx/(4*syntheticWavelength), fy/(4*syntheticWavelength), 1) > 0.5-s.plateau {
+		h = math.Ceil(h/syntheticTerrace) * syntheticTerrace
+	}
+	if h > syntheticAmplitude {
+		h = syntheticAmplitude
+	}
+	return Height(math.Floor(h))
+}
+
+// noise returns Perlin gradient noise at x, y, in roughly [-0.7, 0.7].
+// octave distinguishes the noise fields.
+func (s *Synthetic) noise(x, y float64, octave uint64) float64 {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	dx, dy := x-x0, y-y0
+	ix, iy := int64(x0), int64(y0)
+	grad := func(i, j int64, dx, dy float64) float64 {
+		h := s.seed*0x9e3779b97f4a7c15 ^ uint64(i)*0xbf58476d1ce4e5b9 ^ uint64(j)*0x94d049bb133111eb ^ octave*0xd6e8feb86659fd93
+		h ^= h >> 31
+		h *= 0x7fb5d329728ea185
+		h ^= h >> 27
+		g := &perlinGrads[h>>60]
+		return g[0]*dx + g[1]*dy
+	}
+	fade := func(t float64) float64 { return t * t * t * (t*(t*6-15) + 10) }
+	u, v := fade(dx), fade(dy)
+	n00 := grad(ix, iy, dx, dy)
+	n10 := grad(ix+1, iy, dx-1, dy)
+	n01 := grad(ix, iy+1, dx, dy-1)
+	n11 := grad(ix+1, iy+1, dx-1, dy-1)
+	a := n00 + u*(n10-n00)
+	b := n01 + u*(n11-n01)
+	return a + v*(b-a)
+}
+
+// perlinGrads are the gradients of the noise: 16 unit vectors.
+var perlinGrads [16][2]float64
+
+func init() {
+	for i := range perlinGrads {
+		a := (float64(i) + 0.5) * math.Pi / 8
+		perlinGrads[i] = [2]float64{math.Cos(a), math.Sin(a)}
+	}
+}
+
+func (s *Synthetic) Reader(done <-chan struct{}) (<-chan []Cell, <-chan error) {
+	// Rows to be generated.
+	work := make(chan int)
+	go func() {
+		defer close(work)
+		for y := 0; y < s.length; y++ {
+			select {
+			case work <- y:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Return channel
+	c := make(chan []Cell, workers)
+	errc := make(chan error, 1)
+
+	// Use several workers to generate the rows.
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			chunker := cellChunker{c: c, done: done}
+			for y := range work {
+				for x := 0; x < s.width; x++ {
+					z := s.At(x, y)
+					if z <= s.sea {
+						continue // ocean
+					}
+					if !chunker.send(Cell{Point{Coord(x), Coord(y)}, z}) {
+						return
+					}
+				}
+			}
+			chunker.flush()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		var err error
+		select {
+		case <-done:
+			err = errCanceled // workers may have stopped early
+		default:
+		}
+		errc <- err
+		close(c)
+	}()
+	return c, errc
+}
@@ -0,0 +1,127 @@
+package prominence
+
+import (
+	"testing"
+)
+
+// readSynthetic returns the samples of s, and how many there are.
+func readSynthetic(t testing.TB, s *Synthetic) (map[Point]Height, int) {
+	r, errc := s.Reader(nil)
+	got := map[Point]Height{}
+	n := 0
+	for cslice := range r {
+		for _, c := range cslice {
+			got[c.P] = c.Z
+			n++
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return got, n
+}
+
+func TestSynthetic(t *testing.T) {
+	defer func(n int) { workers = n }(workers)
+	const w, h = 300, 200
+	workers = 1
+	want, n := readSynthetic(t, NewSynthetic(1, w, h, 0, 0))
+	if n != len(want) {
+		t.Errorf("%d samples reported, but only %d are distinct", n, len(want))
+	}
+	if n == 0 || n == w*h {
+		t.Errorf("%d of %d samples are land", n, w*h)
+	}
+	for p, z := range want {
+		if z <= 0 {
+			t.Errorf("%v: ocean sample %d reported", p, z)
+		}
+		if p.X < 0 || p.X >= w || p.Y < 0 || p.Y >= h {
+			t.Errorf("%v: out of bounds", p)
+		}
+	}
+
+	// Same terrain no matter how many workers generate it.
+	workers = 5
+	got, _ := readSynthetic(t, NewSynthetic(1, w, h, 0, 0))
+	if len(got) != len(want) {
+		t.Errorf("5 workers: want %d samples, got %d", len(want), len(got))
+	}
+	for p, z := range want {
+		if got[p] != z {
+			t.Errorf("5 workers: %v: want %d, got %d", p, z, got[p])
+			break
+		}
+	}
+
+	// A different seed is different terrain.
+	got, _ = readSynthetic(t, NewSynthetic(2, w, h, 0, 0))
+	same := 0
+	for p, z := range want {
+		if got[p] == z {
+			same++
+		}
+	}
+	if same > len(want)/10 {
+		t.Errorf("seeds 1 and 2 share %d of %d samples", same, len(want))
+	}
+
+	// Plateaus make lots of neighbors with the same height.
+	flat := func(m map[Point]Height) int {
+		k := 0
+		for p, z := range m {
+			if m[Point{p.X + 1, p.Y}] == z {
+				k++
+			}
+		}
+		return k
+	}
+	terraced, _ := readSynthetic(t, NewSynthetic(1, w, h, 0, 1))
+	if a, b := flat(want), flat(terraced); b < 2*a {
+		t.Errorf("plateaus: %d flat neighbors, %d without plateaus", b, a)
+	}
+}
+
+func TestSyntheticProminence(t *testing.T) {
+	s := NewSynthetic(3, 200, 200, 100, 0.3)
+	minx, maxx, _, _, _, _ := s.Bounds()
+	r, rerr := s.Reader(nil)
+	islands := 0
+	err := ComputeProminence(r, rerr, minx, maxx, 0, 0, nil, func(res Result) {
+		if res.Island {
+			islands++
+		} else if res.Col.Z > res.Peak.Z || res.Dom.Z < res.Peak.Z {
+			t.Errorf("bad result %v", res)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if islands == 0 {
+		t.Errorf("no islands")
+	}
+}
+
+func BenchmarkCellSort(b *testing.B) {
+	s := NewSynthetic(1, 1000, 1000, 0, 0.2)
+	for i := 0; i < b.N; i++ {
+		r, rerr := s.Reader(nil)
+		r, rerr = CellSort(r, rerr, nil)
+		for range r {
+		}
+		if err := <-rerr; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComputeProminence(b *testing.B) {
+	s := NewSynthetic(1, 1000, 1000, 0, 0.2)
+	minx, maxx, _, _, _, _ := s.Bounds()
+	for i := 0; i < b.N; i++ {
+		r, rerr := s.Reader(nil)
+		if err := ComputeProminence(r, rerr, minx, maxx, 0, 0, nil, func(Result) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package prominence
+
+import (
+	"math"
+	"sync"
+)
+
+// Void filling.
+//
+// Some data sets have voids: samples with no data, which are not
+// ocean.  Dropping them makes them look like ocean, splitting
+// mountains into separate islands and losing key cols inside the
+// voids.  Instead, an importer can fill them in by interpolating
+// from the samples around the void.
+//
+// We use a Laplacian fill: each filled sample is the average of its
+// four neighbors, so the filled surface is as smooth as possible
+// and meets the real data at the edge of the void.  We start from
+// an inverse-distance weighting of the nearest real sample in each
+// of the four directions, then relax.
+
+// A Filler is a DataSet which fills some of its voids.
+type Filler interface {
+	DataSet
+
+	// Filled reports whether the sample at p was filled in.
+	Filled(p Point) bool
+}
+
+// MarkFilled sets res.PeakFilled and res.ColFilled if d is
+// a Filler and res's peak or key col was filled in.
+func MarkFilled(d DataSet, res *Result) {
+	f, ok := d.(Filler)
+	if !ok {
+		return
+	}
+	res.PeakFilled = f.Filled(res.Peak.P)
+	res.ColFilled = !res.Island && f.Filled(res.Col.P)
+}
+
+// fillVoids fills in the void samples of the w by h grid z, in rows.
+// void[i] reports whether z[i] is a void.  It returns whether each
+// void was filled; voids with no real samples in line with them
+// in any of the four directions, and not connected to any which
+// do, are not.
+func fillVoids(z []Height, void []bool, w, h int) []bool {
+	v := make([]float64, len(z))
+	filled := make([]bool, len(z))
+
+	// Initial guess: inverse-distance weighting of the nearest
+	// real sample in each direction.
+	sum := make([]float64, len(z))
+	wsum := make([]float64, len(z))
+	scan := func(start, step, n int) {
+		last, lastPos := -1, 0
+		for k := 0; k < n; k++ {
+			i := start + k*step
+			if !void[i] {
+				last, lastPos = i, k
+				continue
+			}
+			if last >= 0 {
+				d := float64(k - lastPos)
+				sum[i] += float64(z[last]) / d
+				wsum[i] += 1 / d
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		scan(y*w, 1, w)
+		scan(y*w+w-1, -1, w)
+	}
+	for x := 0; x < w; x++ {
+		scan(x, w, h)
+		scan(x+(h-1)*w, -w, h)
+	}
+	var todo []int // voids to relax
+	for i := range z {
+		if !void[i] {
+			v[i] = float64(z[i])
+			continue
+		}
+		todo = append(todo, i)
+		if wsum[i] > 0 {
+			v[i] = sum[i] / wsum[i]
+			filled[i] = true
+		}
+	}
+	if len(todo) == 0 {
+		return filled
+	}
+
+	// Relax by successive over-relaxation, using only neighbors
+	// which are real or filled.
+	const omega = 1.8
+	for iter := 0; iter < 1000; iter++ {
+		maxDelta := 0.0
+		for _, i := range todo {
+			x := i % w
+			s, n := 0.0, 0
+			use := func(j int) {
+				if !void[j] || filled[j] {
+					s += v[j]
+					n++
+				}
+			}
+			if x > 0 {
+				use(i - 1)
+			}
+			if x < w-1 {
+				use(i + 1)
+			}
+			if i >= w {
+				use(i - w)
+			}
+			if i+w < len(z) {
+				use(i + w)
+			}
+			if n == 0 {
+				continue
+			}
+			avg := s / float64(n)
+			if !filled[i] {
+				v[i], filled[i] = avg, true
+				maxDelta = math.Inf(1)
+				continue
+			}
+			d := omega * (avg - v[i])
+			v[i] += d
+			if math.Abs(d) > maxDelta {
+				maxDelta = math.Abs(d)
+			}
+		}
+		if maxDelta < 0.05 {
+			break
+		}
+	}
+	for _, i := range todo {
+		if filled[i] {
+			z[i] = Height(math.Floor(v[i] + 0.5))
+		}
+	}
+	return filled
+}
+
+// A voidMap records which samples of a data set were filled,
+// as a bitmap for each tile with filled samples.
+type voidMap struct {
+	mu    sync.Mutex
+	tiles map[[2]int][]uint64
+}
+
+// set records the filled samples of tile t:
+// filled[i] reports whether sample i was filled.
+func (m *voidMap) set(t [2]int, filled []bool) {
+	var b []uint64
+	for i, f := range filled {
+		if f {
+			if b == nil {
+				b = make([]uint64, (len(filled)+63)/64)
+			}
+			b[i/64] |= 1 << uint(i%64)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b == nil {
+		delete(m.tiles, t)
+		return
+	}
+	if m.tiles == nil {
+		m.tiles = map[[2]int][]uint64{}
+	}
+	m.tiles[t] = b
+}
+
+// get reports whether sample i of tile t was filled.
+func (m *voidMap) get(t [2]int, i int) bool {
+	m.mu.Lock()
+	b := m.tiles[t]
+	m.mu.Unlock()
+	return b != nil && b[i/64]&(1<<uint(i%64)) != 0
+}
@@ -0,0 +1,97 @@
+package prominence
+
+// Wet prominence (basin depth) computation.
+//
+// The depth of a basin is the least amount of altitude you
+// must gain to walk to a lower basin (or to the sea).  It is
+// the dual of prominence: turn the world upside down and the
+// After Noah's Flood algorithm computes basin depths instead
+// of peak prominences.  The lowest point of a basin is its sink,
+// and the key col is the spill point where water filling the
+// basin first overflows into a lower one.
+//
+// We implement the inversion by negating all altitudes, so that
+// CellSort's descending order is ascending order of the real
+// altitudes.  Cells which are not in the data set (the ocean) and
+// points off the north and south edges of the grid are all part
+// of the sea, which is lower than every basin.
+
+// ComputeBasins computes the depth of all the basins in the data returned by r.
+// ComputeBasins will call f with info about each basin:
+//
+//	sink = local minimum
+//	col = spill point for that basin
+//	dom = sink of the lower basin it spills into
+//	sea = the basin spills into the sea (dom is undefined)
+//	closed = the basin never spills (col and dom are undefined)
+//
+// rerr, opts and the returned error are as for ComputeProminence.
+func ComputeBasins(r <-chan []Cell, rerr <-chan error, minx, maxx, miny, maxy Coord, opts *Options, f func(sink, col, dom Cell, size int64, sea, closed bool)) error {
+	// Record which points are part of the data set, and
+	// turn the world upside down.
+	// CellSort stops reading r2 if it fails, so abort is closed
+	// when we return, to stop this goroutine if it is still sending.
+	land := newBitmap(minx, maxx, miny, maxy)
+	r2 := make(chan []Cell, 1)
+	abort := make(chan struct{})
+	defer close(abort)
+	go func() {
+		defer close(r2)
+		defer drainCells(r)
+		for cslice := range r {
+			for k := range cslice {
+				land.set(cslice[k].P)
+				cslice[k].Z = -cslice[k].Z
+			}
+			select {
+			case r2 <- cslice:
+			case <-abort:
+				chunkPool.Put(cslice)
+				return
+			}
+		}
+	}()
+
+	// Note: CellSort consumes all of its input before returning,
+	// so land is complete before flood starts asking about it.
+	r3, errc := CellSort(r2, rerr, opts)
+
+	sea := func(p Point) bool {
+		return p.Y < miny || p.Y >= maxy || !land.get(p)
+	}
+	flood(patches(r3, abort, minx, maxx, opts), minx, maxx, 0, 0, sea, opts, func(res Result) {
+		peak, col, dom := res.Peak, res.Col, res.Dom
+		peak.Z = -peak.Z
+		col.Z = -col.Z
+		if dom.Z == seaPeak {
+			f(peak, col, Cell{}, res.Size, true, false)
+			return
+		}
+		dom.Z = -dom.Z
+		f(peak, col, dom, res.Size, false, res.Island)
+	})
+	return <-errc
+}
+
+// A bitmap is a set of points in a rectangular region of the grid.
+type bitmap struct {
+	minx, miny Coord
+	w          int64
+	bits       []uint64
+}
+
+func newBitmap(minx, maxx, miny, maxy Coord) *bitmap {
+	w := int64(maxx - minx)
+	n := w * int64(maxy-miny)
+	return &bitmap{minx: minx, miny: miny, w: w, bits: make([]uint64, (n+63)/64)}
+}
+
+func (b *bitmap) set(p Point) {
+	k := int64(p.Y-b.miny)*b.w + int64(p.X-b.minx)
+	b.bits[k/64] |= 1 << uint(k%64)
+}
+
+func (b *bitmap) get(p Point) bool {
+	k := int64(p.Y-b.miny)*b.w + int64(p.X-b.minx)
+	return b.bits[k/64]>>uint(k%64)&1 != 0
+}
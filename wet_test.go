@@ -0,0 +1,81 @@
+package prominence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// A basinRecord is one basin depth calculation result.
+type basinRecord struct {
+	sink   Cell
+	col    Cell
+	dom    Cell
+	sea    bool
+	closed bool
+}
+
+func TestBasins(t *testing.T) {
+	data := parseTest(`
+99899
+99799
+91639
+99999
+`)
+	var got []basinRecord
+	err := ComputeBasins(simpleReader(data), nil, 0, 5, 0, 4, nil, func(sink, col, dom Cell, size int64, sea, closed bool) {
+		got = append(got, basinRecord{sink, col, dom, sea, closed})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].sink.Z < got[j].sink.Z })
+	want := []basinRecord{
+		{Cell{Point{1, 2}, 1}, Cell{Point{2, 0}, 8}, Cell{}, true, false},
+		{Cell{Point{3, 2}, 3}, Cell{Point{2, 2}, 6}, Cell{Point{1, 2}, 1}, false, false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %v, got %v", want[i], got[i])
+		}
+	}
+}
+
+func TestBasinsSortError(t *testing.T) {
+	// CellSort can't make its temporary file, so it fails without
+	// reading its input.  ComputeBasins must still let the sender
+	// of its input finish.
+	dir, err := ioutil.TempDir("", "basins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := make(chan []Cell)
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			r <- []Cell{{Point{Coord(i), 0}, Height(i)}}
+		}
+		close(r)
+		close(sent)
+	}()
+	opts := &Options{TmpDir: filepath.Join(dir, "missing")}
+	err = ComputeBasins(r, nil, 0, 10, 0, 1, opts, func(sink, col, dom Cell, size int64, sea, closed bool) {
+		t.Errorf("got basin %v from a failed sort", sink)
+	})
+	if err == nil {
+		t.Error("no error from a failed sort")
+	}
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender blocked")
+	}
+}